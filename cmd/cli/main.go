@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/ameistad/turkis/internal/cli/commands"
 )
 
 func main() {
+	// Cancel running builds and deployments on Ctrl-C.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	rootCmd := commands.NewRootCmd()
-	if err := rootCmd.Execute(); err != nil {
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		// Pass on the exit code of a command run with 'turkis run'.
+		var exitErr *commands.ExitCodeError
+		if errors.As(err, &exitErr) {
+			stop()
+			os.Exit(exitErr.Code)
+		}
 		// Print error once, then exit
 		fmt.Fprintln(os.Stderr, err)
+		stop()
 		os.Exit(1)
 	}
 }
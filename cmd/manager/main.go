@@ -1,35 +1,50 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/haproxy"
 	"github.com/ameistad/turkis/internal/manager"
+	"github.com/ameistad/turkis/internal/manager/certificates"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	// RefreshInterval is how often to refresh the full configuration
 	RefreshInterval = 5 * time.Minute
-	// CertificatesDir is the directory where certificates are stored
-	CertificatesDir = "/usr/local/etc/haproxy/certs"
+	// CertificatesDir is the directory where certificates are stored. HAProxy loads it from HAProxyCertificatesDir
+	CertificatesDir = "/cert-storage"
+	// HAProxyCertificatesDir is where the HAProxy container mounts CertificatesDir
+	HAProxyCertificatesDir = "/usr/local/etc/haproxy/certs"
 	// WebRootDir is the directory for ACME HTTP-01 challenges
 	WebRootDir = "/var/www/lego"
 	// CertRefreshInterval is how often to check for certificate renewals
 	CertRefreshInterval = 12 * time.Hour
+	// HAProxyConfigPath is where the generated haproxy.cfg is written
+	HAProxyConfigPath = "/haproxy-config/haproxy.cfg"
+	// HAProxyContainerConfigDir is where the HAProxy container mounts the directory of HAProxyConfigPath
+	HAProxyContainerConfigDir = "/usr/local/etc/haproxy/config"
+	// HAProxySocketPath is the HAProxy runtime API socket, shared through the haproxy-socket volume
+	HAProxySocketPath = "/var/run/haproxy/admin.sock"
 )
 
 var logger = logrus.New()
@@ -42,6 +57,8 @@ type ContainerEvent struct {
 func main() {
 	// Parse command line flags
 	dryRunFlag := flag.Bool("dry-run", false, "Run in dry-run mode (don't actually send commands to HAProxy)")
+	apiAddr := flag.String("api-addr", ":80", "Address for the manager API used by the turkis CLI")
+	debounceFlag := flag.Duration("debounce", manager.DefaultDebounce, "How long to wait for more container events before regenerating the HAProxy config (or set DEBOUNCE)")
 	flag.Parse()
 
 	// Configure logger
@@ -52,6 +69,39 @@ func main() {
 	dryRunEnv := os.Getenv("DRY_RUN") == "true"
 	dryRun := *dryRunFlag || dryRunEnv
 
+	tlsStaging := false
+	if v := os.Getenv("LEGO_STAGING"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid LEGO_STAGING '%s': %v", v, err)
+		}
+		tlsStaging = b
+	}
+
+	debounce := *debounceFlag
+	if v := os.Getenv("DEBOUNCE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid DEBOUNCE '%s': %v", v, err)
+		}
+		debounce = d
+	}
+
+	// The API can change routing and certificates, and the app containers share its network.
+	apiToken, err := envOrFile("TURKIS_MANAGER_TOKEN")
+	if err != nil {
+		log.Fatalf("Failed to read the manager API token: %v", err)
+	}
+	if apiToken == "" {
+		log.Fatalf("TURKIS_MANAGER_TOKEN or TURKIS_MANAGER_TOKEN_FILE must be set, run 'turkis init' to create a token")
+	}
+
+	// The EAB HMAC key is a secret, so it is never taken from the labels of the apps.
+	eabHMACKey, err := envOrFile("ACME_EAB_HMAC_KEY")
+	if err != nil {
+		log.Fatalf("Failed to read the EAB HMAC key: %v", err)
+	}
+
 	if dryRun {
 		fmt.Println("========================")
 		fmt.Println("STARTING IN DRY RUN MODE")
@@ -76,21 +126,59 @@ func main() {
 	eventsChan := make(chan ContainerEvent)
 	errorsChan := make(chan error)
 
-	// Initialize certificate manager if TLS is enabled
-	// var certManager *certificates.Manager
-	// var domainWatcher *certificates.DomainWatcher
+	updater := manager.NewUpdater(HAProxyConfigPath, haproxy.NewRuntimeClient(HAProxySocketPath), func(ctx context.Context) error {
+		return reloadHAProxy(ctx, dockerClient)
+	}, func(ctx context.Context, path string) error {
+		return validateHAProxyConfig(ctx, dockerClient, path)
+	}, dryRun)
+
+	// Certificates are obtained for the domains of the running containers. The ACME account
+	// uses the email from their labels, and the CA settings from the labels or the environment.
+	var certs *manager.Certificates
+	if !dryRun {
+		certs = manager.NewCertificates(certificates.Config{
+			CertDir:         CertificatesDir,
+			WebRootDir:      WebRootDir,
+			HAProxySocket:   HAProxySocketPath,
+			HAProxyCertDir:  HAProxyCertificatesDir,
+			Logger:          logger,
+			TlsStaging:      tlsStaging,
+			CADirURL:        os.Getenv("ACME_CA_DIRECTORY"),
+			EABKeyID:        os.Getenv("ACME_EAB_KEY_ID"),
+			EABHMACKey:      eabHMACKey,
+			CABundle:        os.Getenv("ACME_CA_BUNDLE"),
+			PreferredChain:  os.Getenv("ACME_PREFERRED_CHAIN"),
+			RenewalInterval: CertRefreshInterval,
+			Reload: func(ctx context.Context) error {
+				return reloadHAProxy(ctx, dockerClient)
+			},
+		})
+		go certs.Run(ctx)
+	}
+
+	// The reconciler is the only writer of haproxy.cfg. Everything else triggers it.
+	reconciler := manager.NewReconciler(dockerClient, updater, certs, debounce)
+	go reconciler.Run(ctx)
+
+	// Start the API the CLI uses to follow deployments
+	apiServer := &http.Server{Addr: *apiAddr, Handler: manager.RequireToken(apiToken, manager.NewAPIHandler(updater, reconciler, certs))}
+	go func() {
+		if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Manager API stopped: %v", err)
+		}
+	}()
+	defer apiServer.Close()
 
 	// Start Docker event listener
 	go listenForDockerEvents(ctx, dockerClient, eventsChan, errorsChan)
 
+	// Pick up whatever changed while the manager wasn't running.
+	reconciler.Trigger("startup")
+
 	// Start periodic full refresh
 	refreshTicker := time.NewTicker(RefreshInterval)
 	defer refreshTicker.Stop()
 
-	// Start certificate refresh ticker if TLS is enabled
-	certRefreshTicker := time.NewTicker(CertRefreshInterval)
-	defer certRefreshTicker.Stop()
-
 	fmt.Printf("Manager service started on network %s...\n", config.DockerNetwork)
 
 	// Main event loop
@@ -98,142 +186,46 @@ func main() {
 		select {
 		case <-sigChan:
 			fmt.Println("\nShutting down gracefully...")
-			// Stop certificate manager
-			// if certManager != nil {
-			// 	certManager.Stop()
-			// }
+			// Also stops the certificate manager.
 			cancel()
 			return
 		case e := <-eventsChan:
-			switch e.Event.Action {
-			case "start":
-				log.Printf("Container %s event: %s", e.Event.Action, e.Event.Actor.ID[:12])
-				// Get container details
-
-				labels, err := config.ParseContainerLabels(e.Container.Config.Labels)
-				if err != nil {
-					log.Printf("Error parsing container labels: %v", err)
-					continue
-				}
-
-				log.Printf("Container %s has app name '%s' and deployment ID '%s'", e.Container.ID[:12], labels.AppName, labels.DeploymentID)
-
-				// Execute in a goroutine to avoid blocking the event loop
-				go func() {
-					// Create a child context for the deployment process.
-					_, cancelDeployment := context.WithCancel(ctx)
-					defer cancelDeployment()
-
-					log.Printf("Starting deployment for %s\n", labels.AppName)
-
-					deployments, err := manager.CreateDeployments(ctx, dockerClient)
-					if err != nil {
-						log.Printf("Failed to create deployments: %v", err)
-						return
-					}
-
-					buf, err := manager.CreateHAProxyConfig(deployments)
-					if err != nil {
-						log.Printf("Failed to create config %v", err)
-						return
-					}
-
-					configDirPath, err := config.ConfigDirPath()
-					if err != nil {
-						log.Printf("Failed to determine config directory path: %v", err)
-						return
-					}
-
-					if !dryRun {
-						if err := os.WriteFile("/haproxy-config/haproxy.cfg", buf.Bytes(), 0644); err != nil {
-							log.Printf("Failed to write updated config file: %v", err)
-							return
-						}
-						log.Printf("Sending SIGUSR2 command to haproxy...")
-						haproxyID, err := getHaproxyContainerID(ctx, dockerClient)
-						if err != nil {
-							log.Fatalf("Error locating HAProxy container: %v", err)
-						}
-
-						err = dockerClient.ContainerKill(ctx, haproxyID, "SIGUSR2")
-						if err != nil {
-							log.Printf("Failed to send SIGUSR2: %v", err)
-						} else {
-							log.Println("Sent SIGUSR2 to HAProxy")
-						}
-						if err != nil {
-							log.Printf("Failed to send SIGUSR2 to HAProxy: %v", err)
-						} else {
-							log.Println("Sent SIGUSR2 to HAProxy")
-						}
-					} else {
-						log.Printf("Generated HAProxy config would have been written to %s:\n%s", configDirPath, buf.String())
-					}
-
-					log.Printf("Deployment completed for app '%s' (deployment: '%s')",
-						labels.AppName, labels.DeploymentID)
-				}()
-
-			case "die", "stop", "kill":
-				log.Printf("Container %s event: %s", e.Event.Action, e.Event.Actor.ID[:12])
-
-				labels, err := config.ParseContainerLabels(e.Container.Config.Labels)
-				if err != nil {
-					log.Printf("Error parsing container labels: %v", err)
-					continue
-				}
-
-				// TODO: clean up old deployements:
-				// - remove old containers
-				// - remove old certificates
-				// - remove old HAProxy backends
-				logger.Printf("Removing container %s", labels.AppName)
-
+			log.Printf("Container %s event: %s", e.Event.Action, e.Event.Actor.ID[:12])
+			if e.Event.Action == "start" {
+				// A container that was drained and is started again, e.g. by a rollback, serves again.
+				updater.Undrain([]string{e.Event.Actor.ID})
 			}
+			reconciler.Trigger(fmt.Sprintf("%s of container %s", e.Event.Action, e.Event.Actor.ID[:12]))
 
 		case err := <-errorsChan:
 			log.Printf("Error from Docker events: %v", err)
-		case <-refreshTicker.C:
-			// Periodic full refresh
-			log.Println("Performing periodic HAProxy configuration refresh")
+			// Events may have been missed while the stream was down.
+			reconciler.Trigger("reconnecting to Docker events")
 
-			// Get all running containers on our network
-			containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{})
-			if err != nil {
-				log.Printf("Error listing containers for refresh: %v", err)
-				continue
-			}
-
-			for _, containerSummary := range containers {
-				container, err := dockerClient.ContainerInspect(ctx, containerSummary.ID)
-				if err != nil {
-					continue
-				}
-
-				// Check if container is on our network
-				eligible := isContainerEligible(container)
-				if !eligible {
-					continue
-				}
-
-				labels, err := config.ParseContainerLabels(container.Config.Labels)
-				if err != nil {
-					log.Printf("Error parsing container labels: %v", err)
-					continue
-				}
-
-				// TODO: do the same as for the start event.
-				logger.Printf("Refreshing container %s", labels.AppName)
-			}
-
-			log.Println("HAProxy configuration refresh completed")
-
-		case <-certRefreshTicker.C:
-			log.Println("Performing periodic certificate refresh")
+		case <-refreshTicker.C:
+			// Periodic full refresh, in case an event was missed.
+			reconciler.Trigger("periodic refresh")
 		}
 	}
 }
 
+// envOrFile returns the value of the environment variable name, or else the contents of the
+// file named by name_FILE, so secrets can be mounted instead of set in docker-compose.yml.
+func envOrFile(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 // listenForDockerEvents sets up a listener for Docker events
 func listenForDockerEvents(ctx context.Context, dockerClient *client.Client, eventsChan chan ContainerEvent, errorsChan chan error) {
 	// Set up filter for container events
@@ -309,6 +301,73 @@ func isOnNetworkCheck(container types.ContainerJSON, networkName string) bool {
 	return false
 }
 
+// reloadHAProxy sends SIGUSR2 to the HAProxy master process, which reloads the configuration.
+func reloadHAProxy(ctx context.Context, dockerClient *client.Client) error {
+	log.Printf("Sending SIGUSR2 command to haproxy...")
+	haproxyID, err := getHaproxyContainerID(ctx, dockerClient)
+	if err != nil {
+		return fmt.Errorf("error locating HAProxy container: %w", err)
+	}
+
+	if err := dockerClient.ContainerKill(ctx, haproxyID, "SIGUSR2"); err != nil {
+		return fmt.Errorf("failed to send SIGUSR2 to HAProxy: %w", err)
+	}
+	log.Println("Sent SIGUSR2 to HAProxy")
+	return nil
+}
+
+// validateHAProxyConfig runs haproxy -c on a config file in the HAProxy container, so it is
+// checked by the same HAProxy version that will load it.
+func validateHAProxyConfig(ctx context.Context, dockerClient *client.Client, path string) error {
+	haproxyID, err := getHaproxyContainerID(ctx, dockerClient)
+	if err != nil {
+		return fmt.Errorf("error locating HAProxy container: %w", err)
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(HAProxyConfigPath), path)
+	if err != nil {
+		return fmt.Errorf("config %s isn't in %s: %w", path, filepath.Dir(HAProxyConfigPath), err)
+	}
+	containerPath := filepath.Join(HAProxyContainerConfigDir, rel)
+	exec, err := dockerClient.ContainerExecCreate(ctx, haproxyID, types.ExecConfig{
+		Cmd:          []string{"haproxy", "-c", "-f", containerPath},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create haproxy -c exec: %w", err)
+	}
+	attach, err := dockerClient.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return fmt.Errorf("failed to run haproxy -c: %w", err)
+	}
+	defer attach.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return fmt.Errorf("failed to read haproxy -c output: %w", err)
+	}
+
+	// The output ends when the process exits, but the exit code can take a moment to show up.
+	for {
+		inspect, err := dockerClient.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect haproxy -c exec: %w", err)
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return &manager.InvalidConfigError{Output: strings.TrimSpace(output.String())}
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 func getHaproxyContainerID(ctx context.Context, dockerClient *client.Client) (string, error) {
 	inspect, err := dockerClient.ContainerInspect(ctx, "turkis-haproxy")
 	if err != nil {
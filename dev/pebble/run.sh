@@ -0,0 +1,33 @@
+#!/bin/bash
+# Runs Pebble, a test ACME server, on the turkis-public network so turkis-manager can obtain
+# certificates without Let's Encrypt. pebble-challtestsrv answers Pebble's DNS queries with the
+# address of turkis-haproxy, so HTTP-01 challenges work for any domain. Point turkis at it in
+# apps.yml:
+#
+# tls:
+#   caDirectory: https://pebble:14000/dir
+#   caBundle: /cert-storage/pebble.minica.pem
+#
+# Go to the project root directory
+cd $(git rev-parse --show-toplevel)
+
+CERT_STORAGE=${CERT_STORAGE:-$HOME/.config/turkis/containers/cert-storage}
+HAPROXY_IP=$(docker inspect -f '{{(index .NetworkSettings.Networks "turkis-public").IPAddress}}' turkis-haproxy)
+
+docker run -d --rm \
+  --name challtestsrv \
+  --network turkis-public \
+  ghcr.io/letsencrypt/pebble-challtestsrv:latest \
+  -defaultIPv4 "$HAPROXY_IP" -defaultIPv6 ""
+
+docker run -d --rm \
+  --name pebble \
+  --network turkis-public \
+  -e PEBBLE_VA_NOSLEEP=1 \
+  -v "$(pwd)/dev/pebble/pebble-config.json:/test/config/pebble-config.json:ro" \
+  ghcr.io/letsencrypt/pebble:latest \
+  -config /test/config/pebble-config.json -dnsserver challtestsrv:8053
+
+# The root of the certificate Pebble serves its API with.
+curl -fsSL https://raw.githubusercontent.com/letsencrypt/pebble/main/test/certs/pebble.minica.pem \
+  -o "$CERT_STORAGE/pebble.minica.pem"
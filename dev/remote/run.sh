@@ -0,0 +1,23 @@
+#!/bin/bash
+# Runs an sshd on 127.0.0.1:2222 that manages the local Docker daemon. Add it to
+# ~/.config/turkis/hosts.yml:
+#
+# hosts:
+#   - name: dev
+#     ssh: ssh://root@127.0.0.1:2222
+#     configPath: /tmp/turkis-remote-dev
+#
+# and try it with 'turkis --host dev status'.
+# Go to the project root directory
+cd $(git rev-parse --show-toplevel)
+
+PUBLIC_KEY=${PUBLIC_KEY:-$HOME/.ssh/id_ed25519.pub}
+
+# The host network lets turkis reach turkis-manager on 127.0.0.1:8080 through the tunnel.
+docker run -d --rm \
+  --name turkis-remote-dev \
+  --network host \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v /tmp/turkis-remote-dev:/tmp/turkis-remote-dev \
+  -v "$PUBLIC_KEY":/tmp/authorized_keys:ro \
+  turkis-remote-dev
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/deploy"
+	"github.com/spf13/cobra"
+)
+
+func PromoteAppCmd() *cobra.Command {
+	promoteAppCmd := &cobra.Command{
+		Use:   "promote <app-name>",
+		Short: "Promote a canary deployment",
+		Long:  `Roll a canary deployment out to all replicas and stop the old deployment`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appConfig, err := config.AppConfigByName(args[0])
+			if err != nil {
+				return err
+			}
+
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			if err := deploy.PromoteCanary(cmd.Context(), rt, appConfig); err != nil {
+				return fmt.Errorf("promote failed: %w", err)
+			}
+			return nil
+		},
+	}
+	return promoteAppCmd
+}
+
+func AbortAppCmd() *cobra.Command {
+	abortAppCmd := &cobra.Command{
+		Use:   "abort <app-name>",
+		Short: "Abort a canary deployment",
+		Long:  `Remove a canary deployment and send all traffic back to the old deployment`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appConfig, err := config.AppConfigByName(args[0])
+			if err != nil {
+				return err
+			}
+
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			if err := deploy.AbortCanary(cmd.Context(), rt, appConfig); err != nil {
+				return fmt.Errorf("abort failed: %w", err)
+			}
+			return nil
+		},
+	}
+	return abortAppCmd
+}
@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ameistad/turkis/internal/deploy"
+	"github.com/ameistad/turkis/internal/manager/certificates"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// expiringSoon is when the days left are shown in red
+const expiringSoon = 14 * 24 * time.Hour
+
+func CertsCmd() *cobra.Command {
+	certsCmd := &cobra.Command{
+		Use:   "certs",
+		Short: "Manage the TLS certificates of turkis-manager",
+		Long: `List, inspect, renew, revoke and prune the certificates turkis-manager obtained for the
+domains of the running apps. The commands go through turkis-manager, also with --host.`,
+	}
+	certsCmd.AddCommand(
+		certsListCmd(),
+		certsInspectCmd(),
+		certsRenewCmd(),
+		certsRevokeCmd(),
+		certsPruneCmd(),
+	)
+	return certsCmd
+}
+
+func certsListCmd() *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List certificates with their names, issuer and expiry",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			asJSON, _ := cmd.Flags().GetBool("json")
+
+			infos, err := deploy.NewManagerClient().Certificates(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list certificates: %w", err)
+			}
+
+			if asJSON {
+				return printJSON(infos)
+			}
+			if len(infos) == 0 {
+				fmt.Println("No certificates")
+				return nil
+			}
+			printCertificates(infos)
+			return nil
+		},
+	}
+	listCmd.Flags().Bool("json", false, "Print the certificates as JSON")
+	return listCmd
+}
+
+func certsInspectCmd() *cobra.Command {
+	inspectCmd := &cobra.Command{
+		Use:   "inspect <domain>",
+		Short: "Show a certificate with its chain and renewal state",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			asJSON, _ := cmd.Flags().GetBool("json")
+
+			info, err := deploy.NewManagerClient().Certificate(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("failed to inspect certificate for '%s': %w", args[0], err)
+			}
+
+			if asJSON {
+				return printJSON(info)
+			}
+			printCertificate(info)
+			return nil
+		},
+	}
+	inspectCmd.Flags().Bool("json", false, "Print the certificate as JSON")
+	return inspectCmd
+}
+
+func certsRenewCmd() *cobra.Command {
+	renewCmd := &cobra.Command{
+		Use:   "renew <domain>",
+		Short: "Renew a certificate if it is due",
+		Long: `Renew the certificate of a domain if it is due, without waiting for the next check or for the
+backoff after a failed order. --force renews it even when it isn't due. The CA's rate limits still apply.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+			force, _ := cmd.Flags().GetBool("force")
+
+			resp, err := deploy.NewManagerClient().RenewCertificate(cmd.Context(), domain, force)
+			if err != nil {
+				return fmt.Errorf("failed to renew certificate for '%s': %w", domain, err)
+			}
+
+			if !resp.Renewed && resp.Certificate.Mode == certificates.ModeManual {
+				fmt.Printf("Certificate for %s is provided by hand and up to date\n", domain)
+				return nil
+			}
+			if !resp.Renewed {
+				fmt.Printf("Certificate for %s isn't due for renewal until %s. Use --force to renew it now.\n",
+					domain, formatTime(resp.Certificate.RenewAt))
+				return nil
+			}
+			fmt.Printf("Renewed certificate for %s, it expires at %s\n", domain, formatTime(resp.Certificate.NotAfter))
+			return nil
+		},
+	}
+	renewCmd.Flags().Bool("force", false, "Renew the certificate even when it isn't due")
+	return renewCmd
+}
+
+func certsRevokeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <domain>",
+		Short: "Revoke a certificate",
+		Long: `Revoke the certificate of a domain, e.g. when its private key was exposed, and delete it.
+A domain that is still served gets a new certificate right away.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+			if err := deploy.NewManagerClient().RevokeCertificate(cmd.Context(), domain); err != nil {
+				return fmt.Errorf("failed to revoke certificate for '%s': %w", domain, err)
+			}
+			fmt.Printf("Revoked certificate for %s\n", domain)
+			return nil
+		},
+	}
+}
+
+func certsPruneCmd() *cobra.Command {
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete certificates of domains no running app uses",
+		Long: `Delete the certificates of domains no running app uses. The domains of apps whose
+containers are stopped count as unused too, so check the list before confirming.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			yes, _ := cmd.Flags().GetBool("yes")
+			client := deploy.NewManagerClient()
+
+			infos, err := client.Certificates(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list certificates: %w", err)
+			}
+			var unused []string
+			for _, info := range infos {
+				if !info.Served {
+					unused = append(unused, info.Domain)
+					fmt.Printf("%s (expires %s)\n", info.Domain, formatTime(info.NotAfter))
+				}
+			}
+			if len(unused) == 0 {
+				fmt.Println("No unused certificates")
+				return nil
+			}
+
+			if !yes {
+				fmt.Printf("Delete %d certificate(s)? [y/N] ", len(unused))
+				var answer string
+				// An empty answer is an error for Scanln, and a no like any other.
+				_, _ = fmt.Scanln(&answer)
+				if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+					fmt.Println("Nothing deleted")
+					return nil
+				}
+			}
+
+			removed, err := client.PruneCertificates(cmd.Context(), unused)
+			if err != nil {
+				return fmt.Errorf("failed to prune certificates: %w", err)
+			}
+			for _, domain := range removed {
+				fmt.Printf("Removed certificate for %s\n", domain)
+			}
+			if len(removed) < len(unused) {
+				fmt.Printf("Warning: %d certificate(s) were kept because an app uses their domain again\n", len(unused)-len(removed))
+			}
+			return nil
+		},
+	}
+	pruneCmd.Flags().BoolP("yes", "y", false, "Delete the certificates without asking")
+	return pruneCmd
+}
+
+func printCertificates(infos []certificates.CertificateInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tMODE\tNAMES\tISSUER\tEXPIRES\tDAYS LEFT\tRENEW AT\tSTATUS")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.Domain,
+			info.Mode,
+			strings.Join(info.Names, ","),
+			orDash(info.Issuer),
+			formatTime(info.NotAfter),
+			daysLeftString(info.NotAfter),
+			formatTime(info.RenewAt),
+			certificateStatus(info),
+		)
+	}
+	w.Flush()
+}
+
+func printCertificate(info certificates.CertificateInfo) {
+	label := color.New(color.FgYellow).SprintFunc()
+
+	fmt.Printf("%s: %s\n", label("Domain"), info.Domain)
+	fmt.Printf("%s: %s\n", label("Mode"), info.Mode)
+	fmt.Printf("%s: %s\n", label("Names"), strings.Join(info.Names, ", "))
+	fmt.Printf("%s: %s\n", label("Issuer"), orDash(info.Issuer))
+	fmt.Printf("%s: %s\n", label("Valid from"), formatTime(info.NotBefore))
+	fmt.Printf("%s: %s (%s days left)\n", label("Expires"), formatTime(info.NotAfter), strings.TrimSpace(daysLeftString(info.NotAfter)))
+	renewal := formatTime(info.RenewAt)
+	if info.ARI {
+		renewal += " (suggested by the CA)"
+	}
+	fmt.Printf("%s: %s\n", label("Renew at"), renewal)
+	fmt.Printf("%s: %s\n", label("Status"), certificateStatus(info))
+	if info.LastError != "" {
+		fmt.Printf("%s: %s\n", label("Last error"), info.LastError)
+	}
+
+	for i, cert := range info.Chain {
+		fmt.Printf("\n%s\n", label(fmt.Sprintf("Chain [%d]", i)))
+		fmt.Printf("  Subject:   %s\n", cert.Subject)
+		fmt.Printf("  Issuer:    %s\n", cert.Issuer)
+		fmt.Printf("  Serial:    %s\n", cert.Serial)
+		if len(cert.Names) > 0 {
+			fmt.Printf("  Names:     %s\n", strings.Join(cert.Names, ", "))
+		}
+		fmt.Printf("  Valid:     %s to %s\n", formatTime(cert.NotBefore), formatTime(cert.NotAfter))
+		fmt.Printf("  Key:       %s, signed with %s\n", cert.KeyAlgorithm, cert.SignatureAlgorithm)
+		fmt.Printf("  CA:        %t\n", cert.IsCA)
+	}
+}
+
+// certificateStatus is whether the certificate is used, and why renewing it failed.
+func certificateStatus(info certificates.CertificateInfo) string {
+	switch {
+	case info.Failures > 0:
+		return color.RedString("failing, retrying at %s", formatTime(info.RetryAt))
+	case info.LastError != "":
+		return color.RedString("failing")
+	case !info.Served:
+		return color.YellowString("unused")
+	default:
+		return color.GreenString("ok")
+	}
+}
+
+func daysLeftString(notAfter time.Time) string {
+	left := time.Until(notAfter)
+	// Color codes would throw off the tabwriter alignment, so pad before coloring.
+	padded := fmt.Sprintf("%-4d", int(left.Hours()/24))
+	if left < expiringSoon {
+		return color.RedString(padded)
+	}
+	return padded
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
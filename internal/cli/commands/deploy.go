@@ -26,9 +26,22 @@ func DeployAppCmd() *cobra.Command {
 				return fmt.Errorf("failed to get configuration for %q: %w", appName, err)
 			}
 
-			return deploy.DeployApp(appConfig)
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			keepFailed, _ := cmd.Flags().GetBool("keep-failed")
+			canary, _ := cmd.Flags().GetInt("canary")
+			if cmd.Flags().Changed("canary") && (canary < 1 || canary > 99) {
+				return fmt.Errorf("--canary must be a percentage between 1 and 99")
+			}
+			return deploy.DeployApp(cmd.Context(), rt, appConfig, deploy.DeployOptions{KeepFailed: keepFailed, Canary: canary})
 		},
 	}
+	deployAppCmd.Flags().Bool("keep-failed", false, "Keep a container that fails its health check for debugging")
+	deployAppCmd.Flags().Int("canary", 0, "Run the new deployment next to the current one with this percentage of the traffic")
 	return deployAppCmd
 }
 
@@ -48,13 +61,21 @@ func DeployAllCmd() *cobra.Command {
 				return fmt.Errorf("configuration error: %w", err)
 			}
 
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			keepFailed, _ := cmd.Flags().GetBool("keep-failed")
+
 			// Iterate over all apps using indices to take a pointer reference.
 			for i := range configFile.Apps {
 				// Create a copy of the app config
 				app := configFile.Apps[i]
 				appConfig := &app
 				fmt.Printf("Deploying app '%s'...\n", appConfig.Name)
-				if err := deploy.DeployApp(appConfig); err != nil {
+				if err := deploy.DeployApp(cmd.Context(), rt, appConfig, deploy.DeployOptions{KeepFailed: keepFailed}); err != nil {
 					fmt.Printf("Failed to deploy app '%s': %v\n", appConfig.Name, err)
 				} else {
 					fmt.Printf("Successfully deployed app '%s'.\n", appConfig.Name)
@@ -63,5 +84,6 @@ func DeployAllCmd() *cobra.Command {
 			return nil
 		},
 	}
+	deployAllCmd.Flags().Bool("keep-failed", false, "Keep containers that fail their health check for debugging")
 	return deployAllCmd
 }
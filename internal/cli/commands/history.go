@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/history"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func HistoryCmd() *cobra.Command {
+	historyCmd := &cobra.Command{
+		Use:   "history <app-name>",
+		Short: "Show the deployment history of an application",
+		Long:  `Show every deploy and rollback of an application, newest first`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appName := args[0]
+			asJSON, _ := cmd.Flags().GetBool("json")
+			limit, _ := cmd.Flags().GetInt("limit")
+
+			historyPath, err := config.HistoryFilePath()
+			if err != nil {
+				return err
+			}
+			entries, err := history.Read(historyPath, appName)
+			if err != nil {
+				return err
+			}
+
+			// Newest first.
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+			if limit > 0 && len(entries) > limit {
+				entries = entries[:limit]
+			}
+
+			if asJSON {
+				if entries == nil {
+					entries = []history.Entry{}
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(entries)
+			}
+
+			if len(entries) == 0 {
+				fmt.Printf("No deployment history for app '%s'\n", appName)
+				return nil
+			}
+			printHistory(entries)
+			return nil
+		},
+	}
+
+	historyCmd.Flags().Bool("json", false, "Print the history as JSON")
+	historyCmd.Flags().IntP("limit", "n", 20, "Number of entries to show, 0 shows all")
+	return historyCmd
+}
+
+func printHistory(entries []history.Entry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPLOYMENT\tACTION\tOUTCOME\tHEALTH\tIMAGE\tCOMMIT\tCONFIG\tUSER\tDURATION\tSTARTED")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orDash(e.DeploymentID),
+			e.Action,
+			outcomeString(e.Outcome),
+			e.HealthCheck,
+			orDash(historyImage(e)),
+			orDash(truncate(e.GitCommit, 12, "-dirty")),
+			orDash(e.ConfigHash),
+			orDash(e.User),
+			e.Duration().Round(time.Second),
+			e.StartedAt.Local().Format("2006-01-02 15:04:05"),
+		)
+	}
+	w.Flush()
+}
+
+// historyImage shows the registry reference that was deployed. For local builds it shows
+// the digest or image ID instead.
+func historyImage(e history.Entry) string {
+	if e.Image != "" {
+		return e.Image
+	}
+	if e.ImageDigest != "" {
+		if _, digest, ok := strings.Cut(e.ImageDigest, "@"); ok {
+			return truncate(strings.TrimPrefix(digest, "sha256:"), 12, "")
+		}
+	}
+	return truncate(strings.TrimPrefix(e.ImageID, "sha256:"), 12, "")
+}
+
+// truncate shortens s to n characters, keeping suffix if s ends with it.
+func truncate(s string, n int, suffix string) string {
+	base := s
+	if suffix != "" && strings.HasSuffix(s, suffix) {
+		base = strings.TrimSuffix(s, suffix)
+	} else {
+		suffix = ""
+	}
+	if len(base) > n {
+		base = base[:n]
+	}
+	return base + suffix
+}
+
+func outcomeString(outcome string) string {
+	// Color codes would throw off the tabwriter alignment, so pad before coloring.
+	padded := fmt.Sprintf("%-9s", outcome)
+	if outcome == history.OutcomeSucceeded {
+		return color.GreenString(padded)
+	}
+	return color.RedString(padded)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
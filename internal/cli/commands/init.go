@@ -2,14 +2,18 @@ package commands
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"github.com/ameistad/turkis/internal/config"
 	"github.com/ameistad/turkis/internal/embed"
+	"github.com/ameistad/turkis/internal/remote"
 	"github.com/spf13/cobra"
 )
 
@@ -17,11 +21,19 @@ func InitCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "init",
 		Short: "Initialize configuration files and prepare HAProxy for production",
+		Long: `Create the configuration files and the containers directory for HAProxy and turkis-manager.
+
+With --host the containers directory is created in the configPath of the server, while apps.yml
+and the test website stay on this machine.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			configDir, err := config.ConfigDirPath()
 			if err != nil {
 				return fmt.Errorf("failed to determine config directory: %w", err)
 			}
+			serverConfigDir, err := config.ServerConfigDirPath()
+			if err != nil {
+				return fmt.Errorf("failed to determine config directory: %w", err)
+			}
 
 			if _, err := os.Stat(configDir); err == nil {
 				fmt.Println("Warning: Configuration directory already exists. Files may be overwritten.")
@@ -31,7 +43,11 @@ func InitCmd() *cobra.Command {
 				"containers/cert-storage",
 				"containers/haproxy-config",
 			}
-			if err := copyConfigFiles(configDir, emptyDirs); err != nil {
+			if err := copyConfigFiles(configDir, serverConfigDir, emptyDirs); err != nil {
+				return err
+			}
+
+			if err := writeManagerToken(); err != nil {
 				return err
 			}
 
@@ -42,6 +58,14 @@ func InitCmd() *cobra.Command {
 
 			fmt.Printf("Configuration files created successfully in %s\n", configDir)
 			fmt.Println("Add your applications to apps.yml and run 'turkis deploy <app-name>' to start the reverse proxy.")
+			if host := config.CurrentHost(); host != nil {
+				fmt.Printf("\nThe containers directory was created in %s on host '%s'.\n", serverConfigDir, host.Name)
+				fmt.Println("\nBefore starting HAProxy and the manager, run the setup script on the server:")
+				fmt.Printf("ssh %s 'cd %s/containers && ./setup.sh'\n", host.SSH, serverConfigDir)
+				fmt.Println("\nThen start the containers with:")
+				fmt.Printf("ssh %s 'docker compose -f %s/containers/docker-compose.yml up -d'", host.SSH, serverConfigDir)
+				return nil
+			}
 			fmt.Println("\nBefore starting HAProxy and the manager, run the setup script:")
 			fmt.Printf("cd %s/containers && ./setup.sh\n", configDir)
 			fmt.Println("\nThen start the containers with:")
@@ -53,7 +77,9 @@ func InitCmd() *cobra.Command {
 	return cmd
 }
 
-func copyConfigFiles(dst string, emptyDirs []string) error {
+// copyConfigFiles copies the embedded config files to dst. The containers directory, which
+// HAProxy and turkis-manager mount, goes to serverDst instead, which is on the server with --host.
+func copyConfigFiles(dst, serverDst string, emptyDirs []string) error {
 	fmt.Printf("Copying config files to %s\n", dst)
 	// Create the destination directory if it doesn't exist
 	if err := os.MkdirAll(dst, 0755); err != nil {
@@ -62,9 +88,9 @@ func copyConfigFiles(dst string, emptyDirs []string) error {
 
 	// Create any empty directories
 	for _, dir := range emptyDirs {
-		dirPath := filepath.Join(dst, dir)
-		if err := os.MkdirAll(dirPath, 0755); err != nil {
-			return fmt.Errorf("failed to create empty directory %s: %w", dirPath, err)
+		dirPath := filepath.Join(serverDst, dir)
+		if err := remote.MkdirAll(dirPath, 0755); err != nil {
+			return fmt.Errorf("failed to create empty directory %s: %w", remote.Location(dirPath), err)
 		}
 	}
 
@@ -79,9 +105,17 @@ func copyConfigFiles(dst string, emptyDirs []string) error {
 		if err != nil {
 			return fmt.Errorf("failed to determine relative path: %w", err)
 		}
+		onServer := relPath == "containers" || strings.HasPrefix(relPath, "containers/")
 
 		targetPath := filepath.Join(dst, relPath)
+		if onServer {
+			targetPath = filepath.Join(serverDst, relPath)
+		}
 		if d.IsDir() {
+			if onServer {
+				// remote.WriteFile creates the directories it needs.
+				return nil
+			}
 			return os.MkdirAll(targetPath, 0755)
 		}
 
@@ -97,14 +131,41 @@ func copyConfigFiles(dst string, emptyDirs []string) error {
 			fileMode = 0755
 		}
 
-		if err := os.WriteFile(targetPath, data, fileMode); err != nil {
-			return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+		if onServer {
+			err = remote.WriteFile(targetPath, data, fileMode)
+		} else {
+			err = os.WriteFile(targetPath, data, fileMode)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write file %s: %w", remote.Location(targetPath), err)
 		}
 
 		return nil
 	})
 }
 
+// writeManagerToken creates the token the manager API requires. An existing token is kept, so
+// running init again doesn't lock the CLI out of a running manager.
+func writeManagerToken() error {
+	tokenPath, err := config.ManagerTokenPath()
+	if err != nil {
+		return fmt.Errorf("failed to determine manager token path: %w", err)
+	}
+	if data, err := remote.ReadFile(tokenPath); err == nil && len(bytes.TrimSpace(data)) > 0 {
+		fmt.Printf("Keeping existing manager token in %s\n", remote.Location(tokenPath))
+		return nil
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("failed to generate manager token: %w", err)
+	}
+	if err := remote.WriteFile(tokenPath, []byte(hex.EncodeToString(token)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write manager token %s: %w", remote.Location(tokenPath), err)
+	}
+	return nil
+}
+
 func copyConfigTemplateFiles() error {
 	// Prompt for email with validation
 	// var email string
@@ -159,7 +220,10 @@ func copyConfigTemplateFiles() error {
 		return fmt.Errorf("failed to determine config file path: %w", err)
 	}
 
-	if err := os.WriteFile(configFilePath, configFile.Bytes(), 0644); err != nil {
+	// apps.yml is shared by all hosts, so setting up another server keeps it.
+	if _, err := os.Stat(configFilePath); err == nil && config.CurrentHost() != nil {
+		fmt.Printf("Keeping existing %s\n", configFilePath)
+	} else if err := os.WriteFile(configFilePath, configFile.Bytes(), 0644); err != nil {
 		return fmt.Errorf("failed to write updated config file: %w", err)
 	}
 
@@ -168,7 +232,7 @@ func copyConfigTemplateFiles() error {
 		return fmt.Errorf("failed to determine HAProxy config file path: %w", err)
 	}
 
-	if err := os.WriteFile(haproxyConfigFilePath, haproxyConfigFile.Bytes(), 0644); err != nil {
+	if err := remote.WriteFile(haproxyConfigFilePath, haproxyConfigFile.Bytes(), 0644); err != nil {
 		return fmt.Errorf("failed to write updated haproxy config file: %w", err)
 	}
 
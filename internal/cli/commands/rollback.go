@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/ameistad/turkis/internal/config"
 	"github.com/ameistad/turkis/internal/deploy"
@@ -12,8 +13,11 @@ func RollbackAppCmd() *cobra.Command {
 	rollbackAppCmd := &cobra.Command{
 		Use:   "rollback <app-name>",
 		Short: "Rollback an application",
-		Long:  `Rollback an application to a previous container image`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Rollback an application to a previous container image.
+
+Apps that deploy an image from a registry can also be rolled back to any earlier tag or digest
+with --tag, which pulls and deploys that image.`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			appName := args[0]
 			appConfig, err := config.AppConfigByName(appName)
@@ -23,9 +27,31 @@ func RollbackAppCmd() *cobra.Command {
 
 			// Retrieve container flag if provided.
 			containerIDFlag, _ := cmd.Flags().GetString("container")
-			var targetContainerID string
+			tagFlag, _ := cmd.Flags().GetString("tag")
+			var target deploy.ContainerInfo
 
-			sortedContainers, err := deploy.SortedContainerInfo(appConfig)
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			if tagFlag != "" {
+				if appConfig.Image == "" {
+					return fmt.Errorf("app '%s' is built locally, --tag only works for apps that deploy an image", appConfig.Name)
+				}
+				image, err := deploy.ImageWithTag(appConfig.Image, tagFlag)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Rolling back app '%s' to image %s\n", appConfig.Name, image)
+				if err := deploy.DeployApp(cmd.Context(), rt, appConfig, deploy.DeployOptions{Image: image, Rollback: true}); err != nil {
+					return fmt.Errorf("rollback failed: %w", err)
+				}
+				return nil
+			}
+
+			sortedContainers, err := deploy.SortedContainerInfo(cmd.Context(), rt, appConfig)
 			if err != nil {
 				return err
 			}
@@ -33,19 +59,22 @@ func RollbackAppCmd() *cobra.Command {
 			if len(sortedContainers) < 2 {
 				return fmt.Errorf("you only have one container for app %s, cannot rollback", appConfig.Name)
 			}
-			currentContainerID := sortedContainers[0].ID
 
-			if containerIDFlag != "" {
-				// Check if containerIDFlag is in sortedContainers and is not sortedContainers[0].
-				if sortedContainers[0].ID == containerIDFlag {
-					return fmt.Errorf("container %s is already the current container", containerIDFlag)
+			// The current deployment is the newest one that is running.
+			current := sortedContainers[0]
+			for _, container := range sortedContainers {
+				if container.Running {
+					current = container
+					break
 				}
+			}
 
+			if containerIDFlag != "" {
 				// if conatinerIDFlag is not in sortedContainers, return an error.
 				found := false
 				for _, container := range sortedContainers {
-					if container.ID == containerIDFlag {
-						targetContainerID = container.ID
+					if strings.HasPrefix(container.ID, containerIDFlag) {
+						target = container
 						found = true
 						break
 					}
@@ -53,13 +82,27 @@ func RollbackAppCmd() *cobra.Command {
 				if !found {
 					return fmt.Errorf("container %s is not part of the deployment, check running containers with docker ps -a", containerIDFlag)
 				}
+				if target.DeploymentID == current.DeploymentID {
+					return fmt.Errorf("container %s is already part of the current deployment", containerIDFlag)
+				}
 			} else {
-				targetContainerID = sortedContainers[1].ID
+				// Roll back to the deployment before the current one.
+				found := false
+				for _, container := range sortedContainers {
+					if container.DeploymentID < current.DeploymentID {
+						target = container
+						found = true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("no deployment of app %s older than %s to roll back to", appConfig.Name, current.DeploymentID)
+				}
 			}
 
-			fmt.Printf("Current container: %s\n", currentContainerID)
-			fmt.Printf("Rolling back app '%s' to container %s\n", appConfig.Name, targetContainerID)
-			if err := deploy.RollbackToContainer(currentContainerID, targetContainerID, appConfig.HealthCheckPath); err != nil {
+			fmt.Printf("Current deployment: %s\n", current.DeploymentID)
+			fmt.Printf("Rolling back app '%s' to deployment %s\n", appConfig.Name, target.DeploymentID)
+			if err := deploy.RollbackToContainer(cmd.Context(), rt, appConfig, target); err != nil {
 				return fmt.Errorf("rollback failed: %w", err)
 			}
 
@@ -68,5 +111,7 @@ func RollbackAppCmd() *cobra.Command {
 	}
 
 	rollbackAppCmd.Flags().StringP("container", "c", "", "Specify container ID to use for rollback")
+	rollbackAppCmd.Flags().StringP("tag", "t", "", "Redeploy the app's image with this tag or digest")
+	rollbackAppCmd.MarkFlagsMutuallyExclusive("container", "tag")
 	return rollbackAppCmd
 }
@@ -1,6 +1,9 @@
 package commands
 
 import (
+	"os"
+
+	"github.com/ameistad/turkis/internal/config"
 	"github.com/spf13/cobra"
 )
 
@@ -11,16 +14,38 @@ func NewRootCmd() *cobra.Command {
 		Short:         "turkis builds and runs Docker containers based on a YAML config",
 		SilenceErrors: true, // Don't print errors automatically
 		SilenceUsage:  true, // Don't show usage on error
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			hostName, _ := cmd.Flags().GetString("host")
+			if hostName == "" {
+				hostName = os.Getenv("TURKIS_HOST")
+			}
+			if hostName == "" {
+				return nil
+			}
+			host, err := config.HostByName(hostName)
+			if err != nil {
+				return err
+			}
+			config.UseHost(host)
+			return nil
+		},
 	}
+	cmd.PersistentFlags().String("host", "", "Manage the server with this name from hosts.yml over SSH (or set TURKIS_HOST)")
 
 	// Add all subcommands
 	cmd.AddCommand(
+		AbortAppCmd(),
+		CertsCmd(),
 		CompletionCmd(),
 		DeployAppCmd(),
 		DeployAllCmd(),
+		HistoryCmd(),
 		InitCmd(),
 		ListAppsCmd(),
+		PromoteAppCmd(),
 		RollbackAppCmd(),
+		RunAppCmd(),
+		ScaleAppCmd(),
 		StatusAppCmd(),
 		StatusAllCmd(),
 		ValidateCmd(),
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/deploy"
+	"github.com/moby/term"
+	"github.com/spf13/cobra"
+)
+
+// ExitCodeError makes turkis exit with the exit code of a command it ran, without printing anything.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.Code)
+}
+
+func RunAppCmd() *cobra.Command {
+	runAppCmd := &cobra.Command{
+		Use:   "run <app-name> -- <command> [args...]",
+		Short: "Run a one-off command in an application's image",
+		Long: `Run a command in a new container from the image of the running deployment, with the same
+env, volumes and network as the app, e.g. to open a console or run a maintenance script.
+turkis-manager never routes traffic to the container, and it is removed when the command exits.
+
+A terminal is allocated when stdin is one, use --no-tty to pipe input and output.`,
+		Example: `  turkis run example-app -- bin/rails console
+  turkis run --no-tty example-app -- bin/cleanup < ids.txt`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Without -- flags of the command would be taken for turkis flags.
+			if dash := cmd.ArgsLenAtDash(); dash > 1 {
+				return fmt.Errorf("expected only the app name before --, got %d arguments", dash)
+			}
+			appName := args[0]
+			appConfig, err := config.AppConfigByName(appName)
+			if err != nil {
+				return err
+			}
+
+			noTTY, _ := cmd.Flags().GetBool("no-tty")
+			_, stdinIsTerminal := term.GetFdInfo(os.Stdin)
+
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			exitCode, err := deploy.RunCommand(cmd.Context(), rt, appConfig, args[1:], stdinIsTerminal && !noTTY)
+			if err != nil {
+				return fmt.Errorf("failed to run command for app '%s': %w", appName, err)
+			}
+			if exitCode != 0 {
+				return &ExitCodeError{Code: exitCode}
+			}
+			return nil
+		},
+	}
+	runAppCmd.Flags().BoolP("no-tty", "T", false, "Don't allocate a terminal, even if stdin is one")
+	return runAppCmd
+}
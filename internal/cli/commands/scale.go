@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/deploy"
+	"github.com/spf13/cobra"
+)
+
+func ScaleAppCmd() *cobra.Command {
+	scaleAppCmd := &cobra.Command{
+		Use:   "scale <app-name> <replicas>",
+		Short: "Change the number of replicas of an application",
+		Long: `Start or remove replicas of the running deployment of an application without redeploying it.
+The new count is saved as replicas in apps.yml so later deploys keep it.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appName := args[0]
+			replicas, err := strconv.Atoi(args[1])
+			if err != nil || replicas < 1 {
+				return fmt.Errorf("replicas must be a number of at least 1, got '%s'", args[1])
+			}
+
+			appConfig, err := config.AppConfigByName(appName)
+			if err != nil {
+				return err
+			}
+
+			rt, err := deploy.NewDockerRuntime()
+			if err != nil {
+				return err
+			}
+			defer rt.Close()
+
+			if err := deploy.ScaleApp(cmd.Context(), rt, appConfig, replicas); err != nil {
+				return fmt.Errorf("failed to scale app '%s': %w", appName, err)
+			}
+
+			configFilePath, err := config.ConfigFilePath()
+			if err != nil {
+				return err
+			}
+			if err := config.SetAppReplicas(configFilePath, appName, replicas); err != nil {
+				return fmt.Errorf("scaled app '%s' but could not save replicas to the config file: %w", appName, err)
+			}
+			return nil
+		},
+	}
+	return scaleAppCmd
+}
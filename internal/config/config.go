@@ -1,9 +1,14 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -21,10 +26,53 @@ const (
 	// DefaultContainerPort is the port on which your container serves HTTP.
 	DefaultContainerPort = "80"
 
+	// DefaultReplicas is the default number of containers to run per app.
+	DefaultReplicas = 1
+
+	// DefaultMaxSurge is how many replicas a deploy may start above the desired count.
+	DefaultMaxSurge = 1
+
+	// DefaultDrainTime is how long, in seconds, old containers get to finish open sessions during a cutover.
+	DefaultDrainTime = 10
+
+	// DefaultRedirectCode is the status of the redirects to HTTPS and from aliases.
+	DefaultRedirectCode = 301
+
+	// DefaultRateLimitPeriod is the window a rate limit counts requests in.
+	DefaultRateLimitPeriod = "10s"
+	// DefaultRateLimitStatus is the status of the requests over a rate limit.
+	DefaultRateLimitStatus = 429
+
+	// DefaultManagerURL is where the turkis-manager API is published on the host.
+	DefaultManagerURL = "http://127.0.0.1:8080"
+
 	ConfigFileName = "apps.yml"
 
 	HAProxyConfigFileName = "haproxy.cfg"
 
+	HistoryFileName = "history.jsonl"
+
+	// ManagerTokenFileName holds the token of the manager API, next to docker-compose.yml.
+	ManagerTokenFileName = "manager-token"
+
+	// TLSChallengeHTTP01 obtains certificates by serving a token on port 80. It is the default.
+	TLSChallengeHTTP01 = "http-01"
+
+	// TLSChallengeDNS01 obtains certificates with a TXT record. Wildcard domains need it.
+	TLSChallengeDNS01 = "dns-01"
+
+	// TLSModeACME obtains a domain's certificate from an ACME CA. It is the default.
+	TLSModeACME = "acme"
+
+	// TLSModeManual serves a certificate and key provided by the user.
+	TLSModeManual = "manual"
+
+	// TLSModeSelfSigned issues certificates from a CA turkis-manager creates, for private domains.
+	TLSModeSelfSigned = "self-signed"
+
+	// TLSModeNone serves the domain over plain HTTP only.
+	TLSModeNone = "none"
+
 	// TODO: Consider adding labelPrefix
 	// LabelPreix = "turkis"
 )
@@ -49,6 +97,19 @@ func ConfigDirPath() (string, error) {
 	return filepath.Join(home, ".config", "turkis"), nil
 }
 
+// ManagerURL returns the base URL of the turkis-manager API. With --host it is the URL on
+// the server, reached through ssh.
+// If TURKIS_MANAGER_URL is set, it will use that instead.
+func ManagerURL() string {
+	if envURL, ok := os.LookupEnv("TURKIS_MANAGER_URL"); ok && envURL != "" {
+		return envURL
+	}
+	if currentHost != nil && currentHost.ManagerURL != "" {
+		return currentHost.ManagerURL
+	}
+	return DefaultManagerURL
+}
+
 // ConfigFilePath returns "~/.config/turkis/apps.yml".
 func ConfigFilePath() (string, error) {
 	configDirPath, err := ConfigDirPath()
@@ -58,14 +119,43 @@ func ConfigFilePath() (string, error) {
 	return filepath.Join(configDirPath, ConfigFileName), nil
 }
 
+// ConfigContainersPath returns "~/.config/turkis/containers" on the server.
 func ConfigContainersPath() (string, error) {
-	configDirPath, err := ConfigDirPath()
+	configDirPath, err := ServerConfigDirPath()
 	if err != nil {
 		return "", err
 	}
 	return filepath.Join(configDirPath, "containers"), nil
 }
 
+// FailedDeploymentsPath returns "~/.config/turkis/failed-deployments" on the server.
+func FailedDeploymentsPath() (string, error) {
+	configDirPath, err := ServerConfigDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDirPath, "failed-deployments"), nil
+}
+
+// ManagerTokenPath returns "~/.config/turkis/containers/manager-token" on the server. The
+// manager API only answers requests that carry the token in this file.
+func ManagerTokenPath() (string, error) {
+	containersPath, err := ConfigContainersPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(containersPath, ManagerTokenFileName), nil
+}
+
+// HistoryFilePath returns "~/.config/turkis/history.jsonl" on the server.
+func HistoryFilePath() (string, error) {
+	configDirPath, err := ServerConfigDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDirPath, HistoryFileName), nil
+}
+
 func HAProxyConfigFilePath() (string, error) {
 	containersPath, err := ConfigContainersPath()
 	if err != nil {
@@ -79,6 +169,72 @@ func HAProxyConfigFilePath() (string, error) {
 type Domain struct {
 	Canonical string   `yaml:"canonical"`
 	Aliases   []string `yaml:"aliases,omitempty"`
+	// Paths limits the app to these path prefixes of the domain, so other apps can serve the
+	// rest. Empty means all paths.
+	Paths []Path    `yaml:"paths,omitempty"`
+	TLS   DomainTLS `yaml:"tls,omitempty"`
+}
+
+// Path routes the requests for a path prefix of a domain to the app. A plain string is the prefix.
+type Path struct {
+	// Prefix matches the path itself and everything below it, e.g. /api matches /api and
+	// /api/users but not /apis.
+	Prefix string `yaml:"prefix"`
+	// StripPrefix removes the prefix before the request is passed to the app.
+	StripPrefix bool `yaml:"stripPrefix,omitempty"`
+	// Priority orders the routes of a domain across apps, highest first. Routes with the same
+	// priority are ordered by the length of their prefix, longest first.
+	Priority int `yaml:"priority,omitempty"`
+	// Access replaces the access settings of the app for the path. Nil means the app's.
+	Access *Access `yaml:"access,omitempty"`
+}
+
+// UnmarshalYAML handles decoding a Path from either a plain scalar or a mapping.
+func (p *Path) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = Path{Prefix: value.Value}
+		return nil
+	}
+	type pathAlias Path // alias to avoid recursion
+	var pa pathAlias
+	if err := value.Decode(&pa); err != nil {
+		return err
+	}
+	*p = Path(pa)
+	return nil
+}
+
+// Covers reports whether the prefix of p matches every path the prefix of other does.
+func (p Path) Covers(other Path) bool {
+	return p.Prefix == "/" || other.Prefix == p.Prefix || strings.HasPrefix(other.Prefix, p.Prefix+"/")
+}
+
+// RoutePaths returns the paths the domain routes to its app, / when it doesn't set any.
+func (d Domain) RoutePaths() []Path {
+	if len(d.Paths) == 0 {
+		return []Path{{Prefix: "/"}}
+	}
+	return d.Paths
+}
+
+// DomainTLS configures where the certificate of a domain and its aliases comes from.
+type DomainTLS struct {
+	// Mode is acme, manual, self-signed or none. Empty means acme.
+	Mode string `yaml:"mode,omitempty"`
+	// Cert and Key are the PEM files of a manual certificate, as paths in the manager
+	// container, e.g. /cert-storage/manual/example.internal.crt.
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+// UsesACME reports whether the domain's certificate comes from an ACME CA.
+func (d Domain) UsesACME() bool {
+	return d.TLS.Mode == "" || d.TLS.Mode == TLSModeACME
+}
+
+// ServesHTTPS reports whether the domain is served over HTTPS, and plain HTTP redirects to it.
+func (d Domain) ServesHTTPS() bool {
+	return d.TLS.Mode != TLSModeNone
 }
 
 // UnmarshalYAML handles decoding a Domain from either a plain scalar or a mapping.
@@ -108,11 +264,79 @@ func (d *Domain) UnmarshalYAML(value *yaml.Node) error {
 	return fmt.Errorf("unexpected YAML node kind %d for Domain", value.Kind)
 }
 
+// Command is a command run in a container. A plain string is run with /bin/sh -c, a list
+// is run as is, like the shell and exec forms of a Dockerfile CMD.
+type Command []string
+
+// UnmarshalYAML handles decoding a Command from either a plain scalar or a sequence.
+func (c *Command) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		if value.Value == "" {
+			*c = nil
+			return nil
+		}
+		*c = Command{"/bin/sh", "-c", value.Value}
+		return nil
+	case yaml.SequenceNode:
+		var args []string
+		if err := value.Decode(&args); err != nil {
+			return err
+		}
+		*c = args
+		return nil
+	}
+	return fmt.Errorf("unexpected YAML node kind %d for command", value.Kind)
+}
+
+// Hooks are commands run in one-off containers from the new image during a deploy.
+type Hooks struct {
+	// PreDeploy runs before the first new replica starts, e.g. database migrations.
+	PreDeploy Command `yaml:"preDeploy,omitempty"`
+	// PostDeploy runs once all new replicas are healthy, before the old ones are stopped.
+	PostDeploy Command `yaml:"postDeploy,omitempty"`
+}
+
+// TLSConfig configures how certificates are obtained for an app's domains.
+type TLSConfig struct {
+	// Challenge is http-01 or dns-01. Empty means http-01.
+	Challenge string `yaml:"challenge,omitempty"`
+	// DNSProvider is the lego DNS provider that solves dns-01 challenges, e.g. route53.
+	DNSProvider string `yaml:"dnsProvider,omitempty"`
+
+	// The settings below are for the ACME account, so they can only be set in the top-level
+	// tls section. Unset ones fall back to the manager's environment.
+
+	// CADirectory is the ACME directory URL of the CA. Empty means Let's Encrypt.
+	CADirectory string `yaml:"caDirectory,omitempty"`
+	// EAB binds the account to an existing account at the CA, e.g. at ZeroSSL.
+	EAB EAB `yaml:"eab,omitempty"`
+	// CABundle is a PEM file in the manager container with the CAs to trust for the ACME
+	// server, e.g. /cert-storage/pebble.minica.pem.
+	CABundle string `yaml:"caBundle,omitempty"`
+	// PreferredChain is the common name of the root to prefer when the CA offers more than one chain.
+	PreferredChain string `yaml:"preferredChain,omitempty"`
+}
+
+// EAB holds the External Account Binding credentials a CA hands out.
+type EAB struct {
+	KeyID string `yaml:"keyId,omitempty"`
+	// HMACKey is only here to reject it. The settings end up in the labels of every container,
+	// so the HMAC key is read from the manager's environment instead.
+	HMACKey string `yaml:"hmacKey,omitempty"`
+}
+
+// accountSettings returns only the ACME account settings of t.
+func (t TLSConfig) accountSettings() TLSConfig {
+	return TLSConfig{CADirectory: t.CADirectory, EAB: t.EAB, CABundle: t.CABundle, PreferredChain: t.PreferredChain}
+}
+
 // AppConfig defines the configuration for an application.
 type AppConfig struct {
 	Name              string            `yaml:"name"`
 	Domains           []Domain          `yaml:"domains"`
 	ACMEEmail         string            `yaml:"acmeEmail"`
+	Image             string            `yaml:"image,omitempty"`
 	Dockerfile        string            `yaml:"dockerfile"`
 	BuildContext      string            `yaml:"buildContext"`
 	Env               map[string]string `yaml:"env"`
@@ -120,11 +344,165 @@ type AppConfig struct {
 	Volumes           []string          `yaml:"volumes,omitempty"`
 	HealthCheckPath   string            `yaml:"healthCheckPath,omitempty"`
 	Port              string            `yaml:"port,omitempty"`
+	DrainTime         int               `yaml:"drainTime,omitempty"`
+	Replicas          int               `yaml:"replicas,omitempty"`
+	MaxSurge          int               `yaml:"maxSurge,omitempty"`
+	MaxUnavailable    int               `yaml:"maxUnavailable,omitempty"`
+	Hooks             Hooks             `yaml:"hooks,omitempty"`
+	TLS               TLSConfig         `yaml:"tls,omitempty"`
+	HTTP              HTTPConfig        `yaml:"http,omitempty"`
+	Access            Access            `yaml:"access,omitempty"`
+	// RateLimit limits the requests per client IP. Nil means the top-level rateLimit.
+	RateLimit *RateLimit `yaml:"rateLimit,omitempty"`
+	// MaxConnections is how many connections each replica gets at once, more wait in a queue.
+	// 0 means the top-level maxConnections, or no limit.
+	MaxConnections int `yaml:"maxConnections,omitempty"`
+}
+
+// RateLimit limits how many requests a client IP makes to an app.
+type RateLimit struct {
+	// Requests is how many requests a client IP may make per Period. 0 means no limit.
+	Requests int `yaml:"requests"`
+	// Period is the window the requests are counted in, e.g. 10s or 1m.
+	Period string `yaml:"period,omitempty"`
+	// Burst is how many requests a client IP may make within a second, so it can't use up
+	// Requests all at once. 0 means no limit per second.
+	Burst int `yaml:"burst,omitempty"`
+	// Status is the response to the requests over the limit.
+	Status int `yaml:"status,omitempty"`
+}
+
+// Enabled reports whether requests are limited.
+func (r RateLimit) Enabled() bool {
+	return r.Requests > 0
+}
+
+// Window is the parsed Period, the default period when it's empty or invalid.
+func (r RateLimit) Window() time.Duration {
+	window, err := time.ParseDuration(r.Period)
+	if err != nil {
+		window, _ = time.ParseDuration(DefaultRateLimitPeriod)
+	}
+	return window
+}
+
+// Access limits who can reach an app, or a path of it.
+type Access struct {
+	// Allow only lets these addresses in, as IPs or CIDRs, e.g. 10.0.0.0/8. Empty allows all.
+	Allow []string `yaml:"allow,omitempty"`
+	// Deny turns these addresses away, even when Allow lets them in.
+	Deny      []string  `yaml:"deny,omitempty"`
+	BasicAuth BasicAuth `yaml:"basicAuth,omitempty"`
+}
+
+// BasicAuth asks for a user name and password with HTTP basic auth.
+type BasicAuth struct {
+	// Realm is shown in the browser's login prompt. Empty means the name of the app.
+	Realm string `yaml:"realm,omitempty"`
+	// Users maps user names to bcrypt hashes, e.g. from htpasswd -nB.
+	Users map[string]string `yaml:"users,omitempty"`
+	// UsersFile is an htpasswd file with bcrypt hashes, as a path in the manager container, e.g.
+	// /cert-storage/auth/staging.htpasswd. It keeps the hashes out of apps.yml and the labels.
+	UsersFile string `yaml:"usersFile,omitempty"`
+}
+
+// Enabled reports whether requests need a user name and password.
+func (b BasicAuth) Enabled() bool {
+	return len(b.Users) > 0 || b.UsersFile != ""
+}
+
+// Enabled reports whether access is limited at all.
+func (a Access) Enabled() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0 || a.BasicAuth.Enabled()
+}
+
+// String summarizes the access settings, e.g. "allow 10.0.0.0/8, basic auth".
+func (a Access) String() string {
+	var parts []string
+	if len(a.Allow) > 0 {
+		parts = append(parts, "allow "+strings.Join(a.Allow, " "))
+	}
+	if len(a.Deny) > 0 {
+		parts = append(parts, "deny "+strings.Join(a.Deny, " "))
+	}
+	if a.BasicAuth.Enabled() {
+		parts = append(parts, "basic auth")
+	}
+	if len(parts) == 0 {
+		return "open"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HTTPConfig is the HTTP policy of an app: security headers and how its domains redirect.
+type HTTPConfig struct {
+	HSTS HSTS `yaml:"hsts,omitempty"`
+	// ResponseHeaders are set on every response of the app, e.g. X-Frame-Options: DENY.
+	ResponseHeaders map[string]string `yaml:"responseHeaders,omitempty"`
+	// RequestHeaders are set on every request before it is passed to the app.
+	RequestHeaders map[string]string `yaml:"requestHeaders,omitempty"`
+	// RedirectCode is the status of the redirects to HTTPS and from aliases: 301, 302, 307 or 308.
+	RedirectCode int `yaml:"redirectCode,omitempty"`
+	// HTTPSRedirect redirects plain HTTP requests to HTTPS. Unset means true, false serves the
+	// domains over both.
+	HTTPSRedirect *bool `yaml:"httpsRedirect,omitempty"`
+	// PreserveQuery keeps the query string in redirects.
+	PreserveQuery bool `yaml:"preserveQuery,omitempty"`
+}
+
+// HSTS is the Strict-Transport-Security header sent over HTTPS.
+type HSTS struct {
+	// MaxAge is how many seconds browsers only use HTTPS for the domain. 0 sends no header.
+	MaxAge            int  `yaml:"maxAge,omitempty"`
+	IncludeSubDomains bool `yaml:"includeSubDomains,omitempty"`
+	Preload           bool `yaml:"preload,omitempty"`
+}
+
+// RedirectsToHTTPS reports whether plain HTTP requests are redirected to HTTPS.
+func (h HTTPConfig) RedirectsToHTTPS() bool {
+	return h.HTTPSRedirect == nil || *h.HTTPSRedirect
+}
+
+// sameRedirects reports whether h and other redirect the same way. Unlike the headers, the
+// redirects apply to a domain rather than to an app.
+func (h HTTPConfig) sameRedirects(other HTTPConfig) bool {
+	return h.RedirectCode == other.RedirectCode && h.RedirectsToHTTPS() == other.RedirectsToHTTPS() && h.PreserveQuery == other.PreserveQuery
+}
+
+// HeaderValue is the Strict-Transport-Security header, empty when HSTS is off.
+func (h HSTS) HeaderValue() string {
+	if h.MaxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("max-age=%d", h.MaxAge)
+	if h.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload {
+		value += "; preload"
+	}
+	return value
 }
 
 // Config represents the overall configuration.
 type Config struct {
-	Apps []AppConfig `yaml:"apps"`
+	// TLS is the default for apps that don't set their own.
+	TLS TLSConfig `yaml:"tls,omitempty"`
+	// RateLimit and MaxConnections are the defaults for apps that don't set their own.
+	RateLimit      *RateLimit  `yaml:"rateLimit,omitempty"`
+	MaxConnections int         `yaml:"maxConnections,omitempty"`
+	Apps           []AppConfig `yaml:"apps"`
+}
+
+// Hash returns a short fingerprint of the app configuration, used to tell deployments
+// with the same image but different settings apart.
+func (a *AppConfig) Hash() (string, error) {
+	data, err := yaml.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config for app '%s': %w", a.Name, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12], nil
 }
 
 // NormalizeConfig sets default values for the loaded configuration.
@@ -146,6 +524,57 @@ func NormalizeConfig(conf *Config) *Config {
 		if app.Port == "" {
 			normalized.Apps[i].Port = DefaultContainerPort
 		}
+
+		if app.DrainTime == 0 {
+			normalized.Apps[i].DrainTime = DefaultDrainTime
+		}
+
+		if app.Replicas == 0 {
+			normalized.Apps[i].Replicas = DefaultReplicas
+		}
+
+		if app.HTTP.RedirectCode == 0 {
+			normalized.Apps[i].HTTP.RedirectCode = DefaultRedirectCode
+		}
+
+		rateLimit := app.RateLimit
+		if rateLimit == nil {
+			rateLimit = conf.RateLimit
+		}
+		if rateLimit != nil {
+			// A copy, so filling in the defaults doesn't change the top-level rateLimit.
+			rl := *rateLimit
+			if rl.Period == "" {
+				rl.Period = DefaultRateLimitPeriod
+			}
+			if rl.Status == 0 {
+				rl.Status = DefaultRateLimitStatus
+			}
+			normalized.Apps[i].RateLimit = &rl
+		}
+		if app.MaxConnections == 0 {
+			normalized.Apps[i].MaxConnections = conf.MaxConnections
+		}
+
+		if app.TLS.Challenge == "" {
+			normalized.Apps[i].TLS.Challenge = conf.TLS.Challenge
+		}
+		if app.TLS.DNSProvider == "" && normalized.Apps[i].TLS.Challenge == TLSChallengeDNS01 {
+			normalized.Apps[i].TLS.DNSProvider = conf.TLS.DNSProvider
+		}
+		// The account settings go to the manager with every app's labels.
+		if app.TLS.accountSettings() == (TLSConfig{}) {
+			account := conf.TLS.accountSettings()
+			normalized.Apps[i].TLS.CADirectory = account.CADirectory
+			normalized.Apps[i].TLS.EAB = account.EAB
+			normalized.Apps[i].TLS.CABundle = account.CABundle
+			normalized.Apps[i].TLS.PreferredChain = account.PreferredChain
+		}
+
+		// Setting only maxUnavailable replaces replicas in place without surging.
+		if app.MaxSurge == 0 && app.MaxUnavailable == 0 {
+			normalized.Apps[i].MaxSurge = DefaultMaxSurge
+		}
 	}
 	return &normalized
 }
@@ -175,3 +604,67 @@ func LoadAndValidateConfig(path string) (*Config, error) {
 	}
 	return normalizedConfig, nil
 }
+
+// SetAppReplicas sets the replicas of an app in the config file at path. The file is edited as
+// a YAML tree so comments and formatting elsewhere are kept.
+func SetAppReplicas(path, appName string, replicas int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	app := findAppNode(&root, appName)
+	if app == nil {
+		return fmt.Errorf("app '%s' not found in config file '%s'", appName, path)
+	}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprint(replicas)}
+	if existing := mappingValue(app, "replicas"); existing != nil {
+		*existing = *value
+	} else {
+		app.Content = append(app.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "replicas"}, value)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write config file '%s': %w", path, err)
+	}
+	return nil
+}
+
+// findAppNode returns the mapping node of the app named appName in a parsed config file.
+func findAppNode(root *yaml.Node, appName string) *yaml.Node {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	apps := mappingValue(root.Content[0], "apps")
+	if apps == nil || apps.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, app := range apps.Content {
+		if name := mappingValue(app, "name"); name != nil && name.Value == appName {
+			return app
+		}
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
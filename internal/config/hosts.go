@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	HostsFileName = "hosts.yml"
+
+	// DefaultHostConfigPath is the turkis config directory on a server.
+	DefaultHostConfigPath = "~/.config/turkis"
+)
+
+// Host is a server turkis manages over SSH, selected with --host.
+type Host struct {
+	Name string `yaml:"name"`
+	// SSH is the destination passed to ssh: an alias from ~/.ssh/config, user@host or
+	// ssh://user@host:port.
+	SSH string `yaml:"ssh"`
+	// ConfigPath is the turkis config directory on the server.
+	ConfigPath string `yaml:"configPath,omitempty"`
+	// ManagerURL is where the turkis-manager API is published on the server.
+	ManagerURL string `yaml:"managerURL,omitempty"`
+}
+
+// HostsConfig is the list of servers in hosts.yml.
+type HostsConfig struct {
+	Hosts []Host `yaml:"hosts"`
+}
+
+// currentHost is the server selected with --host, nil for the local machine.
+var currentHost *Host
+
+// UseHost makes turkis manage the Docker daemon and config directory of a server instead of
+// the local machine. nil switches back to the local machine.
+func UseHost(host *Host) {
+	currentHost = host
+}
+
+// CurrentHost returns the server selected with --host, or nil when turkis runs against the
+// local machine.
+func CurrentHost() *Host {
+	return currentHost
+}
+
+// HostsFilePath returns "~/.config/turkis/hosts.yml". It is always on the local machine.
+func HostsFilePath() (string, error) {
+	configDirPath, err := ConfigDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDirPath, HostsFileName), nil
+}
+
+// HostByName loads hosts.yml and returns the host with the given name.
+func HostByName(name string) (*Host, error) {
+	path, err := HostsFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("host '%s' not found, add it to %s", name, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file '%s': %w", path, err)
+	}
+
+	var hosts HostsConfig
+	if err := yaml.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hosts file '%s': %w", path, err)
+	}
+	for _, host := range hosts.Hosts {
+		if host.Name != name {
+			continue
+		}
+		if err := ValidateHost(host); err != nil {
+			return nil, err
+		}
+		if host.ConfigPath == "" {
+			host.ConfigPath = DefaultHostConfigPath
+		}
+		return &host, nil
+	}
+	return nil, fmt.Errorf("host '%s' not found in %s", name, path)
+}
+
+// ValidateHost checks that a host has everything needed to reach it.
+func ValidateHost(host Host) error {
+	if host.Name == "" {
+		return errors.New("found a host with an empty name")
+	}
+	if host.SSH == "" {
+		return fmt.Errorf("host '%s': missing ssh destination", host.Name)
+	}
+	if u, err := url.Parse(host.SSH); err == nil && u.Scheme != "" && u.Scheme != "ssh" {
+		return fmt.Errorf("host '%s': unsupported scheme '%s' in ssh destination, use ssh://", host.Name, u.Scheme)
+	}
+	if host.ManagerURL != "" {
+		if _, err := url.ParseRequestURI(host.ManagerURL); err != nil {
+			return fmt.Errorf("host '%s': invalid managerURL '%s': %w", host.Name, host.ManagerURL, err)
+		}
+	}
+	return nil
+}
+
+// ServerConfigDirPath returns the config directory on the machine that runs the apps, where
+// turkis keeps the manager's containers directory, the deployment history and failed
+// deployments. That is the configPath of the host selected with --host, or ConfigDirPath.
+func ServerConfigDirPath() (string, error) {
+	if currentHost != nil {
+		return currentHost.ConfigPath, nil
+	}
+	return ConfigDirPath()
+}
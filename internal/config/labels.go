@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,13 +18,59 @@ const (
 	LabelIgnore          = "turkis.ignore"            // optional
 	LabelHealthCheckPath = "turkis.health-check-path" // optional default to "/"
 	LabelACMEEmail       = "turkis.acme.email"
-	LabelPort            = "turkis.port" // optional
+	LabelPort            = "turkis.port"             // optional
+	LabelDrainTime       = "turkis.drain-time"       // optional default to 10
+	LabelCanary          = "turkis.canary"           // optional, percentage of traffic for a canary deployment
+	LabelTLSChallenge    = "turkis.tls.challenge"    // optional default to http-01
+	LabelDNSProvider     = "turkis.tls.dns-provider" // optional, required for dns-01
+
+	// ACME account settings from the top-level tls section, all optional.
+	LabelACMEDirectory      = "turkis.acme.directory"
+	LabelACMEEABKeyID       = "turkis.acme.eab-key-id"
+	LabelACMECABundle       = "turkis.acme.ca-bundle"
+	LabelACMEPreferredChain = "turkis.acme.preferred-chain"
+
+	// HTTP policy from the http section, all optional.
+	LabelHTTPRedirectCode          = "turkis.http.redirect-code"  // default to 301
+	LabelHTTPSRedirect             = "turkis.http.https-redirect" // default to true
+	LabelHTTPPreserveQuery         = "turkis.http.preserve-query"
+	LabelHTTPHSTSMaxAge            = "turkis.http.hsts.max-age"
+	LabelHTTPHSTSIncludeSubDomains = "turkis.http.hsts.include-subdomains"
+	LabelHTTPHSTSPreload           = "turkis.http.hsts.preload"
+	// Prefixes of the header labels, followed by the header name, e.g. "turkis.http.response-header.X-Frame-Options"
+	LabelHTTPResponseHeader = "turkis.http.response-header."
+	LabelHTTPRequestHeader  = "turkis.http.request-header."
+
+	// Rate limit from the rateLimit section, all optional.
+	LabelRateLimitRequests = "turkis.rate-limit.requests" // default to no limit
+	LabelRateLimitPeriod   = "turkis.rate-limit.period"   // default to 10s
+	LabelRateLimitBurst    = "turkis.rate-limit.burst"
+	LabelRateLimitStatus   = "turkis.rate-limit.status" // default to 429
+	LabelMaxConnections    = "turkis.max-connections"   // optional, per replica
+
+	// Access settings follow LabelAccess for the app, or LabelDomainPathAccess for a path of a
+	// domain. All optional.
+	LabelAccess           = "turkis.access."
+	LabelAccessAllow      = "allow" // comma-separated IPs and CIDRs
+	LabelAccessDeny       = "deny"  // comma-separated IPs and CIDRs
+	LabelAccessRealm      = "basic-auth.realm"
+	LabelAccessUsersFile  = "basic-auth.users-file"
+	LabelAccessUserPrefix = "basic-auth.user." // followed by the user name, the value is a bcrypt hash
 
 	// Format strings for indexed canonical domains and aliases.
 	// Use fmt.Sprintf(LabelDomainCanonical, index) to get "turkis.domain.<index>"
 	LabelDomainCanonical = "turkis.domain.%d"
 	// Use fmt.Sprintf(LabelDomainAlias, domainIndex, aliasIndex) to get "turkis.domain.<domainIndex>.alias.<aliasIndex>"
 	LabelDomainAlias = "turkis.domain.%d.alias.%d"
+	// Use fmt.Sprintf(LabelDomainTLS, domainIndex, key) to get "turkis.domain.<domainIndex>.tls.<key>"
+	// with key mode, cert or key. All optional.
+	LabelDomainTLS = "turkis.domain.%d.tls.%s"
+	// Use fmt.Sprintf(LabelDomainPath, domainIndex, pathIndex) to get "turkis.domain.<domainIndex>.path.<pathIndex>"
+	// with the path prefix. The settings of the path are optional.
+	LabelDomainPath            = "turkis.domain.%d.path.%d"
+	LabelDomainPathStripPrefix = LabelDomainPath + ".strip-prefix"
+	LabelDomainPathPriority    = LabelDomainPath + ".priority"
+	LabelDomainPathAccess      = LabelDomainPath + ".access."
 )
 
 type ContainerLabels struct {
@@ -33,7 +80,21 @@ type ContainerLabels struct {
 	HealthCheckPath string
 	ACMEEmail       string
 	Port            string
-	Domains         []Domain
+	DrainTime       int
+	// Canary is the percentage of the app's traffic the deployment gets while older
+	// deployments are still running. 0 means it isn't a canary.
+	Canary  int
+	Domains []Domain
+	// TLS is how certificates are obtained for the domains.
+	TLS TLSConfig
+	// HTTP is the HTTP policy of the app.
+	HTTP HTTPConfig
+	// Access limits who can reach the app. Paths can have their own.
+	Access Access
+	// RateLimit limits the requests per client IP.
+	RateLimit RateLimit
+	// MaxConnections is the maxconn of every server of the app, 0 for no limit.
+	MaxConnections int
 }
 
 // Parse from docker labels to ContainerLabels struct.
@@ -42,6 +103,16 @@ func ParseContainerLabels(labels map[string]string) (*ContainerLabels, error) {
 		AppName:      labels[LabelAppName],
 		DeploymentID: labels[LabelDeploymentID],
 		ACMEEmail:    labels[LabelACMEEmail],
+		TLS: TLSConfig{
+			Challenge:   labels[LabelTLSChallenge],
+			DNSProvider: labels[LabelDNSProvider],
+			CADirectory: labels[LabelACMEDirectory],
+			EAB: EAB{
+				KeyID: labels[LabelACMEEABKeyID],
+			},
+			CABundle:       labels[LabelACMECABundle],
+			PreferredChain: labels[LabelACMEPreferredChain],
+		},
 	}
 
 	// Parse and validate Ignore flag.
@@ -59,6 +130,32 @@ func ParseContainerLabels(labels map[string]string) (*ContainerLabels, error) {
 		cl.Port = DefaultContainerPort
 	}
 
+	if v, ok := labels[LabelDrainTime]; ok {
+		drainTime, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", LabelDrainTime, err)
+		}
+		cl.DrainTime = drainTime
+	} else {
+		cl.DrainTime = DefaultDrainTime
+	}
+
+	if v, ok := labels[LabelCanary]; ok {
+		canary, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", LabelCanary, err)
+		}
+		cl.Canary = canary
+	}
+
+	if err := parseHTTPLabels(labels, &cl.HTTP); err != nil {
+		return nil, err
+	}
+	cl.Access, _ = parseAccessLabels(labels, LabelAccess)
+	if err := parseRateLimitLabels(labels, cl); err != nil {
+		return nil, err
+	}
+
 	// Set HealthCheckPath with default value.
 	if v, ok := labels[LabelHealthCheckPath]; ok {
 		cl.HealthCheckPath = v
@@ -68,13 +165,61 @@ func ParseContainerLabels(labels map[string]string) (*ContainerLabels, error) {
 
 	// Parse domains
 	domainMap := make(map[int]*Domain)
+	pathMap := make(map[int]map[int]*Path)
 
 	// Process domain and alias labels.
 	for key, value := range labels {
 		if !strings.HasPrefix(key, "turkis.domain.") {
 			continue
 		}
-		if strings.Contains(key, ".alias.") {
+		// Path settings come first, the user names of their access settings can contain anything.
+		if strings.Contains(key, ".path.") {
+			// Parse path key: "turkis.domain.<domainIdx>.path.<pathIdx>", optionally followed by a setting
+			var domainIdx, pathIdx int
+			if _, err := fmt.Sscanf(key, LabelDomainPath, &domainIdx, &pathIdx); err != nil {
+				continue
+			}
+			getOrCreateDomain(domainMap, domainIdx)
+			if pathMap[domainIdx] == nil {
+				pathMap[domainIdx] = make(map[int]*Path)
+			}
+			if pathMap[domainIdx][pathIdx] == nil {
+				pathMap[domainIdx][pathIdx] = &Path{}
+			}
+			path := pathMap[domainIdx][pathIdx]
+			switch key {
+			case fmt.Sprintf(LabelDomainPath, domainIdx, pathIdx):
+				path.Prefix = value
+			case fmt.Sprintf(LabelDomainPathStripPrefix, domainIdx, pathIdx):
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+				}
+				path.StripPrefix = b
+			case fmt.Sprintf(LabelDomainPathPriority, domainIdx, pathIdx):
+				priority, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+				}
+				path.Priority = priority
+			}
+		} else if strings.Contains(key, ".tls.") {
+			// Parse TLS key: "turkis.domain.<domainIdx>.tls.<key>"
+			var domainIdx int
+			var tlsKey string
+			if _, err := fmt.Sscanf(key, LabelDomainTLS, &domainIdx, &tlsKey); err != nil {
+				continue
+			}
+			domain := getOrCreateDomain(domainMap, domainIdx)
+			switch tlsKey {
+			case "mode":
+				domain.TLS.Mode = value
+			case "cert":
+				domain.TLS.Cert = value
+			case "key":
+				domain.TLS.Key = value
+			}
+		} else if strings.Contains(key, ".alias.") {
 			// Parse alias key: "turkis.domain.<domainIdx>.alias.<aliasIdx>"
 			var domainIdx, aliasIdx int
 			if _, err := fmt.Sscanf(key, LabelDomainAlias, &domainIdx, &aliasIdx); err != nil {
@@ -101,7 +246,20 @@ func ParseContainerLabels(labels map[string]string) (*ContainerLabels, error) {
 	}
 	sort.Ints(indices)
 	for _, i := range indices {
-		cl.Domains = append(cl.Domains, *domainMap[i])
+		domain := domainMap[i]
+		var pathIndices []int
+		for j := range pathMap[i] {
+			pathIndices = append(pathIndices, j)
+		}
+		sort.Ints(pathIndices)
+		for _, j := range pathIndices {
+			path := *pathMap[i][j]
+			if access, ok := parseAccessLabels(labels, fmt.Sprintf(LabelDomainPathAccess, i, j)); ok {
+				path.Access = &access
+			}
+			domain.Paths = append(domain.Paths, path)
+		}
+		cl.Domains = append(cl.Domains, *domain)
 	}
 
 	// Optional: validate the parsed labels.
@@ -112,6 +270,145 @@ func ParseContainerLabels(labels map[string]string) (*ContainerLabels, error) {
 	return cl, nil
 }
 
+// parseHTTPLabels parses the labels of the http section into http.
+func parseHTTPLabels(labels map[string]string, http *HTTPConfig) error {
+	http.RedirectCode = DefaultRedirectCode
+	if v, ok := labels[LabelHTTPRedirectCode]; ok {
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", LabelHTTPRedirectCode, err)
+		}
+		http.RedirectCode = code
+	}
+	if v, ok := labels[LabelHTTPHSTSMaxAge]; ok {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", LabelHTTPHSTSMaxAge, err)
+		}
+		http.HSTS.MaxAge = maxAge
+	}
+	for label, target := range map[string]*bool{
+		LabelHTTPPreserveQuery:         &http.PreserveQuery,
+		LabelHTTPHSTSIncludeSubDomains: &http.HSTS.IncludeSubDomains,
+		LabelHTTPHSTSPreload:           &http.HSTS.Preload,
+	} {
+		if v, ok := labels[label]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", label, err)
+			}
+			*target = b
+		}
+	}
+	if v, ok := labels[LabelHTTPSRedirect]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", LabelHTTPSRedirect, err)
+		}
+		http.HTTPSRedirect = &b
+	}
+
+	for key, value := range labels {
+		if name, ok := strings.CutPrefix(key, LabelHTTPResponseHeader); ok {
+			if http.ResponseHeaders == nil {
+				http.ResponseHeaders = make(map[string]string)
+			}
+			http.ResponseHeaders[name] = value
+		} else if name, ok := strings.CutPrefix(key, LabelHTTPRequestHeader); ok {
+			if http.RequestHeaders == nil {
+				http.RequestHeaders = make(map[string]string)
+			}
+			http.RequestHeaders[name] = value
+		}
+	}
+	return nil
+}
+
+// parseRateLimitLabels parses the labels of the rate limit and the connection limit into cl.
+func parseRateLimitLabels(labels map[string]string, cl *ContainerLabels) error {
+	cl.RateLimit = RateLimit{Period: DefaultRateLimitPeriod, Status: DefaultRateLimitStatus}
+	if v, ok := labels[LabelRateLimitPeriod]; ok {
+		cl.RateLimit.Period = v
+	}
+	for label, target := range map[string]*int{
+		LabelRateLimitRequests: &cl.RateLimit.Requests,
+		LabelRateLimitBurst:    &cl.RateLimit.Burst,
+		LabelRateLimitStatus:   &cl.RateLimit.Status,
+		LabelMaxConnections:    &cl.MaxConnections,
+	} {
+		if v, ok := labels[label]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", label, err)
+			}
+			*target = n
+		}
+	}
+	return nil
+}
+
+// parseAccessLabels parses the access settings whose labels start with prefix. It reports
+// whether there are any.
+func parseAccessLabels(labels map[string]string, prefix string) (Access, bool) {
+	var access Access
+	found := false
+	for key, value := range labels {
+		setting, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		found = true
+		switch setting {
+		case LabelAccessAllow:
+			access.Allow = splitList(value)
+		case LabelAccessDeny:
+			access.Deny = splitList(value)
+		case LabelAccessRealm:
+			access.BasicAuth.Realm = value
+		case LabelAccessUsersFile:
+			access.BasicAuth.UsersFile = value
+		default:
+			if user, ok := strings.CutPrefix(setting, LabelAccessUserPrefix); ok {
+				if access.BasicAuth.Users == nil {
+					access.BasicAuth.Users = make(map[string]string)
+				}
+				access.BasicAuth.Users[user] = value
+			}
+		}
+	}
+	return access, found
+}
+
+// accessLabels sets the labels of access, each starting with prefix.
+func accessLabels(labels map[string]string, prefix string, access Access) {
+	if len(access.Allow) > 0 {
+		labels[prefix+LabelAccessAllow] = strings.Join(access.Allow, ",")
+	}
+	if len(access.Deny) > 0 {
+		labels[prefix+LabelAccessDeny] = strings.Join(access.Deny, ",")
+	}
+	if access.BasicAuth.Realm != "" {
+		labels[prefix+LabelAccessRealm] = access.BasicAuth.Realm
+	}
+	if access.BasicAuth.UsersFile != "" {
+		labels[prefix+LabelAccessUsersFile] = access.BasicAuth.UsersFile
+	}
+	for user, hash := range access.BasicAuth.Users {
+		labels[prefix+LabelAccessUserPrefix+user] = hash
+	}
+}
+
+// splitList splits a comma-separated label value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 // getOrCreateDomain returns an existing *config.Domain from domainMap or creates a new one.
 func getOrCreateDomain(domainMap map[int]*Domain, idx int) *Domain {
 	if domain, exists := domainMap[idx]; exists {
@@ -130,6 +427,66 @@ func (cl *ContainerLabels) ToLabels() map[string]string {
 		LabelHealthCheckPath: cl.HealthCheckPath,
 		LabelPort:            cl.Port,
 		LabelACMEEmail:       cl.ACMEEmail,
+		LabelDrainTime:       strconv.Itoa(cl.DrainTime),
+	}
+	if cl.Canary > 0 {
+		labels[LabelCanary] = strconv.Itoa(cl.Canary)
+	}
+	if cl.TLS.Challenge != "" {
+		labels[LabelTLSChallenge] = cl.TLS.Challenge
+	}
+	if cl.TLS.DNSProvider != "" {
+		labels[LabelDNSProvider] = cl.TLS.DNSProvider
+	}
+	for label, value := range map[string]string{
+		LabelACMEDirectory:      cl.TLS.CADirectory,
+		LabelACMEEABKeyID:       cl.TLS.EAB.KeyID,
+		LabelACMECABundle:       cl.TLS.CABundle,
+		LabelACMEPreferredChain: cl.TLS.PreferredChain,
+	} {
+		if value != "" {
+			labels[label] = value
+		}
+	}
+
+	// Set the HTTP policy.
+	if cl.HTTP.RedirectCode != 0 && cl.HTTP.RedirectCode != DefaultRedirectCode {
+		labels[LabelHTTPRedirectCode] = strconv.Itoa(cl.HTTP.RedirectCode)
+	}
+	if !cl.HTTP.RedirectsToHTTPS() {
+		labels[LabelHTTPSRedirect] = "false"
+	}
+	if cl.HTTP.PreserveQuery {
+		labels[LabelHTTPPreserveQuery] = "true"
+	}
+	if cl.HTTP.HSTS.MaxAge > 0 {
+		labels[LabelHTTPHSTSMaxAge] = strconv.Itoa(cl.HTTP.HSTS.MaxAge)
+	}
+	if cl.HTTP.HSTS.IncludeSubDomains {
+		labels[LabelHTTPHSTSIncludeSubDomains] = "true"
+	}
+	if cl.HTTP.HSTS.Preload {
+		labels[LabelHTTPHSTSPreload] = "true"
+	}
+	for name, value := range cl.HTTP.ResponseHeaders {
+		labels[LabelHTTPResponseHeader+name] = value
+	}
+	for name, value := range cl.HTTP.RequestHeaders {
+		labels[LabelHTTPRequestHeader+name] = value
+	}
+	accessLabels(labels, LabelAccess, cl.Access)
+
+	// Set the rate and connection limits.
+	if cl.RateLimit.Enabled() {
+		labels[LabelRateLimitRequests] = strconv.Itoa(cl.RateLimit.Requests)
+		labels[LabelRateLimitPeriod] = cl.RateLimit.Period
+		labels[LabelRateLimitStatus] = strconv.Itoa(cl.RateLimit.Status)
+		if cl.RateLimit.Burst > 0 {
+			labels[LabelRateLimitBurst] = strconv.Itoa(cl.RateLimit.Burst)
+		}
+	}
+	if cl.MaxConnections > 0 {
+		labels[LabelMaxConnections] = strconv.Itoa(cl.MaxConnections)
 	}
 
 	// Iterate through the domains slice.
@@ -143,35 +500,109 @@ func (cl *ContainerLabels) ToLabels() map[string]string {
 			aliasKey := fmt.Sprintf(LabelDomainAlias, i, j)
 			labels[aliasKey] = alias
 		}
+
+		// Set paths.
+		for j, path := range domain.Paths {
+			labels[fmt.Sprintf(LabelDomainPath, i, j)] = path.Prefix
+			if path.StripPrefix {
+				labels[fmt.Sprintf(LabelDomainPathStripPrefix, i, j)] = "true"
+			}
+			if path.Priority != 0 {
+				labels[fmt.Sprintf(LabelDomainPathPriority, i, j)] = strconv.Itoa(path.Priority)
+			}
+			if path.Access != nil {
+				// An empty path access lifts the app's, so it needs a label of its own.
+				labels[fmt.Sprintf(LabelDomainPathAccess, i, j)+LabelAccessAllow] = strings.Join(path.Access.Allow, ",")
+				accessLabels(labels, fmt.Sprintf(LabelDomainPathAccess, i, j), *path.Access)
+			}
+		}
+
+		// Set TLS settings.
+		for tlsKey, value := range map[string]string{"mode": domain.TLS.Mode, "cert": domain.TLS.Cert, "key": domain.TLS.Key} {
+			if value != "" {
+				labels[fmt.Sprintf(LabelDomainTLS, i, tlsKey)] = value
+			}
+		}
 	}
 
 	return labels
 }
 
+// deploymentIDPattern is a deployment ID, a timestamp like 20060102150405 when turkis made it.
+var deploymentIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
 // We assume that all labels need to be present for the labels to be valid.
 func (cl *ContainerLabels) IsValid() error {
 	if cl.AppName == "" {
 		return fmt.Errorf("appName is required")
 	}
+	if err := ValidateAppName(cl.AppName); err != nil {
+		return err
+	}
 	if cl.DeploymentID == "" {
 		return fmt.Errorf("deploymentID is required")
 	}
-
-	if cl.ACMEEmail == "" {
-		return fmt.Errorf("ACME email is required")
+	// The deployment ID is part of the HAProxy server names.
+	if !deploymentIDPattern.MatchString(cl.DeploymentID) {
+		return fmt.Errorf("invalid deploymentID '%s'", cl.DeploymentID)
 	}
 
-	if !helpers.IsValidEmail(cl.ACMEEmail) {
+	if cl.ACMEEmail == "" {
+		for _, domain := range cl.Domains {
+			if domain.UsesACME() {
+				return fmt.Errorf("ACME email is required")
+			}
+		}
+	} else if !helpers.IsValidEmail(cl.ACMEEmail) {
 		return fmt.Errorf("ACME email is not valid")
 	}
 
 	if cl.Port == "" {
 		return fmt.Errorf("port is required")
 	}
+	if err := ValidatePort(cl.Port); err != nil {
+		return err
+	}
+
+	if cl.DrainTime < 0 {
+		return fmt.Errorf("drain time cannot be negative")
+	}
+
+	if cl.Canary < 0 || cl.Canary > 99 {
+		return fmt.Errorf("canary percentage must be between 1 and 99")
+	}
 
 	if len(cl.Domains) == 0 {
 		return fmt.Errorf("at least one domain is required")
 	}
+
+	// Headers and access settings end up in the HAProxy config too.
+	if err := ValidateHTTP(cl.HTTP); err != nil {
+		return err
+	}
+	if err := ValidateAccess(cl.Access); err != nil {
+		return err
+	}
+	if err := ValidateRateLimit(cl.RateLimit); err != nil {
+		return err
+	}
+
+	// Domains and paths end up in the HAProxy config and its map files.
+	for _, domain := range cl.Domains {
+		if err := ValidateDomain(domain.Canonical); err != nil {
+			return err
+		}
+		for _, alias := range domain.Aliases {
+			if err := ValidateDomain(alias); err != nil {
+				return fmt.Errorf("domain %s: %w", domain.Canonical, err)
+			}
+		}
+		for _, path := range domain.Paths {
+			if err := ValidatePath(path); err != nil {
+				return fmt.Errorf("domain %s: %w", domain.Canonical, err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -190,6 +621,31 @@ func (cl *ContainerLabels) String() string {
 	fmt.Fprintf(w, "%s:\t%s\n", yellow("Health Check Path"), cyan(cl.HealthCheckPath))
 	fmt.Fprintf(w, "%s:\t%s\n", yellow("ACME Email"), cyan(cl.ACMEEmail))
 	fmt.Fprintf(w, "%s:\t%s\n", yellow("Port"), cyan(cl.Port))
+	fmt.Fprintf(w, "%s:\t%ds\n", yellow("Drain Time"), cl.DrainTime)
+	if cl.Canary > 0 {
+		fmt.Fprintf(w, "%s:\t%d%%\n", yellow("Canary"), cl.Canary)
+	}
+	if cl.TLS.CADirectory != "" {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("ACME Directory"), cyan(cl.TLS.CADirectory))
+	}
+	if cl.TLS.Challenge == TLSChallengeDNS01 {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("TLS Challenge"), cyan(fmt.Sprintf("%s (%s)", cl.TLS.Challenge, cl.TLS.DNSProvider)))
+	}
+	if hsts := cl.HTTP.HSTS.HeaderValue(); hsts != "" {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("HSTS"), cyan(hsts))
+	}
+	if !cl.HTTP.RedirectsToHTTPS() {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("HTTPS Redirect"), cyan("off"))
+	}
+	if cl.Access.Enabled() {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("Access"), cyan(cl.Access.String()))
+	}
+	if cl.RateLimit.Enabled() {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("Rate Limit"), cyan(fmt.Sprintf("%d requests per %s", cl.RateLimit.Requests, cl.RateLimit.Period)))
+	}
+	if cl.MaxConnections > 0 {
+		fmt.Fprintf(w, "%s:\t%s\n", yellow("Max Connections"), cyan(strconv.Itoa(cl.MaxConnections)))
+	}
 
 	fmt.Fprintln(w, yellow("Domains:"))
 	for i, domain := range cl.Domains {
@@ -197,6 +653,16 @@ func (cl *ContainerLabels) String() string {
 		if len(domain.Aliases) > 0 {
 			fmt.Fprintf(w, "\t%s\t%s\n", yellow("Aliases"), cyan(strings.Join(domain.Aliases, ", ")))
 		}
+		if len(domain.Paths) > 0 {
+			var paths []string
+			for _, path := range domain.Paths {
+				paths = append(paths, path.Prefix)
+			}
+			fmt.Fprintf(w, "\t%s\t%s\n", yellow("Paths"), cyan(strings.Join(paths, ", ")))
+		}
+		if !domain.UsesACME() {
+			fmt.Fprintf(w, "\t%s\t%s\n", yellow("TLS"), cyan(domain.TLS.Mode))
+		}
 	}
 	w.Flush()
 
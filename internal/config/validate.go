@@ -3,21 +3,27 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ameistad/turkis/internal/helpers"
+	"github.com/distribution/reference"
 )
 
 // ValidateDomain checks that a domain string is not empty and has a basic valid structure.
+// A leading *. makes it a wildcard for the subdomains of the rest.
 func ValidateDomain(domain string) error {
 	if domain == "" {
 		return errors.New("domain cannot be empty")
 	}
 	// This regular expression is a simple validator. Adjust if needed.
-	pattern := `^(?:[a-zA-Z0-9-]+\.)+[a-zA-Z]{2,}$`
+	pattern := `^(?:\*\.)?(?:[a-zA-Z0-9-]+\.)+[a-zA-Z]{2,}$`
 	matched, err := regexp.MatchString(pattern, domain)
 	if err != nil {
 		return err
@@ -28,6 +34,42 @@ func ValidateDomain(domain string) error {
 	return nil
 }
 
+// ReservedNamePrefix starts the names of the sections turkis-manager adds to the HAProxy config
+// next to the backend of every app, e.g. the stick table for a rate limit's burst. App names
+// can't start with it, so they never clash.
+const ReservedNamePrefix = "turkis_"
+
+// appNamePattern is an app name. It names the app's HAProxy backend and ends up in map
+// files and runtime API commands, so it can't have spaces or separators.
+var appNamePattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// ValidateAppName checks that an app name can be the name of its HAProxy backend.
+func ValidateAppName(name string) error {
+	if name == "" {
+		return errors.New("app name cannot be empty")
+	}
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid app name '%s', only lowercase letters, digits, -, _ and . are allowed", name)
+	}
+	if strings.HasPrefix(name, ReservedNamePrefix) {
+		return fmt.Errorf("app name '%s' cannot start with %s", name, ReservedNamePrefix)
+	}
+	// The backends of the HAProxy config template
+	if name == "acme_challenge" || name == "default_backend" {
+		return fmt.Errorf("app name '%s' is reserved", name)
+	}
+	return nil
+}
+
+// ValidatePort checks that a container port is a number between 1 and 65535.
+func ValidatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port '%s', expected a number between 1 and 65535", port)
+	}
+	return nil
+}
+
 // ValidateHealthCheckPath checks that a health check path is a valid URL path.
 func ValidateHealthCheckPath(path string) error {
 	if path == "" {
@@ -39,8 +81,232 @@ func ValidateHealthCheckPath(path string) error {
 	return nil
 }
 
+// ValidateImage checks that an image is a valid reference, e.g. registry.example.com/app:1.4.2
+// or registry.example.com/app@sha256:<digest>.
+func ValidateImage(image string) error {
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return fmt.Errorf("invalid image '%s': %w", image, err)
+	}
+	return nil
+}
+
+// ValidateACMEAccount checks the ACME account settings of the top-level tls section.
+func ValidateACMEAccount(tls TLSConfig) error {
+	if tls.CADirectory != "" {
+		u, err := url.Parse(tls.CADirectory)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("tls.caDirectory '%s' must be an https URL", tls.CADirectory)
+		}
+	}
+	if tls.EAB.HMACKey != "" {
+		return errors.New("tls.eab.hmacKey would be readable in the labels of every container, set ACME_EAB_HMAC_KEY or ACME_EAB_HMAC_KEY_FILE for turkis-manager instead")
+	}
+	if tls.CABundle != "" && !filepath.IsAbs(tls.CABundle) {
+		return fmt.Errorf("tls.caBundle '%s' must be an absolute path in the manager container", tls.CABundle)
+	}
+	return nil
+}
+
+// ValidateDomainTLS checks the tls section of a domain.
+func ValidateDomainTLS(tls DomainTLS) error {
+	switch tls.Mode {
+	case "", TLSModeACME, TLSModeSelfSigned, TLSModeNone:
+		if tls.Cert != "" || tls.Key != "" {
+			return fmt.Errorf("tls.cert and tls.key need tls.mode %s", TLSModeManual)
+		}
+	case TLSModeManual:
+		if tls.Cert == "" || tls.Key == "" {
+			return fmt.Errorf("tls.mode %s needs tls.cert and tls.key", TLSModeManual)
+		}
+		if !filepath.IsAbs(tls.Cert) || !filepath.IsAbs(tls.Key) {
+			return errors.New("tls.cert and tls.key must be absolute paths in the manager container")
+		}
+	default:
+		return fmt.Errorf("invalid tls.mode '%s', expected %s, %s, %s or %s", tls.Mode, TLSModeACME, TLSModeManual, TLSModeSelfSigned, TLSModeNone)
+	}
+	return nil
+}
+
+// pathPattern is a path prefix: / or segments of unreserved URL characters without a trailing slash.
+var pathPattern = regexp.MustCompile(`^/$|^(/[A-Za-z0-9._~-]+)+$`)
+
+// ValidatePath checks a path of a domain.
+func ValidatePath(path Path) error {
+	if !pathPattern.MatchString(path.Prefix) {
+		return fmt.Errorf("invalid path prefix '%s', expected / or something like /api/v1 without a trailing slash", path.Prefix)
+	}
+	if path.StripPrefix && path.Prefix == "/" {
+		return errors.New("path prefix / can't be stripped")
+	}
+	if path.Access != nil {
+		if err := ValidateAccess(*path.Access); err != nil {
+			return fmt.Errorf("path %s: %w", path.Prefix, err)
+		}
+	}
+	return nil
+}
+
+var (
+	// userNamePattern is a basic auth user name, which HAProxy needs without spaces or colons.
+	userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+	// bcryptPattern is a bcrypt hash as htpasswd -B writes it.
+	bcryptPattern = regexp.MustCompile(`^\$2[aby]\$[0-9]{2}\$[./A-Za-z0-9]{53}$`)
+)
+
+// ValidateAccess checks the access section of an app or a path.
+func ValidateAccess(access Access) error {
+	for kind, addresses := range map[string][]string{"allow": access.Allow, "deny": access.Deny} {
+		for _, address := range addresses {
+			if _, _, err := net.ParseCIDR(address); err != nil && net.ParseIP(address) == nil {
+				return fmt.Errorf("access.%s: invalid address '%s', expected an IP or a CIDR like 10.0.0.0/8", kind, address)
+			}
+		}
+	}
+	auth := access.BasicAuth
+	if strings.ContainsFunc(auth.Realm, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return errors.New("access.basicAuth.realm has control characters")
+	}
+	for user, hash := range auth.Users {
+		if !userNamePattern.MatchString(user) {
+			return fmt.Errorf("access.basicAuth.users: invalid user name '%s'", user)
+		}
+		if !bcryptPattern.MatchString(hash) {
+			return fmt.Errorf("access.basicAuth.users: the password of '%s' must be a bcrypt hash, e.g. from htpasswd -nB", user)
+		}
+	}
+	if auth.UsersFile != "" && !filepath.IsAbs(auth.UsersFile) {
+		return errors.New("access.basicAuth.usersFile must be an absolute path in the manager container")
+	}
+	return nil
+}
+
+// headerNamePattern is an HTTP header name (a token in RFC 9110).
+var headerNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// ValidateHTTP checks the http section of an app.
+func ValidateHTTP(http HTTPConfig) error {
+	switch http.RedirectCode {
+	case 301, 302, 307, 308:
+	default:
+		return fmt.Errorf("invalid http.redirectCode %d, expected 301, 302, 307 or 308", http.RedirectCode)
+	}
+	if http.HSTS.MaxAge < 0 {
+		return errors.New("http.hsts.maxAge cannot be negative")
+	}
+	if (http.HSTS.IncludeSubDomains || http.HSTS.Preload) && http.HSTS.MaxAge == 0 {
+		return errors.New("http.hsts.includeSubDomains and http.hsts.preload need http.hsts.maxAge")
+	}
+	// The requirements of the preload list at hstspreload.org
+	if http.HSTS.Preload && (!http.HSTS.IncludeSubDomains || http.HSTS.MaxAge < 31536000) {
+		return errors.New("http.hsts.preload needs http.hsts.includeSubDomains and a maxAge of at least 31536000 (one year)")
+	}
+	for kind, headers := range map[string]map[string]string{"responseHeaders": http.ResponseHeaders, "requestHeaders": http.RequestHeaders} {
+		for name, value := range headers {
+			if !headerNamePattern.MatchString(name) {
+				return fmt.Errorf("http.%s: invalid header name '%s'", kind, name)
+			}
+			if strings.ContainsFunc(value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+				return fmt.Errorf("http.%s: header %s has control characters in its value", kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateRateLimit checks the rate limit of an app.
+func ValidateRateLimit(rateLimit RateLimit) error {
+	if rateLimit.Requests < 0 || rateLimit.Burst < 0 {
+		return errors.New("rateLimit.requests and rateLimit.burst cannot be negative")
+	}
+	if !rateLimit.Enabled() {
+		return nil
+	}
+	window, err := time.ParseDuration(rateLimit.Period)
+	if err != nil {
+		return fmt.Errorf("invalid rateLimit.period '%s', expected something like 10s or 1m", rateLimit.Period)
+	}
+	if window < time.Second {
+		return fmt.Errorf("rateLimit.period %s is shorter than a second", rateLimit.Period)
+	}
+	if rateLimit.Burst > 0 && rateLimit.Burst >= rateLimit.Requests {
+		return errors.New("rateLimit.burst must be less than rateLimit.requests")
+	}
+	// The statuses HAProxy has built-in responses for.
+	switch rateLimit.Status {
+	case 400, 403, 404, 429, 500, 502, 503, 504:
+	default:
+		return fmt.Errorf("invalid rateLimit.status %d, expected 400, 403, 404, 429, 500, 502, 503 or 504", rateLimit.Status)
+	}
+	return nil
+}
+
+// ValidateRoutes checks that the domains and paths of different apps don't overlap, so every
+// request has exactly one app to go to.
+func ValidateRoutes(apps []AppConfig) error {
+	type route struct {
+		app  string
+		path Path
+	}
+	routes := make(map[string][]route)
+	shared := make(map[string]AppConfig)
+	aliasOf := make(map[string]string)
+
+	for _, app := range apps {
+		for _, domain := range app.Domains {
+			if other, ok := shared[domain.Canonical]; ok {
+				for _, d := range other.Domains {
+					if d.Canonical == domain.Canonical && d.TLS != domain.TLS {
+						return fmt.Errorf("apps '%s' and '%s' share domain '%s' with different tls settings", other.Name, app.Name, domain.Canonical)
+					}
+				}
+				if !other.HTTP.sameRedirects(app.HTTP) {
+					return fmt.Errorf("apps '%s' and '%s' share domain '%s' with different http.redirectCode, http.httpsRedirect or http.preserveQuery", other.Name, app.Name, domain.Canonical)
+				}
+			} else {
+				shared[domain.Canonical] = app
+			}
+			for _, alias := range domain.Aliases {
+				if canonical, ok := aliasOf[alias]; ok && canonical != domain.Canonical {
+					return fmt.Errorf("app '%s': alias '%s' is already an alias of '%s'", app.Name, alias, canonical)
+				}
+				aliasOf[alias] = domain.Canonical
+			}
+
+			for _, path := range domain.RoutePaths() {
+				for _, other := range routes[domain.Canonical] {
+					if other.path.Prefix == path.Prefix {
+						if other.app == app.Name {
+							return fmt.Errorf("app '%s': path '%s' of domain '%s' is listed twice", app.Name, path.Prefix, domain.Canonical)
+						}
+						return fmt.Errorf("apps '%s' and '%s' both route %s%s", other.app, app.Name, domain.Canonical, strings.TrimSuffix(path.Prefix, "/"))
+					}
+					// A route below another one is never used when the other one goes first.
+					if inner, outer := path, other.path; outer.Covers(inner) && outer.Priority > inner.Priority {
+						return fmt.Errorf("app '%s': path '%s' of domain '%s' is never used, path '%s' of app '%s' has a higher priority", app.Name, inner.Prefix, domain.Canonical, outer.Prefix, other.app)
+					}
+					if inner, outer := other.path, path; outer.Covers(inner) && outer.Priority > inner.Priority {
+						return fmt.Errorf("app '%s': path '%s' of domain '%s' is never used, path '%s' of app '%s' has a higher priority", other.app, inner.Prefix, domain.Canonical, outer.Prefix, app.Name)
+					}
+				}
+				routes[domain.Canonical] = append(routes[domain.Canonical], route{app: app.Name, path: path})
+			}
+		}
+	}
+
+	for alias, canonical := range aliasOf {
+		if _, ok := routes[alias]; ok {
+			return fmt.Errorf("'%s' is both a domain and an alias of '%s'", alias, canonical)
+		}
+	}
+	return nil
+}
+
 // ValidateConfigFile checks that the Config is well-formed.
 func ValidateConfigFile(conf *Config) error {
+	if err := ValidateACMEAccount(conf.TLS); err != nil {
+		return err
+	}
+
 	// Validate apps.
 	if len(conf.Apps) == 0 {
 		return errors.New("no apps defined in config")
@@ -49,9 +315,18 @@ func ValidateConfigFile(conf *Config) error {
 		if app.Name == "" {
 			return errors.New("found an app with an empty name")
 		}
+		if err := ValidateAppName(app.Name); err != nil {
+			return err
+		}
+		if app.Port != "" {
+			if err := ValidatePort(app.Port); err != nil {
+				return fmt.Errorf("app '%s': %w", app.Name, err)
+			}
+		}
 		if len(app.Domains) == 0 {
 			return fmt.Errorf("app '%s': no domains defined", app.Name)
 		}
+		usesACME := false
 		for _, domain := range app.Domains {
 			if err := ValidateDomain(domain.Canonical); err != nil {
 				return fmt.Errorf("app '%s': %w", app.Name, err)
@@ -60,40 +335,83 @@ func ValidateConfigFile(conf *Config) error {
 				if err := ValidateDomain(alias); err != nil {
 					return fmt.Errorf("app '%s', alias '%s': %w", app.Name, alias, err)
 				}
+				if strings.HasPrefix(alias, "*.") && domain.UsesACME() && app.TLS.Challenge != TLSChallengeDNS01 {
+					return fmt.Errorf("app '%s': wildcard alias '%s' needs tls.challenge %s", app.Name, alias, TLSChallengeDNS01)
+				}
+			}
+			if strings.HasPrefix(domain.Canonical, "*.") {
+				if domain.UsesACME() && app.TLS.Challenge != TLSChallengeDNS01 {
+					return fmt.Errorf("app '%s': wildcard domain '%s' needs tls.challenge %s", app.Name, domain.Canonical, TLSChallengeDNS01)
+				}
+				if len(domain.Aliases) > 0 {
+					return fmt.Errorf("app '%s': wildcard domain '%s' can't have aliases", app.Name, domain.Canonical)
+				}
+			}
+			for _, path := range domain.Paths {
+				if err := ValidatePath(path); err != nil {
+					return fmt.Errorf("app '%s', domain '%s': %w", app.Name, domain.Canonical, err)
+				}
+			}
+			if err := ValidateDomainTLS(domain.TLS); err != nil {
+				return fmt.Errorf("app '%s', domain '%s': %w", app.Name, domain.Canonical, err)
+			}
+			if domain.UsesACME() {
+				usesACME = true
 			}
 		}
-		if len(app.ACMEEmail) == 0 {
-			return fmt.Errorf("app '%s': missing ACME email used to get TLS certificates", app.Name)
-		}
-		if !helpers.IsValidEmail(app.ACMEEmail) {
-			return fmt.Errorf("app '%s': invalid ACME email '%s'", app.Name, app.ACMEEmail)
-		}
-		if app.Dockerfile == "" {
-			return fmt.Errorf("app '%s': missing dockerfile path", app.Name)
+		if app.TLS.accountSettings() != conf.TLS.accountSettings() {
+			return fmt.Errorf("app '%s': tls.caDirectory, tls.eab, tls.caBundle and tls.preferredChain can only be set in the top-level tls section", app.Name)
 		}
-		if app.BuildContext == "" {
-			return fmt.Errorf("app '%s': missing build context path", app.Name)
+		switch app.TLS.Challenge {
+		case "", TLSChallengeHTTP01:
+		case TLSChallengeDNS01:
+			if app.TLS.DNSProvider == "" {
+				return fmt.Errorf("app '%s': tls.challenge %s needs a tls.dnsProvider", app.Name, TLSChallengeDNS01)
+			}
+		default:
+			return fmt.Errorf("app '%s': invalid tls.challenge '%s', expected %s or %s", app.Name, app.TLS.Challenge, TLSChallengeHTTP01, TLSChallengeDNS01)
 		}
-		// Check Dockerfile.
-		fileInfo, err := os.Stat(app.Dockerfile)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("app '%s': dockerfile '%s' does not exist", app.Name, app.Dockerfile)
-		} else if err != nil {
-			return fmt.Errorf("app '%s': unable to check dockerfile '%s': %w", app.Name, app.Dockerfile, err)
+		if usesACME && len(app.ACMEEmail) == 0 {
+			return fmt.Errorf("app '%s': missing ACME email used to get TLS certificates", app.Name)
 		}
-		if fileInfo.IsDir() {
-			return fmt.Errorf("app '%s': dockerfile '%s' is a directory, not a file", app.Name, app.Dockerfile)
+		if app.ACMEEmail != "" && !helpers.IsValidEmail(app.ACMEEmail) {
+			return fmt.Errorf("app '%s': invalid ACME email '%s'", app.Name, app.ACMEEmail)
 		}
+		if app.Image != "" {
+			if app.Dockerfile != "" || app.BuildContext != "" {
+				return fmt.Errorf("app '%s': set either image or dockerfile and buildContext, not both", app.Name)
+			}
+			if err := ValidateImage(app.Image); err != nil {
+				return fmt.Errorf("app '%s': %w", app.Name, err)
+			}
+		} else {
+			if app.Dockerfile == "" {
+				return fmt.Errorf("app '%s': missing image or dockerfile path", app.Name)
+			}
+			if app.BuildContext == "" {
+				return fmt.Errorf("app '%s': missing build context path", app.Name)
+			}
+			// Check Dockerfile.
+			fileInfo, err := os.Stat(app.Dockerfile)
+			if os.IsNotExist(err) {
+				return fmt.Errorf("app '%s': dockerfile '%s' does not exist", app.Name, app.Dockerfile)
+			} else if err != nil {
+				return fmt.Errorf("app '%s': unable to check dockerfile '%s': %w", app.Name, app.Dockerfile, err)
+			}
+			if fileInfo.IsDir() {
+				return fmt.Errorf("app '%s': dockerfile '%s' is a directory, not a file", app.Name, app.Dockerfile)
+			}
 
-		// Check BuildContext.
-		ctxInfo, err := os.Stat(app.BuildContext)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("app '%s': build context '%s' does not exist", app.Name, app.BuildContext)
-		} else if err != nil {
-			return fmt.Errorf("app '%s': unable to check build context '%s': %w", app.Name, app.BuildContext, err)
-		}
-		if !ctxInfo.IsDir() {
-			return fmt.Errorf("app '%s': build context '%s' is not a directory", app.Name, app.BuildContext)
+			// Check BuildContext.
+			ctxInfo, err := os.Stat(app.BuildContext)
+			if os.IsNotExist(err) {
+				return fmt.Errorf("app '%s': build context '%s' does not exist", app.Name, app.BuildContext)
+			} else if err != nil {
+				return fmt.Errorf("app '%s': unable to check build context '%s': %w", app.Name, app.BuildContext, err)
+			}
+			if !ctxInfo.IsDir() {
+				return fmt.Errorf("app '%s': build context '%s' is not a directory", app.Name, app.BuildContext)
+			}
 		}
 
 		// Validate volumes.
@@ -113,10 +431,46 @@ func ValidateConfigFile(conf *Config) error {
 			}
 		}
 
+		if app.DrainTime < 0 {
+			return fmt.Errorf("app '%s': drainTime cannot be negative", app.Name)
+		}
+
+		if app.Replicas < 1 {
+			return fmt.Errorf("app '%s': replicas must be at least 1", app.Name)
+		}
+		if app.MaxSurge < 0 || app.MaxUnavailable < 0 {
+			return fmt.Errorf("app '%s': maxSurge and maxUnavailable cannot be negative", app.Name)
+		}
+		if app.MaxSurge == 0 && app.MaxUnavailable == 0 {
+			return fmt.Errorf("app '%s': maxSurge and maxUnavailable cannot both be 0", app.Name)
+		}
+
+		if len(app.Hooks.PreDeploy) > 0 && app.Hooks.PreDeploy[0] == "" {
+			return fmt.Errorf("app '%s': preDeploy hook has an empty command", app.Name)
+		}
+		if len(app.Hooks.PostDeploy) > 0 && app.Hooks.PostDeploy[0] == "" {
+			return fmt.Errorf("app '%s': postDeploy hook has an empty command", app.Name)
+		}
+
+		if err := ValidateHTTP(app.HTTP); err != nil {
+			return fmt.Errorf("app '%s': %w", app.Name, err)
+		}
+		if err := ValidateAccess(app.Access); err != nil {
+			return fmt.Errorf("app '%s': %w", app.Name, err)
+		}
+		if app.RateLimit != nil {
+			if err := ValidateRateLimit(*app.RateLimit); err != nil {
+				return fmt.Errorf("app '%s': %w", app.Name, err)
+			}
+		}
+		if app.MaxConnections < 0 {
+			return fmt.Errorf("app '%s': maxConnections cannot be negative", app.Name)
+		}
+
 		// Check that the health check path is a valid URL path.
 		if err := ValidateHealthCheckPath(app.HealthCheckPath); err != nil {
 			return fmt.Errorf("app '%s': %w", app.Name, err)
 		}
 	}
-	return nil
+	return ValidateRoutes(conf.Apps)
 }
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// routedApp is an app serving domain with paths.
+func routedApp(name, domain string, paths ...Path) AppConfig {
+	return AppConfig{Name: name, Domains: []Domain{{Canonical: domain, Paths: paths}}}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		apps []AppConfig
+		// wantErr is part of the error, empty when the routes are valid
+		wantErr string
+	}{
+		{
+			name: "different domains",
+			apps: []AppConfig{routedApp("a", "a.example.com"), routedApp("b", "b.example.com")},
+		},
+		{
+			name: "longer prefix",
+			apps: []AppConfig{routedApp("site", "example.com"), routedApp("api", "example.com", Path{Prefix: "/api"})},
+		},
+		{
+			name: "equal-length prefixes",
+			apps: []AppConfig{routedApp("api", "example.com", Path{Prefix: "/api"}), routedApp("app", "example.com", Path{Prefix: "/app"})},
+		},
+		{
+			name: "longer prefix with a higher priority",
+			apps: []AppConfig{routedApp("site", "example.com"), routedApp("api", "example.com", Path{Prefix: "/api", Priority: 10})},
+		},
+		{
+			name:    "same prefix",
+			apps:    []AppConfig{routedApp("a", "example.com", Path{Prefix: "/api"}), routedApp("b", "example.com", Path{Prefix: "/api"})},
+			wantErr: "apps 'a' and 'b' both route example.com/api",
+		},
+		{
+			name:    "same domain",
+			apps:    []AppConfig{routedApp("a", "example.com"), routedApp("b", "example.com")},
+			wantErr: "apps 'a' and 'b' both route example.com",
+		},
+		{
+			name:    "prefix listed twice",
+			apps:    []AppConfig{routedApp("a", "example.com", Path{Prefix: "/api"}, Path{Prefix: "/api", Priority: 1})},
+			wantErr: "path '/api' of domain 'example.com' is listed twice",
+		},
+		{
+			name:    "shorter prefix with a higher priority",
+			apps:    []AppConfig{routedApp("api", "example.com", Path{Prefix: "/api"}), routedApp("maintenance", "example.com", Path{Prefix: "/", Priority: 10})},
+			wantErr: "app 'api': path '/api' of domain 'example.com' is never used",
+		},
+		{
+			name:    "shorter prefix with a higher priority first",
+			apps:    []AppConfig{routedApp("maintenance", "example.com", Path{Prefix: "/", Priority: 10}), routedApp("api", "example.com", Path{Prefix: "/api"})},
+			wantErr: "app 'api': path '/api' of domain 'example.com' is never used",
+		},
+		{
+			name: "prefix of the name with a higher priority",
+			apps: []AppConfig{routedApp("api", "example.com", Path{Prefix: "/api", Priority: 10}), routedApp("apis", "example.com", Path{Prefix: "/apis"})},
+		},
+		{
+			name: "exact domain and a wildcard",
+			apps: []AppConfig{routedApp("wildcard", "*.example.com"), routedApp("api", "api.example.com")},
+		},
+		{
+			name: "alias of two domains",
+			apps: []AppConfig{
+				{Name: "a", Domains: []Domain{{Canonical: "a.example.com", Aliases: []string{"www.example.com"}}}},
+				{Name: "b", Domains: []Domain{{Canonical: "b.example.com", Aliases: []string{"www.example.com"}}}},
+			},
+			wantErr: "alias 'www.example.com' is already an alias of 'a.example.com'",
+		},
+		{
+			name: "domain and alias",
+			apps: []AppConfig{
+				{Name: "a", Domains: []Domain{{Canonical: "example.com", Aliases: []string{"www.example.com"}}}},
+				routedApp("b", "www.example.com"),
+			},
+			wantErr: "'www.example.com' is both a domain and an alias of 'example.com'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRoutes(tt.apps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateRoutes() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateRoutes() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAppName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "app"},
+		{name: "my-app_2.web"},
+		{name: "", wantErr: true},
+		{name: "App", wantErr: true},
+		{name: "my app", wantErr: true},
+		{name: "app;", wantErr: true},
+		{name: "turkis_burst_app", wantErr: true},
+		{name: "turkis_", wantErr: true},
+		{name: "turkis-app"},
+		{name: "acme_challenge", wantErr: true},
+		{name: "default_backend", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateAppName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateAppName(%q) = %v, want an error: %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
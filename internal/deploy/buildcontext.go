@@ -0,0 +1,200 @@
+package deploy
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// externalDockerfileName is the name used inside the build context tarball when
+// the Dockerfile lives outside the build context directory.
+const externalDockerfileName = ".turkis.Dockerfile"
+
+// tarBuildContext streams the build context directory as a tar archive, honouring
+// .dockerignore. It returns the archive and the Dockerfile path relative to it.
+func tarBuildContext(buildContext, dockerfile string) (io.ReadCloser, string, error) {
+	contextDir, err := filepath.Abs(buildContext)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve build context '%s': %w", buildContext, err)
+	}
+	dockerfilePath, err := filepath.Abs(dockerfile)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve dockerfile '%s': %w", dockerfile, err)
+	}
+
+	ignorePatterns, err := readDockerignore(contextDir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Like `docker build -f`, allow a Dockerfile outside of the build context by
+	// adding it to the archive under a reserved name.
+	dockerfileRel, err := filepath.Rel(contextDir, dockerfilePath)
+	external := err != nil || dockerfileRel == ".." || strings.HasPrefix(dockerfileRel, ".."+string(filepath.Separator))
+	if external {
+		dockerfileRel = externalDockerfileName
+	}
+	dockerfileRel = filepath.ToSlash(dockerfileRel)
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.WalkDir(contextDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(contextDir, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+
+			// The Dockerfile and .dockerignore are always sent, like the docker CLI does.
+			if rel != dockerfileRel && rel != ".dockerignore" && isIgnored(rel, ignorePatterns) {
+				if d.IsDir() && !hasExceptions(ignorePatterns) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return addToTar(tw, path, rel)
+		})
+		if err == nil && external {
+			err = addToTarAs(tw, dockerfilePath, externalDockerfileName)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, dockerfileRel, nil
+}
+
+func addToTar(tw *tar.Writer, path, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func addToTarAs(tw *tar.Writer, path, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read dockerfile '%s': %w", path, err)
+	}
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ignorePattern is a single .dockerignore line. Exception patterns start with '!'.
+type ignorePattern struct {
+	pattern   string
+	exception bool
+}
+
+func readDockerignore(contextDir string) ([]ignorePattern, error) {
+	f, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		p.pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		patterns = append(patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+	return patterns, nil
+}
+
+// isIgnored reports whether rel is excluded. The last matching pattern wins, and
+// a pattern matching a parent directory also matches everything below it.
+func isIgnored(rel string, patterns []ignorePattern) bool {
+	ignored := false
+	for _, p := range patterns {
+		if matchesPathOrParent(p.pattern, rel) {
+			ignored = !p.exception
+		}
+	}
+	return ignored
+}
+
+func matchesPathOrParent(pattern, rel string) bool {
+	for path := rel; path != "." && path != ""; path = filepath.ToSlash(filepath.Dir(path)) {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExceptions(patterns []ignorePattern) bool {
+	for _, p := range patterns {
+		if p.exception {
+			return true
+		}
+	}
+	return false
+}
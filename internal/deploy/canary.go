@@ -0,0 +1,191 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/history"
+)
+
+// canaryState describes a canary deployment that runs next to the stable one.
+type canaryState struct {
+	DeploymentID string
+	Percent      int
+	// Canary are the containers of the canary deployment.
+	Canary []ContainerInfo
+	// Stable are the running containers of earlier deployments, oldest first.
+	Stable []ContainerInfo
+}
+
+// findCanary returns the canary in progress for the app, or nil if there is none. A canary
+// is in progress while the newest running deployment is labeled as a canary and containers
+// of older deployments are still running.
+func findCanary(ctx context.Context, rt Runtime, appName string) (*canaryState, error) {
+	running, err := rt.ListContainers(ctx, ListOptions{AppName: appName})
+	if err != nil {
+		return nil, err
+	}
+	if len(running) == 0 {
+		return nil, nil
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].DeploymentID < running[j].DeploymentID })
+
+	newest := running[len(running)-1]
+	percent, _ := strconv.Atoi(newest.Labels[config.LabelCanary])
+	if percent <= 0 {
+		return nil, nil
+	}
+
+	state := &canaryState{DeploymentID: newest.DeploymentID, Percent: percent}
+	for _, c := range running {
+		if c.DeploymentID == newest.DeploymentID {
+			state.Canary = append(state.Canary, c)
+		} else {
+			state.Stable = append(state.Stable, c)
+		}
+	}
+	if len(state.Stable) == 0 {
+		// Promoted, or nothing left to compare against.
+		return nil, nil
+	}
+	return state, nil
+}
+
+// canaryReplicas is how many replicas a canary starts: its share of the app's replicas,
+// rounded up, and at least one.
+func canaryReplicas(replicas, percent int) int {
+	return max(1, min(replicas, (replicas*percent+99)/100))
+}
+
+// runCanary starts the canary replicas next to the old ones, which keep running. The preDeploy
+// hook runs first, the postDeploy hook runs when the canary is promoted.
+func (r *rollout) runCanary(ctx context.Context) (string, error) {
+	if err := r.hook(ctx, hookPreDeploy, r.appConfig.Hooks.PreDeploy); err != nil {
+		return "", err
+	}
+
+	n := canaryReplicas(r.appConfig.Replicas, r.canary)
+	if failedID, err := r.start(ctx, n); err != nil {
+		return failedID, err
+	}
+	if err := WaitForRouting(ctx, r.appConfig.Name, r.started); err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
+		fmt.Printf("Warning: could not confirm that turkis-manager routes traffic to the canary: %v\n", err)
+	}
+	return "", nil
+}
+
+// PromoteCanary finishes a canary deployment. It starts the remaining replicas of the canary,
+// health checks them, runs the postDeploy hook, then drains and stops the old deployment.
+func PromoteCanary(ctx context.Context, rt Runtime, appConfig *config.AppConfig) (err error) {
+	state, err := findCanary(ctx, rt, appConfig.Name)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("app '%s' has no canary deployment in progress", appConfig.Name)
+	}
+
+	entry := canaryHistoryEntry(ctx, rt, history.ActionPromote, appConfig, state)
+	defer func() { finishHistoryEntry(entry, err) }()
+
+	r := &rollout{
+		rt:           rt,
+		appConfig:    appConfig,
+		imageName:    state.Canary[0].ImageID,
+		deploymentID: state.DeploymentID,
+		canary:       state.Percent,
+		cutover:      managerCutover,
+		old:          state.Stable,
+	}
+	for _, c := range state.Canary {
+		r.started = append(r.started, c.ID)
+	}
+
+	if missing := appConfig.Replicas - len(r.started); missing > 0 {
+		fmt.Printf("Starting %d more replica(s) of deployment %s...\n", missing, state.DeploymentID)
+		if failedID, err := r.start(ctx, missing); err != nil {
+			if failedID != "" {
+				entry.HealthCheck = history.HealthFailed
+				removeUnhealthyReplica(context.WithoutCancel(ctx), rt, appConfig.Name, failedID, appConfig.DrainTime)
+			}
+			return err
+		}
+	}
+	entry.HealthCheck = history.HealthPassed
+
+	if err := r.hook(ctx, hookPostDeploy, appConfig.Hooks.PostDeploy); err != nil {
+		return err
+	}
+
+	if err := r.retire(ctx, len(r.old)); err != nil {
+		return err
+	}
+
+	if err := PruneOldContainers(ctx, rt, appConfig.Name, state.DeploymentID, appConfig.KeepOldContainers); err != nil {
+		return fmt.Errorf("failed to prune old containers: %w", err)
+	}
+	if err := PruneOldImages(ctx, rt, appConfig.Name); err != nil {
+		fmt.Printf("Warning: failed to prune old images: %v\n", err)
+	}
+
+	fmt.Printf("Promoted canary deployment %s of app '%s'\n", state.DeploymentID, appConfig.Name)
+	return nil
+}
+
+// AbortCanary reverts a canary deployment. Its containers are drained and removed, and the
+// old deployment gets all the traffic again.
+func AbortCanary(ctx context.Context, rt Runtime, appConfig *config.AppConfig) (err error) {
+	state, err := findCanary(ctx, rt, appConfig.Name)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("app '%s' has no canary deployment in progress", appConfig.Name)
+	}
+
+	entry := canaryHistoryEntry(ctx, rt, history.ActionAbort, appConfig, state)
+	defer func() { finishHistoryEntry(entry, err) }()
+
+	ids := make([]string, 0, len(state.Canary))
+	for _, c := range state.Canary {
+		ids = append(ids, c.ID)
+	}
+	fmt.Printf("Draining canary deployment %s...\n", state.DeploymentID)
+	if err := DrainContainers(ctx, appConfig.Name, ids, appConfig.DrainTime); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("Warning: could not confirm that the canary was drained: %v. Removing it anyway.\n", err)
+	}
+	for _, c := range state.Canary {
+		fmt.Printf("Removing canary container %s\n", shortID(c.ID))
+		if err := rt.StopContainer(ctx, c.ID); err != nil {
+			return err
+		}
+		if err := rt.RemoveContainer(ctx, c.ID); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Aborted canary deployment %s of app '%s'\n", state.DeploymentID, appConfig.Name)
+	return nil
+}
+
+func canaryHistoryEntry(ctx context.Context, rt Runtime, action string, appConfig *config.AppConfig, state *canaryState) *history.Entry {
+	entry := newHistoryEntry(action, appConfig)
+	entry.DeploymentID = state.DeploymentID
+	entry.ContainerID = state.Canary[0].ID
+	if appConfig.Image != "" {
+		entry.Image = state.Canary[0].Image
+	}
+	// The canary was built earlier, so the current commit doesn't apply.
+	entry.GitCommit = ""
+	setHistoryImage(ctx, rt, entry, state.Canary[0].ImageID)
+	return entry
+}
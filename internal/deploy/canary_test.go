@@ -0,0 +1,79 @@
+package deploy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCanaryReplicas(t *testing.T) {
+	tests := []struct {
+		replicas, percent, want int
+	}{
+		{replicas: 1, percent: 1, want: 1},
+		{replicas: 1, percent: 99, want: 1},
+		{replicas: 4, percent: 25, want: 1},
+		{replicas: 4, percent: 26, want: 2},
+		{replicas: 10, percent: 10, want: 1},
+		{replicas: 3, percent: 99, want: 3},
+		{replicas: 3, percent: 100, want: 3},
+	}
+	for _, tt := range tests {
+		if got := canaryReplicas(tt.replicas, tt.percent); got != tt.want {
+			t.Errorf("canaryReplicas(%d, %d) = %d, want %d", tt.replicas, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestFindCanary(t *testing.T) {
+	tests := []struct {
+		name        string
+		deployments []testDeployment
+		// wantCanary and wantStable are the numbers of containers, wantCanary is 0 without a canary
+		wantCanary, wantStable int
+	}{
+		{name: "no deployments"},
+		{name: "regular deployment", deployments: []testDeployment{{id: "20240101000000", replicas: 2, running: true}}},
+		{
+			name: "canary",
+			deployments: []testDeployment{
+				{id: "20240101000000", replicas: 3, running: true},
+				{id: "20240102000000", running: true, canary: 10},
+			},
+			wantCanary: 1,
+			wantStable: 3,
+		},
+		{
+			name: "canary without a stable deployment",
+			deployments: []testDeployment{
+				{id: "20240101000000", replicas: 3},
+				{id: "20240102000000", running: true, canary: 10},
+			},
+		},
+		{
+			name: "regular deployment after a canary",
+			deployments: []testDeployment{
+				{id: "20240101000000", running: true, canary: 10},
+				{id: "20240102000000", running: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := NewFakeRuntime()
+			runTestDeployments(t, rt, tt.deployments)
+			state, err := findCanary(context.Background(), rt, "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state == nil {
+				if tt.wantCanary != 0 {
+					t.Fatal("no canary found")
+				}
+				return
+			}
+			if len(state.Canary) != tt.wantCanary || len(state.Stable) != tt.wantStable || state.Percent != 10 {
+				t.Errorf("canary of %d containers at %d%% next to %d, want %d at 10%% next to %d", len(state.Canary), state.Percent, len(state.Stable), tt.wantCanary, tt.wantStable)
+			}
+		})
+	}
+}
@@ -1,153 +1,125 @@
 package deploy
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"os/exec"
 	"sort"
 	"strings"
 )
 
-func StopOldContainers(appName, newContainerID, newDeploymentID string) error {
-	out, err := exec.Command("docker", "ps", "--filter", fmt.Sprintf("label=turkis.appName=%s", appName), "--format", "{{.ID}}").Output()
+// PruneOldContainers removes the containers of all but the newest keepCount earlier deployments.
+// All replicas of a kept deployment are kept so it can be rolled back to.
+func PruneOldContainers(ctx context.Context, rt Runtime, appName, newDeploymentID string, keepCount int) error {
+	containers, err := rt.ListContainers(ctx, ListOptions{AppName: appName, All: true})
 	if err != nil {
 		return err
 	}
-	containers := strings.Split(strings.TrimSpace(string(out)), "\n")
-	for _, id := range containers {
-		// Skip if the container ID is empty or matches the new container.
-		if id == "" || strings.HasPrefix(newContainerID, id) || strings.HasPrefix(id, newContainerID) {
-			continue
-		}
-
-		// Inspect the container's deployment label.
-		labelOut, err := exec.Command("docker", "inspect", "--format", "{{ index .Config.Labels \"turkis.deployment\" }}", id).Output()
-		if err != nil {
-			fmt.Printf("Error reading deployment label for container %s: %v. Skipping container...\n", id, err)
-			continue
-		}
-		containerDeploymentID := strings.TrimSpace(string(labelOut))
-		if containerDeploymentID != newDeploymentID {
-			fmt.Printf("Stopping old container: %s (deployment: %s)\n", id, containerDeploymentID)
-			if err := exec.Command("docker", "stop", id).Run(); err != nil {
-				fmt.Printf("Error stopping container %s: %v\n", id, err)
-			}
-		}
-	}
-	return nil
-}
-
-func PruneOldContainers(appName, newContainerID string, keepCount int) error {
-	out, err := exec.Command("docker", "ps", "-a", "--filter", fmt.Sprintf("label=turkis.appName=%s", appName), "--format", "{{.ID}}").CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to list containers: %w - output: %s", err, string(out))
-	}
 
-	ids := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if len(ids) == 0 || (len(ids) == 1 && ids[0] == "") {
-		return nil
-	}
-
-	var containers []ContainerInfo
-	for _, id := range ids {
-		if id == "" {
-			continue
-		}
-		labelOut, err := exec.Command("docker", "inspect", "--format", "{{ index .Config.Labels \"turkis.deployment\" }}", id).CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error inspecting container %s for deployment label: %v\n", id, err)
-			continue
-		}
-
-		depID := strings.TrimSpace(string(labelOut))
+	byDeployment := make(map[string][]ContainerInfo)
+	var deploymentIDs []string
+	for _, c := range containers {
 		// Validate deployment ID format (should be a timestamp like 20060102150405)
-		if len(depID) != 14 || !isNumeric(depID) {
-			fmt.Printf("Warning: Container %s has invalid deployment ID format: %s\n", id, depID)
+		if len(c.DeploymentID) != 14 || !isNumeric(c.DeploymentID) {
+			fmt.Printf("Warning: Container %s has invalid deployment ID format: %s\n", shortID(c.ID), c.DeploymentID)
 		}
-
-		containers = append(containers, ContainerInfo{ID: id, DeploymentID: depID})
-	}
-
-	var oldContainers []ContainerInfo
-	for _, c := range containers {
-		if c.ID == newContainerID {
+		if c.DeploymentID == newDeploymentID {
 			continue
 		}
-		oldContainers = append(oldContainers, c)
+		if _, ok := byDeployment[c.DeploymentID]; !ok {
+			deploymentIDs = append(deploymentIDs, c.DeploymentID)
+		}
+		byDeployment[c.DeploymentID] = append(byDeployment[c.DeploymentID], c)
 	}
 
 	// Sort by deployment ID (newer ones first)
-	sort.Slice(oldContainers, func(i, j int) bool {
-		return oldContainers[i].DeploymentID > oldContainers[j].DeploymentID
+	sort.Slice(deploymentIDs, func(i, j int) bool {
+		return deploymentIDs[i] > deploymentIDs[j]
 	})
 
-	if len(oldContainers) <= keepCount {
+	if len(deploymentIDs) <= keepCount {
 		fmt.Println("No extra containers to prune.")
 		return nil
 	}
 
-	for _, c := range oldContainers[keepCount:] {
-		fmt.Printf("Pruning container %s (deployment: %s)\n", c.ID, c.DeploymentID)
-		out, err := exec.Command("docker", "rm", c.ID).CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error pruning container %s: %v, details: %s\n", c.ID, err, string(out))
+	for _, deploymentID := range deploymentIDs[keepCount:] {
+		for _, c := range byDeployment[deploymentID] {
+			if c.Running {
+				// Only stopped containers are pruned, a running one is still serving.
+				continue
+			}
+			fmt.Printf("Pruning container %s (deployment: %s)\n", shortID(c.ID), c.DeploymentID)
+			if err := rt.RemoveContainer(ctx, c.ID); err != nil {
+				fmt.Printf("Error pruning container %s: %v\n", shortID(c.ID), err)
+			}
 		}
 	}
 	return nil
 }
 
-func PruneOldImages(appName string) error {
+// PruneOldImages removes the images of the app that no container of it uses anymore, then
+// prunes dangling images. The app's images are found through the repositories its containers
+// were started from, so images pulled from a registry are pruned like locally built ones.
+func PruneOldImages(ctx context.Context, rt Runtime, appName string) error {
 	fmt.Println("Pruning dangling images...")
 
-	// First, remove unused images related to this app
-	listCmd := exec.Command("docker", "images", "--filter", fmt.Sprintf("reference=%s", appName), "--format", "{{.ID}}")
-	output, err := listCmd.CombinedOutput()
+	containers, err := rt.ListContainers(ctx, ListOptions{AppName: appName, All: true})
 	if err != nil {
-		return fmt.Errorf("error listing images for %s: %w (%s)", appName, err, string(output))
+		return err
 	}
-
-	imageIDs := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, id := range imageIDs {
-		if id == "" {
-			continue
+	inUse := make(map[string]bool)
+	// Locally built images are tagged with the app name.
+	repositories := []string{appName}
+	for _, c := range containers {
+		inUse[c.ImageID] = true
+		if repository := imageRepository(c.Image); repository != "" && !containsString(repositories, repository) {
+			repositories = append(repositories, repository)
 		}
+	}
 
-		// Check if the image is not being used
-		inspectCmd := exec.Command("docker", "inspect", "--format", "{{.RepoTags}}", id)
-		inspectOut, err := inspectCmd.CombinedOutput()
+	// First, remove unused images related to this app
+	removed := make(map[string]bool)
+	for _, repository := range repositories {
+		images, err := rt.ListImages(ctx, repository)
 		if err != nil {
-			fmt.Printf("Warning: could not inspect image %s: %v\n", id, err)
-			continue
+			return err
 		}
-
-		// Skip the latest tag
-		if strings.Contains(string(inspectOut), fmt.Sprintf("%s:latest", appName)) {
-			continue
-		}
-
-		fmt.Printf("Removing old image: %s\n", id)
-		removeCmd := exec.Command("docker", "rmi", id)
-		removeOut, err := removeCmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Warning: could not remove image %s: %v (%s)\n", id, err, string(removeOut))
+		for _, image := range images {
+			if inUse[image.ID] || removed[image.ID] {
+				continue
+			}
+			removed[image.ID] = true
+			fmt.Printf("Removing old image: %s\n", shortID(strings.TrimPrefix(image.ID, "sha256:")))
+			if err := rt.RemoveImage(ctx, image.ID); err != nil {
+				fmt.Printf("Warning: could not remove image %s: %v\n", image.ID, err)
+			}
 		}
 	}
 
 	// Then, prune dangling images (no tag) system-wide
-	pruneCmd := exec.Command("docker", "image", "prune", "--force")
-	pruneCmd.Stdout = io.Discard
-	pruneCmd.Stderr = io.Discard
-	if err := pruneCmd.Run(); err != nil {
-		return fmt.Errorf("error pruning dangling images: %w", err)
-	}
+	return rt.PruneDanglingImages(ctx)
+}
 
-	return nil
+// imageRepository returns the repository of an image reference without its tag or digest,
+// e.g. registry.example.com:5000/team/app for registry.example.com:5000/team/app:1.4.2. It
+// returns "" for an image ID, which Docker shows for containers whose tag moved on.
+func imageRepository(image string) string {
+	if strings.HasPrefix(image, "sha256:") || isImageID(image) {
+		return ""
+	}
+	repository, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository
 }
 
-// Helper function to check if a string contains only digits
-func isNumeric(s string) bool {
-	for _, c := range s {
-		if c < '0' || c > '9' {
+// isImageID reports whether s looks like a full or short hex image ID.
+func isImageID(s string) bool {
+	if len(s) != 12 && len(s) != 64 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
 			return false
 		}
 	}
@@ -0,0 +1,252 @@
+package deploy
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// testDeployment is a deployment of the test app and whether its containers run.
+type testDeployment struct {
+	id       string
+	image    string
+	replicas int
+	running  bool
+	// canary is the canary percentage of the deployment
+	canary int
+}
+
+// runTestDeployments runs the containers of the deployments of app.
+func runTestDeployments(t *testing.T, rt *FakeRuntime, deployments []testDeployment) {
+	t.Helper()
+	ctx := context.Background()
+	if err := rt.EnsureNetwork(ctx, config.DockerNetwork); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deployments {
+		image := d.image
+		if image == "" {
+			image = "app:latest"
+			if _, err := rt.InspectImage(ctx, image); err != nil {
+				if err := rt.BuildImage(ctx, BuildOptions{Image: image}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i := range max(d.replicas, 1) {
+			id, err := runContainer(ctx, rt, image, &config.AppConfig{Name: "app"}, d.id, i+1, d.canary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !d.running {
+				if err := rt.StopContainer(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestPruneOldContainers(t *testing.T) {
+	tests := []struct {
+		name        string
+		deployments []testDeployment
+		keep        int
+		// want are the deployments whose containers are left
+		want []string
+	}{
+		{
+			name: "keeps the newest",
+			deployments: []testDeployment{
+				{id: "20240101000000"}, {id: "20240102000000"}, {id: "20240103000000"}, {id: "20240104000000", running: true},
+			},
+			keep: 1,
+			want: []string{"20240103000000", "20240104000000"},
+		},
+		{
+			name: "keeps whole deployments",
+			deployments: []testDeployment{
+				{id: "20240101000000", replicas: 2}, {id: "20240102000000", replicas: 3}, {id: "20240103000000", replicas: 2, running: true},
+			},
+			keep: 1,
+			want: []string{"20240102000000", "20240103000000"},
+		},
+		{
+			name: "keep none",
+			deployments: []testDeployment{
+				{id: "20240101000000"}, {id: "20240102000000", running: true},
+			},
+			want: []string{"20240102000000"},
+		},
+		{
+			name: "nothing to prune",
+			deployments: []testDeployment{
+				{id: "20240101000000"}, {id: "20240102000000", running: true},
+			},
+			keep: 3,
+			want: []string{"20240101000000", "20240102000000"},
+		},
+		{
+			name: "running containers are kept",
+			deployments: []testDeployment{
+				{id: "20240101000000", running: true}, {id: "20240102000000"}, {id: "20240103000000", running: true},
+			},
+			want: []string{"20240101000000", "20240103000000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			rt := NewFakeRuntime()
+			runTestDeployments(t, rt, tt.deployments)
+			newest := tt.deployments[len(tt.deployments)-1].id
+
+			if err := PruneOldContainers(ctx, rt, "app", newest, tt.keep); err != nil {
+				t.Fatal(err)
+			}
+
+			want := 0
+			for _, d := range tt.deployments {
+				if slices.Contains(tt.want, d.id) {
+					want += max(d.replicas, 1)
+				}
+			}
+			containers, _ := rt.ListContainers(ctx, ListOptions{AppName: "app", All: true})
+			for _, c := range containers {
+				if !slices.Contains(tt.want, c.DeploymentID) {
+					t.Errorf("container of deployment %s wasn't pruned", c.DeploymentID)
+				}
+			}
+			if len(containers) != want {
+				t.Errorf("%d containers are left, want %d", len(containers), want)
+			}
+		})
+	}
+}
+
+func TestPruneOldImages(t *testing.T) {
+	tests := []struct {
+		name        string
+		pulled      []string
+		deployments []testDeployment
+		// want are the references of the images that are left
+		want []string
+	}{
+		{
+			name:   "registry images",
+			pulled: []string{"registry.example.com/team/app:1", "registry.example.com/team/app:2", "registry.example.com/team/app:3"},
+			deployments: []testDeployment{
+				{id: "20240102000000", image: "registry.example.com/team/app:2"},
+				{id: "20240103000000", image: "registry.example.com/team/app:3", running: true},
+			},
+			want: []string{"registry.example.com/team/app:2", "registry.example.com/team/app:3"},
+		},
+		{
+			name:   "registry with a port",
+			pulled: []string{"localhost:5000/app:1", "localhost:5000/app:2"},
+			deployments: []testDeployment{
+				{id: "20240102000000", image: "localhost:5000/app:2", running: true},
+			},
+			want: []string{"localhost:5000/app:2"},
+		},
+		{
+			name:   "pulled by digest",
+			pulled: []string{"registry.example.com/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "registry.example.com/app:2"},
+			deployments: []testDeployment{
+				{id: "20240102000000", image: "registry.example.com/app:2", running: true},
+			},
+			want: []string{"registry.example.com/app:2"},
+		},
+		{
+			name:   "other repositories are left alone",
+			pulled: []string{"registry.example.com/team/app:1", "registry.example.com/team/app:2", "registry.example.com/team/other:1", "postgres:16"},
+			deployments: []testDeployment{
+				{id: "20240102000000", image: "registry.example.com/team/app:2", running: true},
+			},
+			want: []string{"registry.example.com/team/app:2", "registry.example.com/team/other:1", "postgres:16"},
+		},
+		{
+			name:        "built locally",
+			pulled:      []string{"postgres:16"},
+			deployments: []testDeployment{{id: "20240102000000", running: true}},
+			want:        []string{"app:latest", "postgres:16"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			rt := NewFakeRuntime()
+			for _, image := range tt.pulled {
+				if err := rt.PullImage(ctx, PullOptions{Image: image}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			runTestDeployments(t, rt, tt.deployments)
+
+			if err := PruneOldImages(ctx, rt, "app"); err != nil {
+				t.Fatal(err)
+			}
+
+			var left []string
+			for _, image := range rt.Images {
+				left = append(left, image.Tags...)
+				if len(image.Tags) == 0 {
+					left = append(left, image.Digests...)
+				}
+			}
+			slices.Sort(left)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(left, want) {
+				t.Errorf("images left = %v, want %v", left, want)
+			}
+		})
+	}
+}
+
+func TestPruneOldImagesRebuilt(t *testing.T) {
+	ctx := context.Background()
+	rt := NewFakeRuntime()
+	// Every build moves app:latest to a new image. The image of the stopped deployment is
+	// kept for a rollback until its containers are pruned.
+	runTestDeployments(t, rt, []testDeployment{{id: "20240101000000"}})
+	if err := rt.BuildImage(ctx, BuildOptions{Image: "app:latest"}); err != nil {
+		t.Fatal(err)
+	}
+	runTestDeployments(t, rt, []testDeployment{{id: "20240102000000", running: true}})
+
+	if err := PruneOldImages(ctx, rt, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Images) != 2 {
+		t.Fatalf("%d images are left, want the images of both deployments", len(rt.Images))
+	}
+
+	if err := PruneOldContainers(ctx, rt, "app", "20240102000000", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := PruneOldImages(ctx, rt, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Images) != 1 {
+		t.Errorf("%d images are left, want only the current one", len(rt.Images))
+	}
+}
+
+func TestSortedContainerInfo(t *testing.T) {
+	rt := NewFakeRuntime()
+	runTestDeployments(t, rt, []testDeployment{{id: "20240102000000"}, {id: "20240103000000", running: true}, {id: "20240101000000"}})
+
+	containers, err := SortedContainerInfo(context.Background(), rt, &config.AppConfig{Name: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range containers {
+		got = append(got, c.DeploymentID)
+	}
+	if want := []string{"20240103000000", "20240102000000", "20240101000000"}; !slices.Equal(got, want) {
+		t.Errorf("deployments = %v, want newest first %v", got, want)
+	}
+}
@@ -0,0 +1,152 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/manager"
+	"github.com/ameistad/turkis/internal/remote"
+)
+
+// cutoverGracePeriod is added to the drain time to give the manager time to reconcile.
+const cutoverGracePeriod = 30 * time.Second
+
+// DrainContainers asks turkis-manager to take the containers out of the app's HAProxy backend
+// and blocks until their open sessions have drained. The containers keep running.
+func DrainContainers(ctx context.Context, appName string, containerIDs []string, drainTime int) error {
+	if len(containerIDs) == 0 {
+		return nil
+	}
+	client := NewManagerClient()
+	if err := client.Drain(ctx, appName, containerIDs); err != nil {
+		return err
+	}
+
+	timeout := time.Duration(drainTime)*time.Second + cutoverGracePeriod
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		status, err := client.AppStatus(ctx, appName)
+		switch {
+		case errors.Is(err, manager.ErrAppNotFound):
+			// The manager hasn't seen the app yet.
+		case err != nil:
+			return err
+		case status.Phase == manager.PhaseActive && !routesAny(status, containerIDs):
+			return nil
+		case status.Phase == manager.PhaseFailed:
+			return fmt.Errorf("turkis-manager could not drain %d container(s): %s", len(containerIDs), status.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("timed out after %s waiting for turkis-manager to drain %d container(s)", timeout, len(containerIDs))
+		case <-ticker.C:
+		}
+	}
+}
+
+// UndrainContainers asks turkis-manager to put drained containers back into the app's HAProxy
+// backend, e.g. after they were started again, and blocks until it routes traffic to them.
+func UndrainContainers(ctx context.Context, appName string, containerIDs []string) error {
+	if len(containerIDs) == 0 {
+		return nil
+	}
+	if err := NewManagerClient().Undrain(ctx, appName, containerIDs); err != nil {
+		return err
+	}
+	return WaitForRouting(ctx, appName, containerIDs)
+}
+
+// WaitForRouting blocks until turkis-manager routes traffic to all of the containers.
+func WaitForRouting(ctx context.Context, appName string, containerIDs []string) error {
+	client := NewManagerClient()
+	ctx, cancel := context.WithTimeout(ctx, cutoverGracePeriod)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		status, err := client.AppStatus(ctx, appName)
+		switch {
+		case errors.Is(err, manager.ErrAppNotFound):
+			// The manager hasn't seen the app yet.
+		case err != nil:
+			return err
+		case routesAll(status, containerIDs):
+			return nil
+		case status.Phase == manager.PhaseFailed:
+			return fmt.Errorf("turkis-manager could not route traffic to %d container(s): %s", len(containerIDs), status.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("timed out after %s waiting for turkis-manager to route traffic to %d container(s)", cutoverGracePeriod, len(containerIDs))
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewManagerClient returns a client for the turkis-manager API, tunnelled through ssh when
+// turkis manages a server with --host.
+func NewManagerClient() *manager.APIClient {
+	client := manager.NewAPIClient(config.ManagerURL(), managerToken())
+	if host := config.CurrentHost(); host != nil {
+		client.HTTPClient.Transport = remote.Transport(host)
+	}
+	return client
+}
+
+// managerToken returns the token of the manager API from TURKIS_MANAGER_TOKEN, or else from
+// the token file 'turkis init' created on the server. Without one the manager rejects the
+// requests, which tells the user what is missing. The file is read once, since with --host
+// every read is an ssh round trip.
+var managerToken = sync.OnceValue(func() string {
+	if token, ok := os.LookupEnv("TURKIS_MANAGER_TOKEN"); ok && token != "" {
+		return token
+	}
+	path, err := config.ManagerTokenPath()
+	if err != nil {
+		return ""
+	}
+	data, err := remote.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+})
+
+func routesAll(status manager.AppStatus, containerIDs []string) bool {
+	for _, id := range containerIDs {
+		if !containsString(status.Containers, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func routesAny(status manager.AppStatus, containerIDs []string) bool {
+	for _, id := range containerIDs {
+		if containsString(status.Containers, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,51 +1,129 @@
 package deploy
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
 	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/history"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
 )
 
-// TODO: use golang docker client library instead of exec.Command.
+// DeployOptions changes how DeployApp behaves.
+type DeployOptions struct {
+	// KeepFailed leaves a container that fails its health check in place for debugging
+	// instead of removing it. It is disconnected from the network so it gets no traffic.
+	KeepFailed bool
+	// Image overrides the image of an app that deploys from a registry, e.g. to redeploy an earlier tag.
+	Image string
+	// Rollback records the deploy as a rollback in the deployment history.
+	Rollback bool
+	// Canary starts the new deployment next to the running one with this percentage of the
+	// traffic instead of replacing it. Finish with PromoteCanary or AbortCanary.
+	Canary int
+}
 
-// DeployApp builds the Docker image, runs a new container (with volumes), checks its health,
-// stops any old containers, and prunes extras.
-func DeployApp(appConfig *config.AppConfig) error {
+// DeployApp builds the Docker image (or pulls it for apps with an image), replaces the running
+// replicas with new containers (with volumes) in health-checked batches, and prunes old
+// containers and images. If a new container is unhealthy, the new containers are taken out of
+// service again and the previous deployment keeps serving. The same happens when a deploy
+// hook fails.
+func DeployApp(ctx context.Context, rt Runtime, appConfig *config.AppConfig, opts DeployOptions) (err error) {
+	if canary, err := findCanary(ctx, rt, appConfig.Name); err != nil {
+		return err
+	} else if canary != nil {
+		return fmt.Errorf("app '%s' has canary deployment %s in progress, run 'turkis promote' or 'turkis abort' first", appConfig.Name, canary.DeploymentID)
+	}
+
+	action := history.ActionDeploy
+	switch {
+	case opts.Rollback:
+		action = history.ActionRollback
+	case opts.Canary > 0:
+		if opts.Canary > 99 {
+			return fmt.Errorf("canary percentage must be between 1 and 99")
+		}
+		running, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name})
+		if err != nil {
+			return err
+		}
+		if len(running) == 0 {
+			return fmt.Errorf("app '%s' has no running deployment to compare a canary against, deploy it without --canary first", appConfig.Name)
+		}
+		action = history.ActionCanary
+	}
+	entry := newHistoryEntry(action, appConfig)
+	defer func() { finishHistoryEntry(entry, err) }()
 
 	imageName := appConfig.Name + ":latest"
+	if opts.Image != "" {
+		if appConfig.Image == "" {
+			return fmt.Errorf("app '%s' is built locally and can't be deployed from image '%s'", appConfig.Name, opts.Image)
+		}
+		imageName = opts.Image
+	} else if appConfig.Image != "" {
+		imageName = appConfig.Image
+	}
 
-	// Build the new image.
-	if err := buildImage(appConfig.Dockerfile, appConfig.BuildContext, imageName, appConfig.Env); err != nil {
-		return fmt.Errorf("failed to build image: %w", err)
+	if appConfig.Image != "" {
+		// Pull the prebuilt image.
+		if err := pullImage(ctx, rt, imageName); err != nil {
+			return fmt.Errorf("failed to pull image: %w", err)
+		}
+		entry.Image = imageName
+	} else {
+		// Build the new image.
+		if err := buildImage(ctx, rt, appConfig.Dockerfile, appConfig.BuildContext, imageName, appConfig.Env); err != nil {
+			return fmt.Errorf("failed to build image: %w", err)
+		}
 	}
+	setHistoryImage(ctx, rt, entry, imageName)
 
-	// Run a new container and obtain its ID and deployment ID.
-	containerID, deploymentID, err := runContainer(imageName, appConfig)
+	r, err := newRollout(ctx, rt, appConfig, imageName)
 	if err != nil {
-		return fmt.Errorf("failed to run new container: %w", err)
+		return err
 	}
-
-	fmt.Printf("Performing health check on container %s...\n", containerID)
-	if err := HealthCheckContainer(containerID, appConfig.HealthCheckPath); err != nil {
-		return fmt.Errorf("new container failed health check: %w", err)
+	entry.DeploymentID = r.deploymentID
+
+	var failedID string
+	if opts.Canary > 0 {
+		r.canary = opts.Canary
+		failedID, err = r.runCanary(ctx)
+	} else {
+		failedID, err = r.run(ctx)
+	}
+	if len(r.started) > 0 {
+		entry.ContainerID = r.started[0]
+	}
+	if failedID != "" {
+		entry.HealthCheck = history.HealthFailed
+	}
+	if err != nil {
+		if len(r.started) > 0 || len(r.retired) > 0 {
+			entry.FailureLog = rollbackFailedDeployment(ctx, rt, r, failedID, err, opts)
+		}
+		return err
 	}
+	entry.HealthCheck = history.HealthPassed
+	deploymentID := r.deploymentID
 
-	// Stop any old containers so that the reverse proxy routes traffic only to the new container.
-	if err := StopOldContainers(appConfig.Name, containerID, deploymentID); err != nil {
-		return fmt.Errorf("failed to stop old containers: %w", err)
+	if opts.Canary > 0 {
+		fmt.Printf("Canary deployment %s of app '%s' is receiving %d%% of the traffic.\n", deploymentID, appConfig.Name, opts.Canary)
+		fmt.Printf("Run 'turkis promote %s' to roll it out or 'turkis abort %s' to remove it.\n", appConfig.Name, appConfig.Name)
+		return nil
 	}
 
 	// Prune old containers based on configuration.
-	if err := PruneOldContainers(appConfig.Name, containerID, appConfig.KeepOldContainers); err != nil {
+	if err := PruneOldContainers(ctx, rt, appConfig.Name, deploymentID, appConfig.KeepOldContainers); err != nil {
 		return fmt.Errorf("failed to prune old containers: %w", err)
 	}
 
 	// Clean up old dangling images
-	if err := PruneOldImages(appConfig.Name); err != nil {
+	if err := PruneOldImages(ctx, rt, appConfig.Name); err != nil {
 		fmt.Printf("Warning: failed to prune old images: %v\n", err)
 		// We don't return the error here as this is a non-critical step
 	}
@@ -54,26 +132,76 @@ func DeployApp(appConfig *config.AppConfig) error {
 	return nil
 }
 
-func buildImage(dockerfile, buildContext, imageName string, buildArgs map[string]string) error {
-	args := []string{"build", "-t", imageName, "-f", dockerfile}
-	for k, v := range buildArgs {
-		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+func buildImage(ctx context.Context, rt Runtime, dockerfile, buildContext, imageName string, buildArgs map[string]string) error {
+	fmt.Printf("Building image '%s'...\n", imageName)
+	return rt.BuildImage(ctx, BuildOptions{
+		Image:        imageName,
+		Dockerfile:   dockerfile,
+		BuildContext: buildContext,
+		BuildArgs:    buildArgs,
+		Output:       os.Stdout,
+	})
+}
+
+func pullImage(ctx context.Context, rt Runtime, imageName string) error {
+	auth, err := registryAuth(imageName)
+	if err != nil {
+		return err
 	}
-	args = append(args, buildContext)
+	fmt.Printf("Pulling image '%s'...\n", imageName)
+	return rt.PullImage(ctx, PullOptions{
+		Image:        imageName,
+		RegistryAuth: auth,
+		Output:       os.Stdout,
+	})
+}
 
-	cmd := exec.Command("docker", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	fmt.Printf("Building image '%s'...\n", imageName)
-	return cmd.Run()
+// ImageWithTag returns image with its tag or digest replaced. tag is either a tag like 1.4.1
+// or a digest like sha256:<hex>.
+func ImageWithTag(image, tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image '%s': %w", image, err)
+	}
+	repository := reference.TrimNamed(named)
+
+	var ref reference.Named
+	if strings.HasPrefix(tag, "sha256:") {
+		d, err := digest.Parse(tag)
+		if err != nil {
+			return "", fmt.Errorf("invalid digest '%s': %w", tag, err)
+		}
+		ref, err = reference.WithDigest(repository, d)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		ref, err = reference.WithTag(repository, tag)
+		if err != nil {
+			return "", fmt.Errorf("invalid tag '%s': %w", tag, err)
+		}
+	}
+	return reference.FamiliarString(ref), nil
+}
+
+// newDeploymentID returns the ID for a new deployment. It doesn't need to be a timestamp,
+// but it needs to be incremented from the previous deployment.
+func newDeploymentID() string {
+	return time.Now().Format("20060102150405")
 }
 
-func runContainer(imageName string, appConfig *config.AppConfig) (string, string, error) {
-	// deploymentID doesn't need to be a timestamp, but it needs to be incremented from the previous deployment.
-	deploymentID := time.Now().Format("20060102150405")
-	containerName := fmt.Sprintf("%s-turkis-%s", appConfig.Name, deploymentID)
+// containerName returns the name of a replica. The first replica has no suffix.
+func containerName(appName, deploymentID string, replica int) string {
+	if replica <= 1 {
+		return fmt.Sprintf("%s-turkis-%s", appName, deploymentID)
+	}
+	return fmt.Sprintf("%s-turkis-%s-%d", appName, deploymentID, replica)
+}
 
-	args := []string{"run", "-d", "--name", containerName, "--restart", "unless-stopped"}
+// runContainer starts a replica of a deployment. canary is the percentage of traffic the
+// deployment gets while it runs next to older deployments, 0 for a regular deployment.
+func runContainer(ctx context.Context, rt Runtime, imageName string, appConfig *config.AppConfig, deploymentID string, replica, canary int) (string, error) {
+	name := containerName(appConfig.Name, deploymentID, replica)
 
 	// Convert AppConfig to ContainerLabels
 	cl := config.ContainerLabels{
@@ -83,49 +211,36 @@ func runContainer(imageName string, appConfig *config.AppConfig) (string, string
 		ACMEEmail:       appConfig.ACMEEmail,
 		Port:            appConfig.Port,
 		HealthCheckPath: appConfig.HealthCheckPath,
+		DrainTime:       appConfig.DrainTime,
+		Canary:          canary,
 		Domains:         appConfig.Domains,
-	}
-	// Add all labels at once by merging maps
-	labels := cl.ToLabels()
-
-	// Convert all labels to docker command arguments
-	for k, v := range labels {
-		args = append(args, "-l", fmt.Sprintf("%s=%s", k, v))
+		TLS:             appConfig.TLS,
+		HTTP:            appConfig.HTTP,
+		Access:          appConfig.Access,
+		MaxConnections:  appConfig.MaxConnections,
 	}
 
-	// Add environment variables.
-	for k, v := range appConfig.Env {
-		args = append(args, "-e", fmt.Sprintf("%s=%s", k, v))
-	}
-
-	// Add volumes.
-	for _, vol := range appConfig.Volumes {
-		args = append(args, "-v", vol)
+	if appConfig.RateLimit != nil {
+		cl.RateLimit = *appConfig.RateLimit
 	}
 
 	// Ensure the network exists before attaching the container
-	ensureNetworkCmd := exec.Command("docker", "network", "inspect", config.DockerNetwork)
-	if err := ensureNetworkCmd.Run(); err != nil {
-		// Network doesn't exist, create it
-		fmt.Printf("Network %s doesn't exist. Creating it...\n", config.DockerNetwork)
-		createNetworkCmd := exec.Command("docker", "network", "create", config.DockerNetwork)
-		if err := createNetworkCmd.Run(); err != nil {
-			return "", "", fmt.Errorf("failed to create network %s: %w", config.DockerNetwork, err)
-		}
+	if err := rt.EnsureNetwork(ctx, config.DockerNetwork); err != nil {
+		return "", err
 	}
 
-	// Attach the container to the network.
-	args = append(args, "--network", config.DockerNetwork)
-
-	// Finally, set the image to run.
-	args = append(args, imageName)
-
-	cmd := exec.Command("docker", args...)
-	out, err := cmd.Output()
+	containerID, err := rt.RunContainer(ctx, RunOptions{
+		Name:          name,
+		Image:         imageName,
+		Labels:        cl.ToLabels(),
+		Env:           appConfig.Env,
+		Volumes:       appConfig.Volumes,
+		Network:       config.DockerNetwork,
+		RestartPolicy: "unless-stopped",
+	})
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-	containerID := strings.TrimSpace(string(out))
-	fmt.Printf("New container started with ID '%s' and name '%s'\n", containerID, containerName)
-	return containerID, deploymentID, nil
+	fmt.Printf("New container started with ID '%s' and name '%s'\n", shortID(containerID), name)
+	return containerID, nil
 }
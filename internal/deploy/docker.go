@@ -0,0 +1,478 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/remote"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+)
+
+// DockerRuntime implements Runtime using the Docker Engine API.
+type DockerRuntime struct {
+	client *client.Client
+}
+
+// NewDockerRuntime connects to the Docker daemon configured in the environment (DOCKER_HOST etc),
+// or to the daemon of the server selected with --host through ssh.
+func NewDockerRuntime() (*DockerRuntime, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host := config.CurrentHost(); host != nil {
+		// The local DOCKER_* settings don't apply. The host name is never resolved, every
+		// connection goes through the dialer.
+		opts = []client.Opt{
+			client.WithAPIVersionNegotiation(),
+			client.WithHost("http://docker.turkis"),
+			client.WithDialContext(remote.DockerDialer(host)),
+		}
+	}
+	dockerClient, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return &DockerRuntime{client: dockerClient}, nil
+}
+
+func (r *DockerRuntime) Close() error {
+	return r.client.Close()
+}
+
+func (r *DockerRuntime) BuildImage(ctx context.Context, opts BuildOptions) error {
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
+
+	buildContext, dockerfile, err := tarBuildContext(opts.BuildContext, opts.Dockerfile)
+	if err != nil {
+		return err
+	}
+	defer buildContext.Close()
+
+	buildArgs := make(map[string]*string, len(opts.BuildArgs))
+	for k, v := range opts.BuildArgs {
+		value := v
+		buildArgs[k] = &value
+	}
+
+	resp, err := r.client.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:       []string{opts.Image},
+		Dockerfile: dockerfile,
+		BuildArgs:  buildArgs,
+		Remove:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start build of image '%s': %w", opts.Image, err)
+	}
+	defer resp.Body.Close()
+
+	fd, isTerminal := term.GetFdInfo(out)
+	if err := jsonmessage.DisplayJSONMessagesStream(resp.Body, out, fd, isTerminal, nil); err != nil {
+		if jsonErr, ok := err.(*jsonmessage.JSONError); ok {
+			return &BuildError{Image: opts.Image, Message: jsonErr.Message}
+		}
+		return fmt.Errorf("failed to read build output for image '%s': %w", opts.Image, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) PullImage(ctx context.Context, opts PullOptions) error {
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
+
+	resp, err := r.client.ImagePull(ctx, opts.Image, types.ImagePullOptions{RegistryAuth: opts.RegistryAuth})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrImageNotFound, opts.Image)
+		}
+		return fmt.Errorf("failed to pull image '%s': %w", opts.Image, err)
+	}
+	defer resp.Close()
+
+	fd, isTerminal := term.GetFdInfo(out)
+	if err := jsonmessage.DisplayJSONMessagesStream(resp, out, fd, isTerminal, nil); err != nil {
+		return fmt.Errorf("failed to pull image '%s': %w", opts.Image, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) InspectImage(ctx context.Context, reference string) (ImageInfo, error) {
+	image, _, err := r.client.ImageInspectWithRaw(ctx, reference)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return ImageInfo{}, fmt.Errorf("%w: %s", ErrImageNotFound, reference)
+		}
+		return ImageInfo{}, fmt.Errorf("failed to inspect image %s: %w", reference, err)
+	}
+	return ImageInfo{ID: image.ID, Tags: image.RepoTags, Digests: image.RepoDigests}, nil
+}
+
+func (r *DockerRuntime) ListImages(ctx context.Context, reference string) ([]ImageInfo, error) {
+	images, err := r.client.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", reference)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images for '%s': %w", reference, err)
+	}
+
+	infos := make([]ImageInfo, 0, len(images))
+	for _, image := range images {
+		infos = append(infos, ImageInfo{ID: image.ID, Tags: image.RepoTags, Digests: image.RepoDigests})
+	}
+	return infos, nil
+}
+
+func (r *DockerRuntime) RemoveImage(ctx context.Context, imageID string) error {
+	_, err := r.client.ImageRemove(ctx, imageID, types.ImageRemoveOptions{PruneChildren: true})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrImageNotFound, imageID)
+		}
+		return fmt.Errorf("failed to remove image %s: %w", imageID, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) PruneDanglingImages(ctx context.Context) error {
+	_, err := r.client.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		return fmt.Errorf("failed to prune dangling images: %w", err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) EnsureNetwork(ctx context.Context, name string) error {
+	_, err := r.client.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect network %s: %w", name, err)
+	}
+
+	fmt.Printf("Network %s doesn't exist. Creating it...\n", name)
+	if _, err := r.client.NetworkCreate(ctx, name, types.NetworkCreate{}); err != nil {
+		return fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) ConnectNetwork(ctx context.Context, networkName, containerID string) error {
+	if err := r.client.NetworkConnect(ctx, networkName, containerID, &network.EndpointSettings{}); err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrNetworkNotFound, networkName)
+		}
+		return fmt.Errorf("failed to connect container %s to network %s: %w", shortID(containerID), networkName, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) DisconnectNetwork(ctx context.Context, networkName, containerID string) error {
+	if err := r.client.NetworkDisconnect(ctx, networkName, containerID, false); err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrNetworkNotFound, networkName)
+		}
+		return fmt.Errorf("failed to disconnect container %s from network %s: %w", shortID(containerID), networkName, err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) RunContainer(ctx context.Context, opts RunOptions) (string, error) {
+	env := make([]string, 0, len(opts.Env))
+	for k, v := range opts.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds: opts.Volumes,
+	}
+	if opts.RestartPolicy != "" {
+		hostConfig.RestartPolicy = container.RestartPolicy{Name: opts.RestartPolicy}
+	}
+
+	networkingConfig := &network.NetworkingConfig{}
+	if opts.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(opts.Network)
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			opts.Network: {},
+		}
+	}
+
+	created, err := r.client.ContainerCreate(ctx, &container.Config{
+		Image:  opts.Image,
+		Env:    env,
+		Labels: opts.Labels,
+	}, hostConfig, networkingConfig, nil, opts.Name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "", fmt.Errorf("%w: %s", ErrImageNotFound, opts.Image)
+		}
+		return "", fmt.Errorf("failed to create container %s: %w", opts.Name, err)
+	}
+
+	if err := r.client.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		// Nothing would remove a container with turkis labels that never ran, even if ctx was
+		// cancelled.
+		if rmErr := r.client.ContainerRemove(context.WithoutCancel(ctx), created.ID, types.ContainerRemoveOptions{Force: true}); rmErr != nil && !client.IsErrNotFound(rmErr) {
+			fmt.Printf("Warning: could not remove container %s: %v\n", opts.Name, rmErr)
+		}
+		return "", fmt.Errorf("failed to start container %s: %w", opts.Name, err)
+	}
+	return created.ID, nil
+}
+
+func (r *DockerRuntime) RunTask(ctx context.Context, opts TaskOptions) (int, error) {
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
+
+	env := make([]string, 0, len(opts.Env))
+	for k, v := range opts.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds: opts.Volumes,
+	}
+	networkingConfig := &network.NetworkingConfig{}
+	if opts.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(opts.Network)
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			opts.Network: {},
+		}
+	}
+
+	withStdin := opts.Stdin != nil
+	created, err := r.client.ContainerCreate(ctx, &container.Config{
+		Image:        opts.Image,
+		Cmd:          opts.Cmd,
+		Env:          env,
+		Labels:       opts.Labels,
+		Tty:          opts.Tty,
+		OpenStdin:    withStdin,
+		StdinOnce:    withStdin,
+		AttachStdin:  withStdin,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, hostConfig, networkingConfig, nil, opts.Name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return 0, fmt.Errorf("%w: %s", ErrImageNotFound, opts.Image)
+		}
+		return 0, fmt.Errorf("failed to create container %s: %w", opts.Name, err)
+	}
+	// Remove the container even if ctx was cancelled, killing it if it still runs.
+	defer func() {
+		err := r.client.ContainerRemove(context.WithoutCancel(ctx), created.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil && !client.IsErrNotFound(err) {
+			fmt.Printf("Warning: could not remove container %s: %v\n", opts.Name, err)
+		}
+	}()
+
+	attach, err := r.client.ContainerAttach(ctx, created.ID, types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  withStdin,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to attach to container %s: %w", opts.Name, err)
+	}
+	defer attach.Close()
+
+	// Wait before starting, so a command that exits right away isn't missed.
+	waitCh, errCh := r.client.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+	copied := make(chan error, 1)
+	go func() {
+		var err error
+		if opts.Tty {
+			// With a TTY stdout and stderr arrive as one raw stream.
+			_, err = io.Copy(out, attach.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(out, out, attach.Reader)
+		}
+		copied <- err
+	}()
+	if withStdin {
+		go func() {
+			io.Copy(attach.Conn, opts.Stdin)
+			attach.CloseWrite()
+		}()
+	}
+
+	stdinFd, stdinIsTerminal := term.GetFdInfo(opts.Stdin)
+	if opts.Tty && stdinIsTerminal {
+		// Keys like Ctrl-C go to the container instead of turkis.
+		state, err := term.SetRawTerminal(stdinFd)
+		if err != nil {
+			return 0, fmt.Errorf("failed to put the terminal into raw mode: %w", err)
+		}
+		defer term.RestoreTerminal(stdinFd, state)
+	}
+
+	if err := r.client.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return 0, fmt.Errorf("failed to start container %s: %w", opts.Name, err)
+	}
+	if opts.Tty && stdinIsTerminal {
+		if size, err := term.GetWinsize(stdinFd); err == nil {
+			r.client.ContainerResize(ctx, created.ID, types.ResizeOptions{Height: uint(size.Height), Width: uint(size.Width)})
+		}
+	}
+
+	select {
+	case result := <-waitCh:
+		if result.Error != nil {
+			return 0, fmt.Errorf("failed to wait for container %s: %s", opts.Name, result.Error.Message)
+		}
+		// The output stream ends when the container exits.
+		if err := <-copied; err != nil {
+			fmt.Printf("Warning: could not read all output of container %s: %v\n", opts.Name, err)
+		}
+		return int(result.StatusCode), nil
+	case err := <-errCh:
+		return 0, fmt.Errorf("failed to wait for container %s: %w", opts.Name, err)
+	}
+}
+
+func (r *DockerRuntime) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error) {
+	filterArgs := filters.NewArgs()
+	if opts.AppName != "" {
+		filterArgs.Add("label", fmt.Sprintf("%s=%s", config.LabelAppName, opts.AppName))
+	}
+
+	containers, err := r.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     opts.All,
+		Filters: filterArgs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	infos := make([]ContainerInfo, 0, len(containers))
+	for _, c := range containers {
+		info := ContainerInfo{
+			ID:           c.ID,
+			Image:        c.Image,
+			ImageID:      c.ImageID,
+			DeploymentID: c.Labels[config.LabelDeploymentID],
+			Labels:       c.Labels,
+			State:        c.State,
+			Running:      c.State == "running",
+			Networks:     make(map[string]string),
+		}
+		if len(c.Names) > 0 {
+			info.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if c.NetworkSettings != nil {
+			for name, endpoint := range c.NetworkSettings.Networks {
+				if endpoint != nil {
+					info.Networks[name] = endpoint.IPAddress
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (r *DockerRuntime) InspectContainer(ctx context.Context, containerID string) (ContainerInfo, error) {
+	c, err := r.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return ContainerInfo{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return ContainerInfo{}, fmt.Errorf("failed to inspect container %s: %w", shortID(containerID), err)
+	}
+
+	info := ContainerInfo{
+		ID:       c.ID,
+		Name:     strings.TrimPrefix(c.Name, "/"),
+		ImageID:  c.Image,
+		Networks: make(map[string]string),
+	}
+	if c.Config != nil {
+		info.Image = c.Config.Image
+		info.Labels = c.Config.Labels
+		info.DeploymentID = c.Config.Labels[config.LabelDeploymentID]
+	}
+	if c.State != nil {
+		info.State = c.State.Status
+		info.Running = c.State.Running
+	}
+	if c.NetworkSettings != nil {
+		for name, endpoint := range c.NetworkSettings.Networks {
+			if endpoint != nil {
+				info.Networks[name] = endpoint.IPAddress
+			}
+		}
+	}
+	return info, nil
+}
+
+func (r *DockerRuntime) StartContainer(ctx context.Context, containerID string) error {
+	if err := r.client.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return fmt.Errorf("failed to start container %s: %w", shortID(containerID), err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) StopContainer(ctx context.Context, containerID string) error {
+	if err := r.client.ContainerStop(ctx, containerID, container.StopOptions{}); err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return fmt.Errorf("failed to stop container %s: %w", shortID(containerID), err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) RemoveContainer(ctx context.Context, containerID string) error {
+	if err := r.client.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{}); err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return fmt.Errorf("failed to remove container %s: %w", shortID(containerID), err)
+	}
+	return nil
+}
+
+func (r *DockerRuntime) ContainerLogs(ctx context.Context, containerID string, tail int) (string, error) {
+	logs, err := r.client.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Tail:       strconv.Itoa(tail),
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "", fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return "", fmt.Errorf("failed to get logs for container %s: %w", shortID(containerID), err)
+	}
+	defer logs.Close()
+
+	// Containers without a TTY multiplex stdout and stderr into one stream.
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, logs); err != nil {
+		return "", fmt.Errorf("failed to read logs for container %s: %w", shortID(containerID), err)
+	}
+	return buf.String(), nil
+}
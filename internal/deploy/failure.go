@@ -0,0 +1,135 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/remote"
+)
+
+// failedLogTail is how many log lines are kept from a failed container.
+const failedLogTail = 500
+
+// rollbackFailedDeployment undoes a rollout that failed. It records the container that
+// failed its health check together with its logs, starts the old containers that were
+// retired again and takes the new containers out of service. failedID is empty when the
+// rollout failed for another reason. It returns the path of the saved logs, or "" if there
+// are none.
+func rollbackFailedDeployment(ctx context.Context, rt Runtime, r *rollout, failedID string, cause error, opts DeployOptions) string {
+	// Clean up even if the deploy was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	appConfig := r.appConfig
+
+	var logPath string
+	if failedID != "" {
+		logs, err := rt.ContainerLogs(ctx, failedID, failedLogTail)
+		if err != nil {
+			fmt.Printf("Warning: could not get logs from failed container %s: %v\n", shortID(failedID), err)
+		}
+		logPath, err = recordFailedDeployment(appConfig.Name, r.deploymentID, failedID, cause, logs)
+		if err != nil {
+			fmt.Printf("Warning: could not record failed deployment: %v\n", err)
+		} else {
+			fmt.Printf("Failed deployment and container logs saved to %s\n", remote.Location(logPath))
+		}
+	}
+
+	// Bring back the old replicas before the new ones go away.
+	var restarted []string
+	for _, c := range r.retired {
+		fmt.Printf("Starting old container %s (deployment: %s) again\n", shortID(c.ID), c.DeploymentID)
+		if err := rt.StartContainer(ctx, c.ID); err != nil {
+			fmt.Printf("Warning: could not start old container %s: %v\n", shortID(c.ID), err)
+			continue
+		}
+		restarted = append(restarted, c.ID)
+		if err := r.cutover.healthCheck(ctx, rt, c.ID, appConfig.Port, appConfig.HealthCheckPath); err != nil {
+			fmt.Printf("Warning: old container %s is not healthy either: %v\n", shortID(c.ID), err)
+		}
+	}
+	// They keep their IDs, which the manager still has as drained.
+	if err := r.cutover.undrain(ctx, appConfig.Name, restarted); err != nil {
+		fmt.Printf("Warning: could not confirm that turkis-manager routes traffic to the old containers again: %v\n", err)
+	}
+
+	if err := r.cutover.drain(ctx, appConfig.Name, r.started, appConfig.DrainTime); err != nil {
+		fmt.Printf("Warning: could not confirm that turkis-manager took the new containers out of service: %v\n", err)
+	}
+
+	for _, id := range r.started {
+		if id == failedID && opts.KeepFailed {
+			// Off the network the manager no longer sees the container, but it can still be inspected.
+			fmt.Printf("Keeping failed container %s for debugging, disconnecting it from %s\n", shortID(id), config.DockerNetwork)
+			if err := rt.DisconnectNetwork(ctx, config.DockerNetwork, id); err != nil {
+				fmt.Printf("Warning: %v. Stopping it instead.\n", err)
+				if err := rt.StopContainer(ctx, id); err != nil {
+					fmt.Printf("Warning: could not stop failed container: %v\n", err)
+				}
+			}
+			continue
+		}
+		fmt.Printf("Removing new container %s\n", shortID(id))
+		if err := rt.StopContainer(ctx, id); err != nil {
+			fmt.Printf("Warning: could not stop container %s: %v\n", shortID(id), err)
+		} else if err := rt.RemoveContainer(ctx, id); err != nil {
+			fmt.Printf("Warning: could not remove container %s: %v\n", shortID(id), err)
+		}
+	}
+
+	previous, err := previousDeployment(ctx, rt, appConfig.Name, r.deploymentID)
+	if err != nil {
+		fmt.Printf("Warning: could not look up the previous deployment: %v\n", err)
+	} else if previous == nil {
+		fmt.Println("No previous deployment is running, nothing to fall back to.")
+	} else {
+		fmt.Printf("Deployment %s is serving traffic again\n", previous.DeploymentID)
+	}
+	return logPath
+}
+
+// previousDeployment returns the newest running container of the app that isn't part of
+// the deployment excludeDeploymentID.
+func previousDeployment(ctx context.Context, rt Runtime, appName, excludeDeploymentID string) (*ContainerInfo, error) {
+	containers, err := rt.ListContainers(ctx, ListOptions{AppName: appName})
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *ContainerInfo
+	for i, c := range containers {
+		if c.DeploymentID == excludeDeploymentID {
+			continue
+		}
+		if previous == nil || c.DeploymentID > previous.DeploymentID {
+			previous = &containers[i]
+		}
+	}
+	return previous, nil
+}
+
+// recordFailedDeployment writes the error and container logs of a failed deployment to
+// ~/.config/turkis/failed-deployments/<app>-<deploymentID>.log and returns the path.
+func recordFailedDeployment(appName, deploymentID, containerID string, cause error, logs string) (string, error) {
+	dir, err := config.FailedDeploymentsPath()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "App: %s\n", appName)
+	fmt.Fprintf(&b, "Deployment ID: %s\n", deploymentID)
+	fmt.Fprintf(&b, "Container ID: %s\n", containerID)
+	fmt.Fprintf(&b, "Failed at: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Error: %v\n", cause)
+	fmt.Fprintf(&b, "\n--- Container logs (last %d lines) ---\n%s", failedLogTail, logs)
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.log", appName, deploymentID))
+	if err := remote.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", remote.Location(path), err)
+	}
+	return path, nil
+}
@@ -0,0 +1,411 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// FakeRuntime is an in-memory Runtime for tests. It never talks to a Docker daemon.
+// Set the *Err fields to make the corresponding operation fail.
+type FakeRuntime struct {
+	mu sync.Mutex
+
+	Containers map[string]*ContainerInfo
+	Images     map[string]*ImageInfo
+	Networks   map[string]bool
+
+	BuildErr error
+	PullErr  error
+	RunErr   error
+	StopErr  error
+
+	// BuildLog is written to BuildOptions.Output on every build.
+	BuildLog string
+	// Logs holds the output returned by ContainerLogs, keyed by container ID.
+	Logs map[string]string
+
+	// Tasks records every RunTask call. TaskOutput is written to TaskOptions.Output and
+	// TaskExitCode is returned, unless TaskErr is set.
+	Tasks        []TaskOptions
+	TaskOutput   string
+	TaskExitCode int
+	TaskErr      error
+
+	nextID int
+	nextIP int
+}
+
+// NewFakeRuntime returns an empty FakeRuntime.
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		Containers: make(map[string]*ContainerInfo),
+		Images:     make(map[string]*ImageInfo),
+		Networks:   make(map[string]bool),
+		Logs:       make(map[string]string),
+	}
+}
+
+func (f *FakeRuntime) newID() string {
+	f.nextID++
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.Itoa(f.nextID))))
+}
+
+func (f *FakeRuntime) Close() error {
+	return nil
+}
+
+func (f *FakeRuntime) BuildImage(ctx context.Context, opts BuildOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.BuildErr != nil {
+		return f.BuildErr
+	}
+	if opts.Output != nil && f.BuildLog != "" {
+		fmt.Fprint(opts.Output, f.BuildLog)
+	}
+
+	// Building moves the tag to the new image, leaving the old one dangling.
+	for _, image := range f.Images {
+		image.Tags = removeString(image.Tags, opts.Image)
+	}
+	id := "sha256:" + f.newID()
+	f.Images[id] = &ImageInfo{ID: id, Tags: []string{opts.Image}}
+	return nil
+}
+
+func (f *FakeRuntime) PullImage(ctx context.Context, opts PullOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.PullErr != nil {
+		return f.PullErr
+	}
+	for _, image := range f.Images {
+		if containsString(image.Tags, opts.Image) || containsString(image.Digests, opts.Image) {
+			return nil
+		}
+	}
+
+	id := f.newID()
+	repository, _, _ := strings.Cut(opts.Image, "@")
+	image := &ImageInfo{ID: "sha256:" + id, Digests: []string{repository + "@sha256:" + id}}
+	if strings.Contains(opts.Image, "@") {
+		image.Digests = []string{opts.Image}
+	} else {
+		image.Tags = []string{opts.Image}
+		if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+			image.Digests = []string{repository[:i] + "@sha256:" + id}
+		}
+	}
+	f.Images[image.ID] = image
+	return nil
+}
+
+func (f *FakeRuntime) InspectImage(ctx context.Context, reference string) (ImageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if image, ok := f.Images[reference]; ok {
+		return *image, nil
+	}
+	for _, image := range f.Images {
+		if containsString(image.Tags, reference) || containsString(image.Digests, reference) {
+			return *image, nil
+		}
+	}
+	return ImageInfo{}, fmt.Errorf("%w: %s", ErrImageNotFound, reference)
+}
+
+func (f *FakeRuntime) ListImages(ctx context.Context, reference string) ([]ImageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var images []ImageInfo
+	for _, image := range f.Images {
+		for _, ref := range slices.Concat(image.Tags, image.Digests) {
+			if ref == reference || strings.HasPrefix(ref, reference+":") || strings.HasPrefix(ref, reference+"@") {
+				images = append(images, *image)
+				break
+			}
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+func (f *FakeRuntime) RemoveImage(ctx context.Context, imageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.Images[imageID]; !ok {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, imageID)
+	}
+	for _, c := range f.Containers {
+		if c.ImageID == imageID {
+			return fmt.Errorf("image %s is in use by container %s", imageID, shortID(c.ID))
+		}
+	}
+	delete(f.Images, imageID)
+	return nil
+}
+
+func (f *FakeRuntime) PruneDanglingImages(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inUse := make(map[string]bool)
+	for _, c := range f.Containers {
+		inUse[c.ImageID] = true
+	}
+	for id, image := range f.Images {
+		if len(image.Tags) == 0 && !inUse[id] {
+			delete(f.Images, id)
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) EnsureNetwork(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Networks[name] = true
+	return nil
+}
+
+func (f *FakeRuntime) ConnectNetwork(ctx context.Context, networkName, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.Networks[networkName] {
+		return fmt.Errorf("%w: %s", ErrNetworkNotFound, networkName)
+	}
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return err
+	}
+	c.Networks[networkName] = f.newIP()
+	return nil
+}
+
+func (f *FakeRuntime) DisconnectNetwork(ctx context.Context, networkName, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.Networks[networkName]; !ok {
+		return fmt.Errorf("container %s is not connected to network %s", shortID(c.ID), networkName)
+	}
+	delete(c.Networks, networkName)
+	return nil
+}
+
+func (f *FakeRuntime) RunContainer(ctx context.Context, opts RunOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.RunErr != nil {
+		return "", f.RunErr
+	}
+
+	imageID := ""
+	for id, image := range f.Images {
+		if containsString(image.Tags, opts.Image) || containsString(image.Digests, opts.Image) {
+			imageID = id
+		}
+	}
+	if imageID == "" {
+		if _, ok := f.Images[opts.Image]; !ok {
+			return "", fmt.Errorf("%w: %s", ErrImageNotFound, opts.Image)
+		}
+		imageID = opts.Image
+	}
+
+	if opts.Network != "" && !f.Networks[opts.Network] {
+		return "", fmt.Errorf("%w: %s", ErrNetworkNotFound, opts.Network)
+	}
+
+	labels := make(map[string]string, len(opts.Labels))
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+
+	id := f.newID()
+	c := &ContainerInfo{
+		ID:           id,
+		Name:         opts.Name,
+		Image:        opts.Image,
+		ImageID:      imageID,
+		DeploymentID: labels[config.LabelDeploymentID],
+		Labels:       labels,
+		State:        "running",
+		Running:      true,
+		Networks:     make(map[string]string),
+	}
+	if opts.Network != "" {
+		c.Networks[opts.Network] = f.newIP()
+	}
+	f.Containers[id] = c
+	return id, nil
+}
+
+func (f *FakeRuntime) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var containers []ContainerInfo
+	for _, c := range f.Containers {
+		if opts.AppName != "" && c.Labels[config.LabelAppName] != opts.AppName {
+			continue
+		}
+		if !opts.All && !c.Running {
+			continue
+		}
+		containers = append(containers, *c)
+	}
+	// Newest first, like docker ps.
+	sort.Slice(containers, func(i, j int) bool { return containers[i].DeploymentID > containers[j].DeploymentID })
+	return containers, nil
+}
+
+func (f *FakeRuntime) InspectContainer(ctx context.Context, containerID string) (ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	return *c, nil
+}
+
+func (f *FakeRuntime) StartContainer(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return err
+	}
+	c.State = "running"
+	c.Running = true
+	return nil
+}
+
+func (f *FakeRuntime) StopContainer(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.StopErr != nil {
+		return f.StopErr
+	}
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return err
+	}
+	c.State = "exited"
+	c.Running = false
+	return nil
+}
+
+func (f *FakeRuntime) RemoveContainer(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return err
+	}
+	if c.Running {
+		return fmt.Errorf("cannot remove running container %s", shortID(c.ID))
+	}
+	delete(f.Containers, c.ID)
+	return nil
+}
+
+func (f *FakeRuntime) RunTask(ctx context.Context, opts TaskOptions) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Tasks = append(f.Tasks, opts)
+	if f.TaskErr != nil {
+		return 0, f.TaskErr
+	}
+	if opts.Network != "" && !f.Networks[opts.Network] {
+		return 0, fmt.Errorf("%w: %s", ErrNetworkNotFound, opts.Network)
+	}
+	if opts.Output != nil {
+		if _, err := io.WriteString(opts.Output, f.TaskOutput); err != nil {
+			return 0, err
+		}
+	}
+	return f.TaskExitCode, nil
+}
+
+func (f *FakeRuntime) ContainerLogs(ctx context.Context, containerID string, tail int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.lookup(containerID)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.SplitAfter(f.Logs[c.ID], "\n")
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// lookup finds a container by full ID, ID prefix or name. Callers must hold f.mu.
+func (f *FakeRuntime) lookup(containerID string) (*ContainerInfo, error) {
+	if c, ok := f.Containers[containerID]; ok {
+		return c, nil
+	}
+	for _, c := range f.Containers {
+		if c.Name == containerID || (containerID != "" && strings.HasPrefix(c.ID, containerID)) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+}
+
+func (f *FakeRuntime) newIP() string {
+	f.nextIP++
+	return fmt.Sprintf("172.20.%d.%d", (f.nextIP/254)%256, f.nextIP%254+1)
+}
+
+func removeString(values []string, s string) []string {
+	result := values[:0]
+	for _, v := range values {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
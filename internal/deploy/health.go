@@ -1,64 +1,51 @@
 package deploy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/ameistad/turkis/internal/config"
 )
 
-// HealthCheckContainer performs an HTTP health check on the specified container.
-// TODO: this function is not very robust and should be improved.
-// consider using docker client library instead of exec.Command
-// consider using a more robust health check mechanism
-// consider using a more robust way to get the container's IP address and extract it to a separate function.
-// consider using a more robust way to connect the container to the network and extract it to a separate function.
-// consider using a more robust way to get the health check path and extract it to a separate function.
-func HealthCheckContainer(containerID, healthCheckPath string) error {
+// HealthCheckContainer performs an HTTP health check on the specified container, on the port
+// the app serves HTTP on.
+// TODO: consider using a more robust health check mechanism.
+func HealthCheckContainer(ctx context.Context, rt Runtime, containerID, port, healthCheckPath string) error {
 	// First try to get the container's IP address on turkis-public network
-	cmd := exec.Command("docker", "inspect",
-		"--format", "{{.NetworkSettings.Networks.turkis-public.IPAddress}}",
-		containerID)
-
-	output, err := cmd.CombinedOutput() // Use CombinedOutput to get error messages too
+	ipAddress, err := ContainerIP(ctx, rt, containerID, config.DockerNetwork)
 	if err != nil {
+		if errors.Is(err, ErrContainerNotFound) {
+			return err
+		}
 		// If that fails, try to connect the container to the turkis-public network
-		fmt.Printf("Warning: Container not connected to turkis-public network. Trying to connect it...\n")
-		connectCmd := exec.Command("docker", "network", "connect", "turkis-public", containerID)
-		if connectErr := connectCmd.Run(); connectErr != nil {
-			return fmt.Errorf("failed to connect container to turkis-public network: %w", connectErr)
+		fmt.Printf("Warning: Container not connected to %s network. Trying to connect it...\n", config.DockerNetwork)
+		if connectErr := rt.ConnectNetwork(ctx, config.DockerNetwork, containerID); connectErr != nil {
+			return fmt.Errorf("failed to connect container to %s network: %w", config.DockerNetwork, connectErr)
 		}
 
 		// Try again after connecting
-		cmd = exec.Command("docker", "inspect",
-			"--format", "{{.NetworkSettings.Networks.turkis-public.IPAddress}}",
-			containerID)
-		output, err = cmd.Output()
+		ipAddress, err = ContainerIP(ctx, rt, containerID, config.DockerNetwork)
 		if err != nil {
 			return fmt.Errorf("failed to get container IP after connecting to network: %w", err)
 		}
 	}
 
-	ipAddress := strings.TrimSpace(string(output))
-	if ipAddress == "" {
-		// If IP is still empty, try to inspect the container to see all network settings
-		inspectCmd := exec.Command("docker", "inspect", "--format", "{{json .NetworkSettings.Networks}}", containerID)
-		inspectOutput, inspectErr := inspectCmd.Output()
-		if inspectErr == nil {
-			fmt.Printf("Available networks for container: %s\n", string(inspectOutput))
-		}
-
-		return fmt.Errorf("container has no IP address on turkis-public network")
-	}
-
 	// Ensure health check path starts with '/'
 	if !strings.HasPrefix(healthCheckPath, "/") {
 		healthCheckPath = "/" + healthCheckPath
 	}
 
+	if port == "" {
+		port = config.DefaultContainerPort
+	}
+
 	// Construct health check URL
-	healthURL := fmt.Sprintf("http://%s:80%s", ipAddress, healthCheckPath)
+	healthURL := fmt.Sprintf("http://%s%s", net.JoinHostPort(ipAddress, port), healthCheckPath)
 
 	client := &http.Client{
 		Timeout: 5 * time.Second,
@@ -71,10 +58,21 @@ func HealthCheckContainer(containerID, healthCheckPath string) error {
 	fmt.Printf("Performing health checks against %s\n", healthURL)
 
 	for i := 0; i < maxRetries; i++ {
-		resp, err := client.Get(healthURL)
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryInterval):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+		if err != nil {
+			return fmt.Errorf("invalid health check URL %s: %w", healthURL, err)
+		}
+		resp, err := client.Do(req)
 		if err != nil {
 			fmt.Printf("Health check attempt %d: Connection error: %v\n", i+1, err)
-			time.Sleep(retryInterval)
 			continue
 		}
 
@@ -86,7 +84,6 @@ func HealthCheckContainer(containerID, healthCheckPath string) error {
 		}
 
 		fmt.Printf("Health check attempt %d: Received status code %d\n", i+1, resp.StatusCode)
-		time.Sleep(retryInterval)
 	}
 
 	return fmt.Errorf("health check failed after %d attempts", maxRetries)
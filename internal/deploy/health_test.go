@@ -0,0 +1,41 @@
+package deploy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+func TestHealthCheckContainerPort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	rt := NewFakeRuntime()
+	runTestDeployments(t, rt, []testDeployment{{id: "20240101000000", running: true}})
+	containers, _ := rt.ListContainers(ctx, ListOptions{AppName: "app"})
+	id := containers[0].ID
+	// The app listens on the test server's port
+	rt.Containers[id].Networks[config.DockerNetwork] = host
+
+	if err := HealthCheckContainer(ctx, rt, id, port, "/health"); err != nil {
+		t.Errorf("health check on port %s: %v", port, err)
+	}
+}
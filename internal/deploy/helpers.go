@@ -1,23 +1,46 @@
 package deploy
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
-	"strings"
 )
 
-// getContainerIP wraps the docker inspect call to retrieve a container's IP on a given network.
-func GetContainerIP(containerID, networkName string) (string, error) {
-	cmd := exec.Command("docker", "inspect", "--format",
-		fmt.Sprintf("{{(index .NetworkSettings.Networks \"%s\").IPAddress}}", networkName),
-		containerID)
-	out, err := cmd.Output()
+// ContainerIP returns a container's IP address on the given network.
+func ContainerIP(ctx context.Context, rt Runtime, containerID, networkName string) (string, error) {
+	info, err := rt.InspectContainer(ctx, containerID)
 	if err != nil {
 		return "", fmt.Errorf("failed to get container IP: %w", err)
 	}
-	ip := strings.TrimSpace(string(out))
-	if ip == "" {
-		return "", fmt.Errorf("no IP address found for container %s on network %s", containerID, networkName)
+	ip, ok := info.Networks[networkName]
+	if !ok || ip == "" {
+		return "", fmt.Errorf("no IP address found for container %s on network %s", shortID(containerID), networkName)
 	}
 	return ip, nil
 }
+
+// shortID truncates a container or image ID the way the docker CLI displays it.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Helper function to check if a string contains only digits
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/history"
+)
+
+// newHistoryEntry starts a history entry for a deploy or rollback of the app.
+func newHistoryEntry(action string, appConfig *config.AppConfig) *history.Entry {
+	entry := &history.Entry{
+		App:         appConfig.Name,
+		Action:      action,
+		User:        currentUser(),
+		StartedAt:   time.Now(),
+		HealthCheck: history.HealthSkipped,
+		GitCommit:   gitCommit(appConfig.BuildContext),
+	}
+	if hash, err := appConfig.Hash(); err == nil {
+		entry.ConfigHash = hash
+	}
+	return entry
+}
+
+// setHistoryImage fills in the image ID and, for images from a registry, the digest.
+func setHistoryImage(ctx context.Context, rt Runtime, entry *history.Entry, imageRef string) {
+	image, err := rt.InspectImage(ctx, imageRef)
+	if err != nil {
+		return
+	}
+	entry.ImageID = image.ID
+	if len(image.Digests) > 0 {
+		entry.ImageDigest = image.Digests[0]
+	}
+}
+
+// finishHistoryEntry sets the outcome and duration and appends the entry to the journal.
+// Failing to write history never fails the deploy.
+func finishHistoryEntry(entry *history.Entry, err error) {
+	entry.DurationMS = time.Since(entry.StartedAt).Milliseconds()
+	if err != nil {
+		entry.Outcome = history.OutcomeFailed
+		entry.Error = err.Error()
+	} else {
+		entry.Outcome = history.OutcomeSucceeded
+	}
+
+	path, pathErr := config.HistoryFilePath()
+	if pathErr != nil {
+		fmt.Printf("Warning: could not record deployment history: %v\n", pathErr)
+		return
+	}
+	if err := history.Append(path, *entry); err != nil {
+		fmt.Printf("Warning: could not record deployment history: %v\n", err)
+	}
+}
+
+// gitCommit returns the commit checked out in dir, with a "-dirty" suffix if there are
+// uncommitted changes. It returns "" if dir isn't a git work tree or git isn't installed.
+func gitCommit(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	commit := strings.TrimSpace(string(out))
+
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err == nil && len(strings.TrimSpace(string(status))) > 0 {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
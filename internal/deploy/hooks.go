@@ -0,0 +1,44 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+const (
+	hookPreDeploy  = "preDeploy"
+	hookPostDeploy = "postDeploy"
+)
+
+// runHook runs a deploy hook in a one-off container from the image of the deployment, with the
+// app's env, volumes and network. Its output is streamed to stdout. A hook that exits with a
+// non-zero code fails the deploy.
+func runHook(ctx context.Context, rt Runtime, appConfig *config.AppConfig, imageName, deploymentID, hook string, cmd config.Command) error {
+	if len(cmd) == 0 {
+		return nil
+	}
+
+	if err := rt.EnsureNetwork(ctx, config.DockerNetwork); err != nil {
+		return err
+	}
+
+	fmt.Printf("Running %s hook: %s\n", hook, strings.Join(cmd, " "))
+	name := fmt.Sprintf("%s-turkis-%s-%s", appConfig.Name, deploymentID, strings.ToLower(hook))
+	exitCode, err := rt.RunTask(ctx, taskOptions(appConfig, name, imageName, cmd))
+	if err != nil {
+		return fmt.Errorf("failed to run %s hook: %w", hook, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%s hook exited with code %d", hook, exitCode)
+	}
+	fmt.Printf("The %s hook finished successfully\n", hook)
+	return nil
+}
+
+// hook runs a deploy hook for the deployment being rolled out.
+func (r *rollout) hook(ctx context.Context, hook string, cmd config.Command) error {
+	return runHook(ctx, r.rt, r.appConfig, r.imageName, r.deploymentID, hook, cmd)
+}
@@ -0,0 +1,163 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// dockerHubServer is the key the Docker CLI stores Docker Hub credentials under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the part of the Docker CLI config.json that holds registry credentials.
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// registryAuth returns the encoded credentials for the registry that hosts image, as stored by
+// `docker login` in ~/.docker/config.json (or $DOCKER_CONFIG/config.json). Credential helpers
+// and credsStore are supported. It returns "" when there are no credentials for the registry.
+func registryAuth(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference '%s': %w", image, err)
+	}
+	server := reference.Domain(named)
+	if server == "docker.io" {
+		server = dockerHubServer
+	}
+
+	conf, err := loadDockerConfig()
+	if err != nil || conf == nil {
+		return "", err
+	}
+
+	var authConfig *registry.AuthConfig
+	helper := conf.CredsStore
+	if h, ok := conf.CredHelpers[reference.Domain(named)]; ok {
+		helper = h
+	}
+	if helper != "" {
+		authConfig, err = credentialsFromHelper(helper, server)
+		if err != nil {
+			return "", err
+		}
+	}
+	if authConfig == nil {
+		authConfig, err = credentialsFromAuths(conf.Auths, server)
+		if err != nil {
+			return "", err
+		}
+	}
+	if authConfig == nil {
+		return "", nil
+	}
+	authConfig.ServerAddress = server
+	return registry.EncodeAuthConfig(*authConfig)
+}
+
+func loadDockerConfig() (*dockerConfigFile, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	path := filepath.Join(dir, "config.json")
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read Docker config '%s': %w", path, err)
+	}
+	var conf dockerConfigFile
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse Docker config '%s': %w", path, err)
+	}
+	return &conf, nil
+}
+
+// credentialsFromHelper asks docker-credential-<helper> for the credentials of server.
+func credentialsFromHelper(helper, server string) (*registry.AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers print this when they have nothing stored for the server.
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper docker-credential-%s failed: %w", helper, err)
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("invalid output from docker-credential-%s: %w", helper, err)
+	}
+	// Helpers return identity tokens with this placeholder as the username.
+	if creds.Username == "<token>" {
+		return &registry.AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return &registry.AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// credentialsFromAuths looks server up in the auths section, where keys may be bare
+// hostnames or URLs.
+func credentialsFromAuths(auths map[string]dockerAuthEntry, server string) (*registry.AuthConfig, error) {
+	host := registryHost(server)
+	for key, entry := range auths {
+		if registryHost(key) != host {
+			continue
+		}
+		authConfig := &registry.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for registry %s in Docker config: %w", key, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for registry %s in Docker config", key)
+			}
+			authConfig.Username = username
+			authConfig.Password = password
+		}
+		return authConfig, nil
+	}
+	return nil, nil
+}
+
+func registryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	return host
+}
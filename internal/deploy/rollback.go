@@ -1,62 +1,99 @@
 package deploy
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
-	"strings"
+	"sort"
 
 	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/history"
 )
 
-func RollbackToContainer(currentContainerID, targetContainerID string, healthCheckPath string) error {
-	fmt.Printf("Starting target container: %s\n", targetContainerID)
-	if err := exec.Command("docker", "start", targetContainerID).Run(); err != nil {
-		return fmt.Errorf("failed to start target container %s: %w", targetContainerID, err)
+// RollbackToContainer makes the deployment of the target container the live one. It starts
+// all replicas of that deployment, checks their health, then drains and stops the containers
+// of every other deployment. The rollback is recorded in the deployment history.
+func RollbackToContainer(ctx context.Context, rt Runtime, appConfig *config.AppConfig, target ContainerInfo) (err error) {
+	entry := newHistoryEntry(history.ActionRollback, appConfig)
+	entry.DeploymentID = target.DeploymentID
+	entry.ContainerID = target.ID
+	if appConfig.Image != "" {
+		entry.Image = target.Image
 	}
+	// The target was built from an earlier checkout, so the current commit doesn't apply.
+	entry.GitCommit = ""
+	setHistoryImage(ctx, rt, entry, target.ImageID)
+	defer func() { finishHistoryEntry(entry, err) }()
 
-	// check health of target container with HealthCheckContainer
-	if err := HealthCheckContainer(targetContainerID, healthCheckPath); err != nil {
-		return fmt.Errorf("target container %s is not healthy: %w", targetContainerID, err)
+	containers, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name, All: true})
+	if err != nil {
+		return err
+	}
+
+	var targets, current []ContainerInfo
+	for _, c := range containers {
+		if c.DeploymentID == target.DeploymentID {
+			targets = append(targets, c)
+		} else if c.Running {
+			current = append(current, c)
+		}
+	}
+
+	for _, c := range targets {
+		if !c.Running {
+			fmt.Printf("Starting target container: %s\n", shortID(c.ID))
+			if err := rt.StartContainer(ctx, c.ID); err != nil {
+				return fmt.Errorf("failed to start target container %s: %w", shortID(c.ID), err)
+			}
+		}
+		// check health of target container with HealthCheckContainer
+		if err := HealthCheckContainer(ctx, rt, c.ID, appConfig.Port, appConfig.HealthCheckPath); err != nil {
+			entry.HealthCheck = history.HealthFailed
+			return fmt.Errorf("target container %s is not healthy: %w", shortID(c.ID), err)
+		}
 	}
+	entry.HealthCheck = history.HealthPassed
 
-	fmt.Printf("Stopping current container: %s\n", currentContainerID)
-	if err := exec.Command("docker", "stop", currentContainerID).Run(); err != nil {
-		return fmt.Errorf("failed to stop current container %s: %w", currentContainerID, err)
+	// The manager may still have the target containers as drained from when they were retired.
+	targetIDs := make([]string, 0, len(targets))
+	for _, c := range targets {
+		targetIDs = append(targetIDs, c.ID)
+	}
+	if err := UndrainContainers(ctx, appConfig.Name, targetIDs); err != nil {
+		return fmt.Errorf("failed to put the target containers back into service: %w", err)
+	}
+
+	ids := make([]string, 0, len(current))
+	for _, c := range current {
+		ids = append(ids, c.ID)
+	}
+	if err := DrainContainers(ctx, appConfig.Name, ids, appConfig.DrainTime); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("Warning: could not confirm that the current containers were drained: %v. Stopping them anyway.\n", err)
+	}
+	for _, c := range current {
+		fmt.Printf("Stopping current container: %s\n", shortID(c.ID))
+		if err := rt.StopContainer(ctx, c.ID); err != nil {
+			return fmt.Errorf("failed to stop current container %s: %w", shortID(c.ID), err)
+		}
 	}
 
 	return nil
 }
 
-func SortedContainerInfo(appConfig *config.AppConfig) ([]ContainerInfo, error) {
-	out, err := exec.Command("docker", "ps", "-a",
-		"--filter", fmt.Sprintf("label=turkis.appName=%s", appConfig.Name),
-		"--format", "{{.ID}}").Output()
+// SortedContainerInfo returns all containers for the app, newest deployment first.
+func SortedContainerInfo(ctx context.Context, rt Runtime, appConfig *config.AppConfig) ([]ContainerInfo, error) {
+	containers, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name, All: true})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list containers: %w", err)
+		return nil, err
 	}
-	ids := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if len(ids) < 2 {
+	if len(containers) < 2 {
 		return nil, fmt.Errorf("no previous container found to rollback to")
 	}
 
-	var containers []ContainerInfo
-
-	// Inspect each container for its deployment timestamp.
-	for _, id := range ids {
-		if id == "" {
-			continue
-		}
-		labelOut, err := exec.Command("docker", "inspect",
-			"--format", "{{ index .Config.Labels \"turkis.deployment\" }}", id).Output()
-		if err != nil {
-			fmt.Printf("Error inspecting container %s: %v\n", id, err)
-			continue
-		}
-		deploymentLabel := strings.TrimSpace(string(labelOut))
-		containers = append(containers, ContainerInfo{
-			ID:           id,
-			DeploymentID: deploymentLabel,
-		})
-	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].DeploymentID > containers[j].DeploymentID
+	})
 	return containers, nil
 }
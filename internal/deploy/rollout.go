@@ -0,0 +1,158 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// cutover is how a rollout checks new containers and moves traffic between containers. The
+// real one needs the containers' network and turkis-manager, so tests replace it.
+type cutover struct {
+	healthCheck func(ctx context.Context, rt Runtime, containerID, port, healthCheckPath string) error
+	drain       func(ctx context.Context, appName string, containerIDs []string, drainTime int) error
+	undrain     func(ctx context.Context, appName string, containerIDs []string) error
+}
+
+// managerCutover health checks containers over HTTP and asks turkis-manager to move traffic.
+var managerCutover = cutover{
+	healthCheck: HealthCheckContainer,
+	drain:       DrainContainers,
+	undrain:     UndrainContainers,
+}
+
+// rollout replaces the running containers of an app with the replicas of a new deployment,
+// a batch at a time. Every new replica passes its health check before an old one is drained.
+type rollout struct {
+	rt           Runtime
+	appConfig    *config.AppConfig
+	imageName    string
+	deploymentID string
+	// canary is the percentage of traffic for a canary deployment, 0 for a regular rollout.
+	canary  int
+	cutover cutover
+
+	// old are the containers of earlier deployments that are still serving, oldest first.
+	old []ContainerInfo
+	// retired are old containers that were drained and stopped during the rollout.
+	retired []ContainerInfo
+	// started are the containers of the new deployment.
+	started []string
+}
+
+func newRollout(ctx context.Context, rt Runtime, appConfig *config.AppConfig, imageName string) (*rollout, error) {
+	old, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running containers: %w", err)
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].DeploymentID < old[j].DeploymentID })
+
+	return &rollout{
+		rt:           rt,
+		appConfig:    appConfig,
+		imageName:    imageName,
+		deploymentID: newDeploymentID(),
+		cutover:      managerCutover,
+		old:          old,
+	}, nil
+}
+
+// run starts the new replicas in batches of at most maxSurge above the desired count, taking
+// up to maxUnavailable old replicas out first when there is no room to surge. The preDeploy
+// hook runs before the first replica starts and the postDeploy hook before the last old
+// replicas are stopped. When a new replica fails its health check, run stops and returns its
+// ID with the error.
+func (r *rollout) run(ctx context.Context) (string, error) {
+	if err := r.hook(ctx, hookPreDeploy, r.appConfig.Hooks.PreDeploy); err != nil {
+		return "", err
+	}
+
+	replicas := r.appConfig.Replicas
+	for len(r.started) < replicas {
+		// Old replicas the new ones have made redundant can go.
+		if excess := len(r.old) + len(r.started) - replicas; excess > 0 {
+			if err := r.retire(ctx, excess); err != nil {
+				return "", err
+			}
+		}
+
+		room := replicas + r.appConfig.MaxSurge - len(r.old) - len(r.started)
+		if room <= 0 {
+			if err := r.retire(ctx, r.appConfig.MaxUnavailable); err != nil {
+				return "", err
+			}
+			room = replicas + r.appConfig.MaxSurge - len(r.old) - len(r.started)
+		}
+		batch := min(room, replicas-len(r.started))
+
+		if failedID, err := r.start(ctx, batch); err != nil {
+			return failedID, err
+		}
+		if replicas > 1 {
+			fmt.Printf("%d of %d replicas of deployment %s are healthy\n", len(r.started), replicas, r.deploymentID)
+		}
+	}
+
+	if err := r.hook(ctx, hookPostDeploy, r.appConfig.Hooks.PostDeploy); err != nil {
+		return "", err
+	}
+
+	// Everything left over belongs to an earlier deployment.
+	return "", r.retire(ctx, len(r.old))
+}
+
+// start runs n more replicas of the new deployment and health checks them. When one fails its
+// health check, start returns its ID with the error.
+func (r *rollout) start(ctx context.Context, n int) (string, error) {
+	var ids []string
+	for i := 0; i < n; i++ {
+		id, err := runContainer(ctx, r.rt, r.imageName, r.appConfig, r.deploymentID, len(r.started)+1, r.canary)
+		if err != nil {
+			return "", fmt.Errorf("failed to run new container: %w", err)
+		}
+		r.started = append(r.started, id)
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		fmt.Printf("Performing health check on container %s...\n", shortID(id))
+		if err := r.cutover.healthCheck(ctx, r.rt, id, r.appConfig.Port, r.appConfig.HealthCheckPath); err != nil {
+			return id, fmt.Errorf("new container failed health check: %w", err)
+		}
+	}
+	return "", nil
+}
+
+// retire drains the n oldest old containers through turkis-manager and stops them. They are
+// kept, so they can be started again if the rollout fails or for a rollback.
+func (r *rollout) retire(ctx context.Context, n int) error {
+	n = min(n, len(r.old))
+	if n == 0 {
+		return nil
+	}
+	containers := r.old[:n]
+
+	ids := make([]string, 0, n)
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	fmt.Printf("Draining %d old container(s)...\n", n)
+	if err := r.cutover.drain(ctx, r.appConfig.Name, ids, r.appConfig.DrainTime); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("Warning: could not confirm that old containers were drained: %v. Stopping them anyway.\n", err)
+	}
+
+	for _, c := range containers {
+		fmt.Printf("Stopping old container: %s (deployment: %s)\n", shortID(c.ID), c.DeploymentID)
+		if err := r.rt.StopContainer(ctx, c.ID); err != nil {
+			fmt.Printf("Error stopping container %s: %v\n", shortID(c.ID), err)
+		}
+	}
+	r.retired = append(r.retired, containers...)
+	r.old = r.old[n:]
+	return nil
+}
@@ -0,0 +1,249 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// fakeCutover stands in for the health checks and turkis-manager. It fails the failOn-th
+// health check and keeps track of how many replicas run and serve while a rollout is going on.
+type fakeCutover struct {
+	rt      *FakeRuntime
+	appName string
+	failOn  int
+
+	checks    int
+	healthy   map[string]bool
+	drained   map[string]bool
+	undrained []string
+
+	maxRunning int
+	minServing int
+}
+
+func newFakeCutover(rt *FakeRuntime, appName string, failOn int) *fakeCutover {
+	f := &fakeCutover{rt: rt, appName: appName, failOn: failOn, healthy: make(map[string]bool), drained: make(map[string]bool)}
+	for _, c := range f.running() {
+		f.healthy[c.ID] = true
+	}
+	f.minServing = f.serving()
+	return f
+}
+
+func (f *fakeCutover) cutover() cutover {
+	return cutover{healthCheck: f.healthCheck, drain: f.drain, undrain: f.undrain}
+}
+
+func (f *fakeCutover) healthCheck(ctx context.Context, rt Runtime, containerID, port, healthCheckPath string) error {
+	f.checks++
+	f.maxRunning = max(f.maxRunning, len(f.running()))
+	if f.checks == f.failOn {
+		return errors.New("connection refused")
+	}
+	f.healthy[containerID] = true
+	return nil
+}
+
+func (f *fakeCutover) drain(ctx context.Context, appName string, containerIDs []string, drainTime int) error {
+	for _, id := range containerIDs {
+		f.drained[id] = true
+	}
+	f.minServing = min(f.minServing, f.serving())
+	return nil
+}
+
+func (f *fakeCutover) undrain(ctx context.Context, appName string, containerIDs []string) error {
+	for _, id := range containerIDs {
+		delete(f.drained, id)
+	}
+	f.undrained = append(f.undrained, containerIDs...)
+	return nil
+}
+
+func (f *fakeCutover) running() []ContainerInfo {
+	containers, _ := f.rt.ListContainers(context.Background(), ListOptions{AppName: f.appName})
+	return containers
+}
+
+// serving counts the running replicas that passed their health check and aren't drained.
+func (f *fakeCutover) serving() int {
+	n := 0
+	for _, c := range f.running() {
+		if f.healthy[c.ID] && !f.drained[c.ID] {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestRollout returns a rollout of app:latest that replaces the running replicas of
+// oldReplicas earlier deployments.
+func newTestRollout(t *testing.T, rt *FakeRuntime, appConfig *config.AppConfig, oldReplicas int) *rollout {
+	t.Helper()
+	ctx := context.Background()
+	if err := rt.BuildImage(ctx, BuildOptions{Image: appConfig.Name + ":latest"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range oldReplicas {
+		if _, err := runContainer(ctx, rt, appConfig.Name+":latest", appConfig, "20240101000000", i+1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := newRollout(ctx, rt, appConfig, appConfig.Name+":latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRolloutRun(t *testing.T) {
+	tests := []struct {
+		name           string
+		replicas       int
+		maxSurge       int
+		maxUnavailable int
+		old            int
+	}{
+		{name: "single replica", replicas: 1, maxSurge: 1, old: 1},
+		{name: "surge one at a time", replicas: 3, maxSurge: 1, old: 3},
+		{name: "no surge", replicas: 3, maxUnavailable: 1, old: 3},
+		{name: "surge and unavailable", replicas: 4, maxSurge: 2, maxUnavailable: 1, old: 4},
+		{name: "first deploy", replicas: 2, maxSurge: 1},
+		{name: "scale down", replicas: 2, maxSurge: 1, old: 3},
+		{name: "scale up", replicas: 3, maxSurge: 1, old: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := NewFakeRuntime()
+			appConfig := &config.AppConfig{Name: "app", Replicas: tt.replicas, MaxSurge: tt.maxSurge, MaxUnavailable: tt.maxUnavailable}
+			r := newTestRollout(t, rt, appConfig, tt.old)
+			fake := newFakeCutover(rt, "app", 0)
+			r.cutover = fake.cutover()
+
+			if failedID, err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() = %q, %v", failedID, err)
+			}
+
+			if len(r.started) != tt.replicas {
+				t.Errorf("started %d replicas, want %d", len(r.started), tt.replicas)
+			}
+			if len(r.retired) != tt.old {
+				t.Errorf("retired %d old replicas, want %d", len(r.retired), tt.old)
+			}
+			for _, c := range fake.running() {
+				if c.DeploymentID != r.deploymentID {
+					t.Errorf("old container %s is still running", shortID(c.ID))
+				}
+			}
+			if limit := max(tt.old, tt.replicas+tt.maxSurge); fake.maxRunning > limit {
+				t.Errorf("%d replicas ran at once, want at most %d", fake.maxRunning, limit)
+			}
+			if limit := min(tt.old, tt.replicas) - tt.maxUnavailable; fake.minServing < limit {
+				t.Errorf("only %d replicas served at one point, want at least %d", fake.minServing, limit)
+			}
+		})
+	}
+}
+
+func TestRollbackFailedDeployment(t *testing.T) {
+	tests := []struct {
+		name           string
+		replicas       int
+		maxSurge       int
+		maxUnavailable int
+		// failOn is the health check that fails
+		failOn     int
+		keepFailed bool
+		// wantRetired is how many old replicas were stopped before the failure
+		wantRetired int
+	}{
+		{name: "first replica fails", replicas: 2, maxSurge: 1, failOn: 1},
+		{name: "later replica fails", replicas: 3, maxSurge: 1, failOn: 2, wantRetired: 1},
+		{name: "no surge", replicas: 2, maxUnavailable: 1, failOn: 1, wantRetired: 1},
+		{name: "keep failed", replicas: 3, maxSurge: 1, failOn: 3, keepFailed: true, wantRetired: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TURKIS_CONFIG_PATH", t.TempDir())
+			ctx := context.Background()
+			rt := NewFakeRuntime()
+			appConfig := &config.AppConfig{Name: "app", Replicas: tt.replicas, MaxSurge: tt.maxSurge, MaxUnavailable: tt.maxUnavailable}
+			r := newTestRollout(t, rt, appConfig, tt.replicas)
+			fake := newFakeCutover(rt, "app", tt.failOn)
+			r.cutover = fake.cutover()
+
+			failedID, err := r.run(ctx)
+			if err == nil || failedID == "" {
+				t.Fatalf("run() = %q, %v, want a failed container", failedID, err)
+			}
+			if len(r.retired) != tt.wantRetired {
+				t.Fatalf("retired %d old replicas before the failure, want %d", len(r.retired), tt.wantRetired)
+			}
+
+			logPath := rollbackFailedDeployment(ctx, rt, r, failedID, err, DeployOptions{KeepFailed: tt.keepFailed})
+			if _, err := os.Stat(logPath); err != nil {
+				t.Errorf("failure log: %v", err)
+			}
+
+			var old []string
+			for _, c := range fake.running() {
+				if c.DeploymentID == r.deploymentID && c.ID != failedID {
+					t.Errorf("new container %s is still running", shortID(c.ID))
+				}
+				if c.DeploymentID != r.deploymentID {
+					old = append(old, c.ID)
+					if fake.drained[c.ID] {
+						t.Errorf("old container %s is still drained", shortID(c.ID))
+					}
+				}
+			}
+			if len(old) != tt.replicas {
+				t.Errorf("%d old replicas are running, want %d", len(old), tt.replicas)
+			}
+			for _, c := range r.retired {
+				if !slices.Contains(fake.undrained, c.ID) {
+					t.Errorf("restarted container %s wasn't undrained", shortID(c.ID))
+				}
+			}
+			for _, id := range r.started {
+				if !fake.drained[id] {
+					t.Errorf("new container %s wasn't drained", shortID(id))
+				}
+				c, err := rt.InspectContainer(ctx, id)
+				switch {
+				case id == failedID && tt.keepFailed:
+					if err != nil {
+						t.Errorf("failed container was removed: %v", err)
+					} else if _, ok := c.Networks[config.DockerNetwork]; ok {
+						t.Errorf("failed container is still on %s", config.DockerNetwork)
+					}
+				case !errors.Is(err, ErrContainerNotFound):
+					t.Errorf("new container %s wasn't removed: %v", shortID(id), err)
+				}
+			}
+		})
+	}
+}
+
+func TestRolloutRunContainerFails(t *testing.T) {
+	rt := NewFakeRuntime()
+	appConfig := &config.AppConfig{Name: "app", Replicas: 2, MaxSurge: 1}
+	r := newTestRollout(t, rt, appConfig, 2)
+	fake := newFakeCutover(rt, "app", 0)
+	r.cutover = fake.cutover()
+	rt.RunErr = fmt.Errorf("no space left on device")
+
+	failedID, err := r.run(context.Background())
+	if err == nil || failedID != "" {
+		t.Fatalf("run() = %q, %v, want an error without a failed container", failedID, err)
+	}
+	if len(fake.running()) != 2 || len(r.retired) != 0 {
+		t.Errorf("old replicas were touched: %d running, %d retired", len(fake.running()), len(r.retired))
+	}
+}
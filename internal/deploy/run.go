@@ -0,0 +1,53 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// RunCommand runs cmd in a one-off container from the image of the app's current deployment,
+// with the same env, volumes and network as its replicas. Stdin is attached, and with tty the
+// container gets a terminal. The container is removed when the command exits, and its exit
+// code is returned.
+func RunCommand(ctx context.Context, rt Runtime, appConfig *config.AppConfig, cmd []string, tty bool) (int, error) {
+	running, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name})
+	if err != nil {
+		return 0, err
+	}
+	if len(running) == 0 {
+		return 0, fmt.Errorf("app '%s' has no running containers, deploy it first", appConfig.Name)
+	}
+	// The newest running deployment is the current one. During a canary that's the canary.
+	sort.Slice(running, func(i, j int) bool { return running[i].DeploymentID > running[j].DeploymentID })
+
+	if err := rt.EnsureNetwork(ctx, config.DockerNetwork); err != nil {
+		return 0, err
+	}
+
+	name := fmt.Sprintf("%s-turkis-run-%s", appConfig.Name, time.Now().Format("20060102150405"))
+	opts := taskOptions(appConfig, name, running[0].ImageID, cmd)
+	opts.Stdin = os.Stdin
+	opts.Tty = tty
+	return rt.RunTask(ctx, opts)
+}
+
+// taskOptions returns the options for a one-off container that runs like a replica of the
+// app: same env, volumes and network. It is labeled so turkis-manager never routes traffic to
+// it, and without the app labels it is never mistaken for a replica.
+func taskOptions(appConfig *config.AppConfig, name, imageName string, cmd []string) TaskOptions {
+	return TaskOptions{
+		Name:    name,
+		Image:   imageName,
+		Cmd:     cmd,
+		Labels:  map[string]string{config.LabelIgnore: "true"},
+		Env:     appConfig.Env,
+		Volumes: appConfig.Volumes,
+		Network: config.DockerNetwork,
+		Output:  os.Stdout,
+	}
+}
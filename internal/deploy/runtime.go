@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrContainerNotFound is returned when a container does not exist.
+	ErrContainerNotFound = errors.New("container not found")
+
+	// ErrImageNotFound is returned when an image does not exist.
+	ErrImageNotFound = errors.New("image not found")
+
+	// ErrNetworkNotFound is returned when a network does not exist.
+	ErrNetworkNotFound = errors.New("network not found")
+)
+
+// BuildError is returned when the image build itself fails, as opposed to
+// failing to talk to the container runtime.
+type BuildError struct {
+	Image   string
+	Message string
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("failed to build image '%s': %s", e.Image, e.Message)
+}
+
+// Runtime is the container runtime used by turkis to build and run apps.
+// DockerRuntime talks to a Docker daemon, FakeRuntime keeps everything in memory.
+type Runtime interface {
+	// BuildImage builds an image and streams the build output to opts.Output.
+	BuildImage(ctx context.Context, opts BuildOptions) error
+	// PullImage pulls an image from its registry and streams the progress to opts.Output.
+	PullImage(ctx context.Context, opts PullOptions) error
+	// InspectImage returns the image a reference (name, tag, digest or ID) points to.
+	InspectImage(ctx context.Context, reference string) (ImageInfo, error)
+	// ListImages returns all images with a tag or digest in the given repository.
+	ListImages(ctx context.Context, reference string) ([]ImageInfo, error)
+	// RemoveImage removes an image by ID.
+	RemoveImage(ctx context.Context, imageID string) error
+	// PruneDanglingImages removes all untagged images.
+	PruneDanglingImages(ctx context.Context) error
+
+	// EnsureNetwork creates the network if it doesn't exist.
+	EnsureNetwork(ctx context.Context, name string) error
+	// ConnectNetwork attaches a container to a network.
+	ConnectNetwork(ctx context.Context, networkName, containerID string) error
+	// DisconnectNetwork detaches a container from a network.
+	DisconnectNetwork(ctx context.Context, networkName, containerID string) error
+
+	// RunContainer creates and starts a container and returns its ID. A container that fails
+	// to start is removed.
+	RunContainer(ctx context.Context, opts RunOptions) (string, error)
+	// ListContainers returns the containers matching opts.
+	ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error)
+	// InspectContainer returns the current state of a container.
+	InspectContainer(ctx context.Context, containerID string) (ContainerInfo, error)
+	StartContainer(ctx context.Context, containerID string) error
+	StopContainer(ctx context.Context, containerID string) error
+	RemoveContainer(ctx context.Context, containerID string) error
+	// RunTask runs a one-off container to completion, streams its output to opts.Output and
+	// removes it again. It returns the exit code of the command.
+	RunTask(ctx context.Context, opts TaskOptions) (int, error)
+	// ContainerLogs returns the last tail lines of a container's stdout and stderr.
+	ContainerLogs(ctx context.Context, containerID string, tail int) (string, error)
+
+	Close() error
+}
+
+// BuildOptions describes an image build.
+type BuildOptions struct {
+	Image        string
+	Dockerfile   string
+	BuildContext string
+	BuildArgs    map[string]string
+	// Output receives the build log. Defaults to io.Discard.
+	Output io.Writer
+}
+
+// PullOptions describes an image pull.
+type PullOptions struct {
+	// Image is a reference with a tag or digest, e.g. registry.example.com/app:1.4.2.
+	Image string
+	// RegistryAuth is the base64 encoded registry.AuthConfig, empty for anonymous pulls.
+	RegistryAuth string
+	// Output receives the pull progress. Defaults to io.Discard.
+	Output io.Writer
+}
+
+// RunOptions describes a container to run.
+type RunOptions struct {
+	Name          string
+	Image         string
+	Labels        map[string]string
+	Env           map[string]string
+	Volumes       []string
+	Network       string
+	RestartPolicy string
+}
+
+// TaskOptions describes a one-off container, e.g. for a deploy hook.
+type TaskOptions struct {
+	Name    string
+	Image   string
+	Cmd     []string
+	Labels  map[string]string
+	Env     map[string]string
+	Volumes []string
+	Network string
+	// Stdin is copied to the container's stdin, nil leaves it closed.
+	Stdin io.Reader
+	// Tty allocates a terminal. When Stdin is a terminal it is put into raw mode while the
+	// container runs.
+	Tty bool
+	// Output receives the container's stdout and stderr. Defaults to io.Discard.
+	Output io.Writer
+}
+
+// ListOptions filters the containers returned by ListContainers.
+type ListOptions struct {
+	// AppName limits the result to containers with a matching turkis.appName label.
+	AppName string
+	// All includes stopped containers.
+	All bool
+}
@@ -0,0 +1,123 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// ScaleApp changes the number of running replicas of the app's current deployment without
+// deploying anything new. New replicas run the same image and are health-checked before
+// ScaleApp returns. Surplus replicas are drained through turkis-manager and removed.
+func ScaleApp(ctx context.Context, rt Runtime, appConfig *config.AppConfig, replicas int) error {
+	if replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+
+	if canary, err := findCanary(ctx, rt, appConfig.Name); err != nil {
+		return err
+	} else if canary != nil {
+		return fmt.Errorf("app '%s' has canary deployment %s in progress, promote or abort it first", appConfig.Name, canary.DeploymentID)
+	}
+
+	running, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name})
+	if err != nil {
+		return err
+	}
+	if len(running) == 0 {
+		return fmt.Errorf("app '%s' has no running containers, deploy it first", appConfig.Name)
+	}
+
+	// The newest running deployment is the one being scaled.
+	sort.Slice(running, func(i, j int) bool { return running[i].DeploymentID > running[j].DeploymentID })
+	deploymentID := running[0].DeploymentID
+	var current []ContainerInfo
+	for _, c := range running {
+		if c.DeploymentID == deploymentID {
+			current = append(current, c)
+		}
+	}
+	all, err := rt.ListContainers(ctx, ListOptions{AppName: appConfig.Name, All: true})
+	if err != nil {
+		return err
+	}
+	usedNames := make(map[string]bool, len(all))
+	for _, c := range all {
+		usedNames[c.Name] = true
+	}
+
+	switch {
+	case replicas == len(current):
+		fmt.Printf("App '%s' already runs %d replica(s)\n", appConfig.Name, replicas)
+		return nil
+
+	case replicas > len(current):
+		// Run the image of the current deployment by ID, its tag may have moved since.
+		image := current[0].ImageID
+		replica := 1
+		for i := len(current); i < replicas; i++ {
+			for usedNames[containerName(appConfig.Name, deploymentID, replica)] {
+				replica++
+			}
+			usedNames[containerName(appConfig.Name, deploymentID, replica)] = true
+
+			id, err := runContainer(ctx, rt, image, appConfig, deploymentID, replica, 0)
+			if err != nil {
+				return fmt.Errorf("failed to run new container: %w", err)
+			}
+			fmt.Printf("Performing health check on container %s...\n", shortID(id))
+			if err := HealthCheckContainer(ctx, rt, id, appConfig.Port, appConfig.HealthCheckPath); err != nil {
+				removeUnhealthyReplica(context.WithoutCancel(ctx), rt, appConfig.Name, id, appConfig.DrainTime)
+				return fmt.Errorf("new container failed health check: %w", err)
+			}
+		}
+
+	default:
+		// Remove the replicas with the highest numbers. Comparing lengths first sorts
+		// app-turkis-<id>-10 after app-turkis-<id>-9.
+		sort.Slice(current, func(i, j int) bool {
+			if len(current[i].Name) != len(current[j].Name) {
+				return len(current[i].Name) < len(current[j].Name)
+			}
+			return current[i].Name < current[j].Name
+		})
+		surplus := current[replicas:]
+		ids := make([]string, 0, len(surplus))
+		for _, c := range surplus {
+			ids = append(ids, c.ID)
+		}
+		fmt.Printf("Draining %d container(s)...\n", len(ids))
+		if err := DrainContainers(ctx, appConfig.Name, ids, appConfig.DrainTime); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			fmt.Printf("Warning: could not confirm that the containers were drained: %v. Removing them anyway.\n", err)
+		}
+		for _, c := range surplus {
+			fmt.Printf("Removing container %s\n", shortID(c.ID))
+			if err := rt.StopContainer(ctx, c.ID); err != nil {
+				return err
+			}
+			if err := rt.RemoveContainer(ctx, c.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("App '%s' now runs %d replica(s) of deployment %s\n", appConfig.Name, replicas, deploymentID)
+	return nil
+}
+
+// removeUnhealthyReplica takes a replica that failed its health check out of service and removes it.
+func removeUnhealthyReplica(ctx context.Context, rt Runtime, appName, containerID string, drainTime int) {
+	if err := DrainContainers(ctx, appName, []string{containerID}, drainTime); err != nil {
+		fmt.Printf("Warning: could not confirm that turkis-manager took container %s out of service: %v\n", shortID(containerID), err)
+	}
+	if err := rt.StopContainer(ctx, containerID); err != nil {
+		fmt.Printf("Warning: could not stop container %s: %v\n", shortID(containerID), err)
+	} else if err := rt.RemoveContainer(ctx, containerID); err != nil {
+		fmt.Printf("Warning: could not remove container %s: %v\n", shortID(containerID), err)
+	}
+}
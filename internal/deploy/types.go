@@ -2,5 +2,19 @@ package deploy
 
 type ContainerInfo struct {
 	ID           string
+	Name         string
+	Image        string
+	ImageID      string
 	DeploymentID string
+	Labels       map[string]string
+	State        string
+	Running      bool
+	// Networks maps network names to the container's IP address on that network.
+	Networks map[string]string
+}
+
+type ImageInfo struct {
+	ID      string
+	Tags    []string
+	Digests []string
 }
@@ -0,0 +1,418 @@
+package haproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultTimeout is how long a single runtime API command may take.
+const DefaultTimeout = 5 * time.Second
+
+// RuntimeClient sends commands to the HAProxy Runtime API over the stats socket.
+// See https://docs.haproxy.org/3.1/management.html#9.3
+type RuntimeClient struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// ServerState is a single row of "show servers state".
+type ServerState struct {
+	Backend    string
+	Name       string
+	Address    string
+	Port       string
+	OpState    int
+	AdminState int
+	// Weight is the weight the server was configured with (srv_uweight).
+	Weight int
+}
+
+// NewRuntimeClient returns a client for the socket at socketPath.
+func NewRuntimeClient(socketPath string) *RuntimeClient {
+	return &RuntimeClient{
+		SocketPath: socketPath,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+// Execute runs a single command and returns its raw output. Each command uses its own
+// connection since the socket is in non-interactive mode by default.
+func (c *RuntimeClient) Execute(ctx context.Context, command string) (string, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, "unix", c.SocketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to HAProxy runtime API at %s: %w", c.SocketPath, err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return "", fmt.Errorf("failed to send command '%s': %w", command, err)
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response to '%s': %w", command, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ExecuteWithPayload runs a command that reads a multi-line payload, like "set ssl cert".
+// The payload can't contain empty lines since one ends it, so they are dropped.
+func (c *RuntimeClient) ExecuteWithPayload(ctx context.Context, command, payload string) (string, error) {
+	var lines []string
+	for _, line := range strings.Split(payload, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return c.Execute(ctx, command+" <<\n"+strings.Join(lines, "\n")+"\n")
+}
+
+// Available reports whether the runtime API socket accepts connections.
+func (c *RuntimeClient) Available(ctx context.Context) bool {
+	_, err := c.Execute(ctx, "show info")
+	return err == nil
+}
+
+// Servers returns the state of all servers in a backend.
+func (c *RuntimeClient) Servers(ctx context.Context, backend string) ([]ServerState, error) {
+	if err := checkArguments(backend); err != nil {
+		return nil, err
+	}
+	out, err := c.Execute(ctx, "show servers state "+backend)
+	if err != nil {
+		return nil, err
+	}
+
+	var header []string
+	var servers []ServerState
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line == "1":
+			// Blank lines and the format version.
+			continue
+		case strings.HasPrefix(line, "# "):
+			header = strings.Fields(strings.TrimPrefix(line, "# "))
+			continue
+		case header == nil:
+			// Anything before the header is an error message.
+			return nil, fmt.Errorf("unexpected response to 'show servers state %s': %s", backend, line)
+		}
+
+		fields := strings.Fields(line)
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(fields) {
+				row[name] = fields[i]
+			}
+		}
+		opState, _ := strconv.Atoi(row["srv_op_state"])
+		adminState, _ := strconv.Atoi(row["srv_admin_state"])
+		weight, _ := strconv.Atoi(row["srv_uweight"])
+		servers = append(servers, ServerState{
+			Backend:    row["be_name"],
+			Name:       row["srv_name"],
+			Address:    row["srv_addr"],
+			Port:       row["srv_port"],
+			OpState:    opState,
+			AdminState: adminState,
+			Weight:     weight,
+		})
+	}
+	return servers, scanner.Err()
+}
+
+// Sessions returns the number of current sessions on a server.
+func (c *RuntimeClient) Sessions(ctx context.Context, backend, server string) (int, error) {
+	out, err := c.Execute(ctx, "show stat")
+	if err != nil {
+		return 0, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(out, "# ")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse 'show stat' output: %w", err)
+	}
+	if len(records) == 0 {
+		return 0, fmt.Errorf("empty 'show stat' output")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	pxname, svname, scur := columns["pxname"], columns["svname"], columns["scur"]
+	for _, record := range records[1:] {
+		if len(record) <= scur {
+			continue
+		}
+		if record[pxname] == backend && record[svname] == server {
+			return strconv.Atoi(record[scur])
+		}
+	}
+	return 0, fmt.Errorf("server %s/%s not found", backend, server)
+}
+
+// AddServer registers a new server in a backend and puts it into service. A weight of 0
+// leaves HAProxy's default weight, a maxConn of 0 leaves the server without a connection limit.
+func (c *RuntimeClient) AddServer(ctx context.Context, backend, server, address string, weight, maxConn int, check bool) error {
+	if err := checkArguments(backend, server, address); err != nil {
+		return err
+	}
+	command := fmt.Sprintf("add server %s/%s %s", backend, server, address)
+	if weight > 0 {
+		command += fmt.Sprintf(" weight %d", weight)
+	}
+	if maxConn > 0 {
+		command += fmt.Sprintf(" maxconn %d", maxConn)
+	}
+	if check {
+		command += " check"
+	}
+	if err := c.expect(ctx, command, "New server registered"); err != nil {
+		return err
+	}
+	if check {
+		if err := c.expect(ctx, fmt.Sprintf("enable health %s/%s", backend, server), ""); err != nil {
+			return err
+		}
+	}
+	// Dynamically added servers start in maintenance mode.
+	return c.expect(ctx, fmt.Sprintf("enable server %s/%s", backend, server), "")
+}
+
+// SetWeight changes the weight of a server, which takes effect for new connections.
+func (c *RuntimeClient) SetWeight(ctx context.Context, backend, server string, weight int) error {
+	if err := checkArguments(backend, server); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("set weight %s/%s %d", backend, server, weight), "")
+}
+
+// DrainServer stops new traffic from reaching a server while existing sessions finish.
+func (c *RuntimeClient) DrainServer(ctx context.Context, backend, server string) error {
+	if err := checkArguments(backend, server); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("set server %s/%s state drain", backend, server), "")
+}
+
+// ReadyServer puts a drained server back into service.
+func (c *RuntimeClient) ReadyServer(ctx context.Context, backend, server string) error {
+	if err := checkArguments(backend, server); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("set server %s/%s state ready", backend, server), "")
+}
+
+// WaitForDrain polls until a server has no sessions left or the timeout expires.
+// It returns the number of sessions still open.
+func (c *RuntimeClient) WaitForDrain(ctx context.Context, backend, server string, timeout time.Duration) (int, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		sessions, err := c.Sessions(ctx, backend, server)
+		if err != nil {
+			return 0, err
+		}
+		if sessions == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return sessions, ctx.Err()
+		case <-deadline:
+			return sessions, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RemoveServer puts a server into maintenance, kills any sessions left and deletes it.
+func (c *RuntimeClient) RemoveServer(ctx context.Context, backend, server string) error {
+	if err := checkArguments(backend, server); err != nil {
+		return err
+	}
+	if err := c.expect(ctx, fmt.Sprintf("set server %s/%s state maint", backend, server), ""); err != nil {
+		return err
+	}
+	if err := c.expect(ctx, fmt.Sprintf("shutdown sessions server %s/%s", backend, server), ""); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("del server %s/%s", backend, server), "Server deleted")
+}
+
+// Certificates returns the file names of the certificates HAProxy has loaded.
+func (c *RuntimeClient) Certificates(ctx context.Context) ([]string, error) {
+	return c.list(ctx, "show ssl cert")
+}
+
+// CrtLists returns the crt-lists and certificate directories used by bind lines.
+func (c *RuntimeClient) CrtLists(ctx context.Context) ([]string, error) {
+	return c.list(ctx, "show ssl crt-list")
+}
+
+// SetCertificate replaces a certificate HAProxy has loaded with pem, which holds the
+// certificate chain and its private key. New connections use it right away.
+func (c *RuntimeClient) SetCertificate(ctx context.Context, name, pem string) error {
+	if err := checkArguments(name); err != nil {
+		return err
+	}
+	if err := c.expectPayload(ctx, "set ssl cert "+name, pem, "Transaction "); err != nil {
+		return err
+	}
+	if err := c.expect(ctx, "commit ssl cert "+name, "Success!"); err != nil {
+		c.Execute(ctx, "abort ssl cert "+name)
+		return err
+	}
+	return nil
+}
+
+// AddCertificate loads a new certificate and adds it to a crt-list or certificate directory,
+// so the bind lines using it serve it for the names it covers.
+func (c *RuntimeClient) AddCertificate(ctx context.Context, crtList, name, pem string) error {
+	if err := checkArguments(crtList, name); err != nil {
+		return err
+	}
+	if err := c.expect(ctx, "new ssl cert "+name, "New empty certificate store"); err != nil {
+		return err
+	}
+	if err := c.SetCertificate(ctx, name, pem); err != nil {
+		c.Execute(ctx, "del ssl cert "+name)
+		return err
+	}
+	if err := c.expect(ctx, fmt.Sprintf("add ssl crt-list %s %s", crtList, name), "Success!"); err != nil {
+		c.Execute(ctx, "del ssl cert "+name)
+		return err
+	}
+	return nil
+}
+
+// RemoveCertificate takes a certificate out of a crt-list and deletes it from memory.
+func (c *RuntimeClient) RemoveCertificate(ctx context.Context, crtList, name string) error {
+	if err := checkArguments(crtList, name); err != nil {
+		return err
+	}
+	if err := c.expect(ctx, fmt.Sprintf("del ssl crt-list %s %s", crtList, name), "deleted"); err != nil {
+		return err
+	}
+	return c.expect(ctx, "del ssl cert "+name, "deleted")
+}
+
+// Maps returns the files of the maps HAProxy has loaded, as the config names them.
+func (c *RuntimeClient) Maps(ctx context.Context) ([]string, error) {
+	lines, err := c.list(ctx, "show map")
+	if err != nil {
+		return nil, err
+	}
+	// Each line looks like: 1 (routes.map) pattern loaded from file 'routes.map' used by map at ...
+	var files []string
+	for _, line := range lines {
+		start := strings.Index(line, "(")
+		end := strings.Index(line, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("unexpected response to 'show map': %s", line)
+		}
+		files = append(files, line[start+1:end])
+	}
+	return files, nil
+}
+
+// AddMapEntry adds an entry to a loaded map. The map file is left alone.
+func (c *RuntimeClient) AddMapEntry(ctx context.Context, file, key, value string) error {
+	if err := checkArguments(file, key, value); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("add map %s %s %s", file, key, value), "")
+}
+
+// SetMapEntry changes the value of an entry of a loaded map.
+func (c *RuntimeClient) SetMapEntry(ctx context.Context, file, key, value string) error {
+	if err := checkArguments(file, key, value); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("set map %s %s %s", file, key, value), "")
+}
+
+// DeleteMapEntry removes an entry from a loaded map.
+func (c *RuntimeClient) DeleteMapEntry(ctx context.Context, file, key string) error {
+	if err := checkArguments(file, key); err != nil {
+		return err
+	}
+	return c.expect(ctx, fmt.Sprintf("del map %s %s", file, key), "")
+}
+
+// checkArguments rejects values that can't go into a command as is. A space would split
+// them, and a ; or a newline would start another command.
+func checkArguments(values ...string) error {
+	for _, value := range values {
+		if value == "" || strings.ContainsFunc(value, func(r rune) bool { return r == ';' || unicode.IsSpace(r) || unicode.IsControl(r) }) {
+			return fmt.Errorf("invalid argument %q for the HAProxy runtime API", value)
+		}
+	}
+	return nil
+}
+
+// list runs a "show" command that returns one name per line after a comment header.
+func (c *RuntimeClient) list(ctx context.Context, command string) ([]string, error) {
+	out, err := c.Execute(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, nil
+}
+
+// expectPayload is expect for commands with a payload.
+func (c *RuntimeClient) expectPayload(ctx context.Context, command, payload, want string) error {
+	out, err := c.ExecuteWithPayload(ctx, command, payload)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, want) {
+		return fmt.Errorf("HAProxy rejected '%s': %s", command, out)
+	}
+	return nil
+}
+
+// expect runs a command and treats any response that doesn't contain want as an error.
+// An empty want means the command must not produce any output.
+func (c *RuntimeClient) expect(ctx context.Context, command, want string) error {
+	out, err := c.Execute(ctx, command)
+	if err != nil {
+		return err
+	}
+	if (want == "" && out != "") || (want != "" && !strings.Contains(out, want)) {
+		return fmt.Errorf("HAProxy rejected '%s': %s", command, out)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ameistad/turkis/internal/remote"
+)
+
+const (
+	ActionDeploy   = "deploy"
+	ActionRollback = "rollback"
+	ActionCanary   = "canary"
+	ActionPromote  = "promote"
+	ActionAbort    = "abort"
+
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+
+	HealthPassed  = "passed"
+	HealthFailed  = "failed"
+	HealthSkipped = "skipped"
+)
+
+// Entry is a single deploy or rollback in the history journal.
+type Entry struct {
+	App          string `json:"app"`
+	Action       string `json:"action"`
+	DeploymentID string `json:"deploymentId,omitempty"`
+	ContainerID  string `json:"containerId,omitempty"`
+	// Image is the registry reference that was deployed, empty for images built locally.
+	Image       string    `json:"image,omitempty"`
+	ImageID     string    `json:"imageId,omitempty"`
+	ImageDigest string    `json:"imageDigest,omitempty"`
+	GitCommit   string    `json:"gitCommit,omitempty"`
+	ConfigHash  string    `json:"configHash,omitempty"`
+	User        string    `json:"user"`
+	StartedAt   time.Time `json:"startedAt"`
+	DurationMS  int64     `json:"durationMs"`
+	HealthCheck string    `json:"healthCheck"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	// FailureLog is the path to the saved logs of a container that failed its health check.
+	FailureLog string `json:"failureLog,omitempty"`
+}
+
+// Duration returns how long the deploy or rollback took.
+func (e Entry) Duration() time.Duration {
+	return time.Duration(e.DurationMS) * time.Millisecond
+}
+
+// appendMutex serializes writers within a process. Each entry is written with a single
+// append, so lines from separate processes don't interleave.
+var appendMutex sync.Mutex
+
+// Append adds an entry to the journal at path, creating it if needed.
+func Append(path string, entry Entry) error {
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := remote.AppendFile(path, line, 0644); err != nil {
+		return fmt.Errorf("failed to write history file '%s': %w", remote.Location(path), err)
+	}
+	return nil
+}
+
+// Read returns the entries for appName in the order they were recorded. An empty appName
+// returns all entries. A missing journal is not an error.
+func Read(path, appName string) ([]Entry, error) {
+	data, err := remote.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read history file '%s': %w", remote.Location(path), err)
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid history entry on line %d of '%s': %w", lineNumber, path, err)
+		}
+		if appName != "" && entry.App != appName {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file '%s': %w", path, err)
+	}
+	return entries, nil
+}
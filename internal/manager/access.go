@@ -0,0 +1,157 @@
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// accessName names the access settings of the j-th path of the i-th domain of an app. The
+// route of the path carries it, so the backend knows which settings apply.
+func accessName(i, j int) string {
+	return fmt.Sprintf("d%dp%d", i, j)
+}
+
+// accessPolicy is access settings of an app and the requests they apply to.
+type accessPolicy struct {
+	access config.Access
+	// condition selects the requests, empty for all of them
+	condition string
+	userlist  string
+}
+
+// accessPolicies returns the access settings of the app and of its paths. A path with settings
+// of its own is exempt from the app's.
+func accessPolicies(labels *config.ContainerLabels) (acls []string, policies []accessPolicy) {
+	var exempt []string
+	for i, domain := range labels.Domains {
+		for j, path := range domain.Paths {
+			if path.Access == nil {
+				continue
+			}
+			name := accessName(i, j)
+			acl := "access_" + name
+			acls = append(acls, fmt.Sprintf("acl %s var(txn.turkis_route),field(3,:) -m str %s", acl, name))
+			exempt = append(exempt, "!"+acl)
+			policies = append(policies, accessPolicy{access: *path.Access, condition: acl, userlist: config.ReservedNamePrefix + "auth_" + labels.AppName + "_" + name})
+		}
+	}
+	app := accessPolicy{access: labels.Access, condition: strings.Join(exempt, " "), userlist: labels.AppName}
+	return acls, append([]accessPolicy{app}, policies...)
+}
+
+// accessRules turns away the requests to an app that its access settings don't let in, and
+// returns the userlist sections for basic auth.
+func accessRules(labels *config.ContainerLabels) (rules []string, userlists string) {
+	acls, policies := accessPolicies(labels)
+	for _, p := range policies {
+		if !p.access.Enabled() {
+			continue
+		}
+		if len(p.access.Deny) > 0 {
+			rules = append(rules, "http-request deny deny_status 403 if "+joinConditions(p.condition, fmt.Sprintf("{ src %s }", strings.Join(p.access.Deny, " "))))
+		}
+		if len(p.access.Allow) > 0 {
+			rules = append(rules, "http-request deny deny_status 403 if "+joinConditions(p.condition, fmt.Sprintf("!{ src %s }", strings.Join(p.access.Allow, " "))))
+		}
+		if auth := p.access.BasicAuth; auth.Enabled() {
+			realm := auth.Realm
+			if realm == "" {
+				realm = labels.AppName
+			}
+			rules = append(rules, fmt.Sprintf("http-request auth realm %s if %s", quote(realm), joinConditions(p.condition, fmt.Sprintf("!{ http_auth(%s) }", p.userlist))))
+
+			userlists += fmt.Sprintf("userlist %s\n", p.userlist)
+			for _, user := range slices.Sorted(maps.Keys(auth.Users)) {
+				userlists += fmt.Sprintf("    user %s password %s\n", user, quote(auth.Users[user]))
+			}
+		}
+	}
+	// The acls are only needed when a path has rules.
+	if len(rules) > 0 {
+		rules = append(acls, rules...)
+	}
+	return rules, userlists
+}
+
+func joinConditions(conditions ...string) string {
+	var kept []string
+	for _, c := range conditions {
+		if c != "" {
+			kept = append(kept, c)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// loadUsersFiles adds the users of the htpasswd files in the access settings of labels to their
+// users. A file that can't be read lets nobody in who isn't listed in the config.
+func loadUsersFiles(labels *config.ContainerLabels) {
+	load := func(auth *config.BasicAuth) {
+		if auth.UsersFile == "" {
+			return
+		}
+		users, err := readUsersFile(auth.UsersFile)
+		if err != nil {
+			log.Printf("Failed to read users file of app %s: %v", labels.AppName, err)
+			return
+		}
+		if auth.Users == nil {
+			auth.Users = make(map[string]string)
+		}
+		for user, hash := range users {
+			// Users in the config win
+			if _, ok := auth.Users[user]; !ok {
+				auth.Users[user] = hash
+			}
+		}
+	}
+
+	load(&labels.Access.BasicAuth)
+	for i := range labels.Domains {
+		for j := range labels.Domains[i].Paths {
+			if access := labels.Domains[i].Paths[j].Access; access != nil {
+				load(&access.BasicAuth)
+			}
+		}
+	}
+}
+
+// readUsersFile reads the user:hash lines of an htpasswd file. HAProxy checks passwords with
+// crypt(3), so only bcrypt hashes are used.
+func readUsersFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || strings.ContainsAny(user, " \t") {
+			log.Printf("Skipping invalid line in users file %s", path)
+			continue
+		}
+		if !strings.HasPrefix(hash, "$2") {
+			log.Printf("Skipping user %s in users file %s: only bcrypt hashes are supported, use htpasswd -B", user, path)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
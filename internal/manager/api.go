@@ -0,0 +1,439 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/manager/certificates"
+)
+
+// ErrAppNotFound is returned by the API client when the manager doesn't know about an app.
+var ErrAppNotFound = errors.New("app not found")
+
+// NewAPIHandler returns the HTTP API the turkis CLI uses to follow deployments and manage
+// certificates. Reconciles are triggered through reconciler and happen in the background.
+// certs is nil in dry-run mode.
+func NewAPIHandler(updater *Updater, reconciler *Reconciler, certs *Certificates) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		// Reconciles are debounced and run one at a time, so don't make the caller wait for it.
+		reconciler.Trigger("an API request")
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	})
+	mux.HandleFunc("POST /v1/apps/{app}/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req DrainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Containers) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON body with a list of containers"})
+			return
+		}
+		updater.Drain(req.Containers)
+		reconciler.Trigger(fmt.Sprintf("draining %d container(s) of %s", len(req.Containers), r.PathValue("app")))
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	})
+	mux.HandleFunc("POST /v1/apps/{app}/undrain", func(w http.ResponseWriter, r *http.Request) {
+		var req DrainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Containers) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON body with a list of containers"})
+			return
+		}
+		updater.Undrain(req.Containers)
+		reconciler.Trigger(fmt.Sprintf("undraining %d container(s) of %s", len(req.Containers), r.PathValue("app")))
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	})
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Status{Config: updater.ConfigStatus(), Apps: updater.Statuses()})
+	})
+	mux.HandleFunc("GET /v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, updater.Metrics())
+	})
+	mux.HandleFunc("GET /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		status, ok := updater.Status(r.PathValue("app"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrAppNotFound.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /v1/certificates", func(w http.ResponseWriter, r *http.Request) {
+		m, err := certs.Manager()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		infos, err := m.Certificates()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+	mux.HandleFunc("GET /v1/certificates/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		domain, ok := domainValue(w, r)
+		if !ok {
+			return
+		}
+		m, err := certs.Manager()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		info, err := m.Certificate(domain)
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+	// Renewing and revoking talk to the CA, so these wait for the result.
+	mux.HandleFunc("POST /v1/certificates/{domain}/renew", func(w http.ResponseWriter, r *http.Request) {
+		domain, ok := domainValue(w, r)
+		if !ok {
+			return
+		}
+		var req RenewRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON body with force"})
+				return
+			}
+		}
+		m, err := certs.Manager()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		renewed, err := m.Renew(domain, req.Force)
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		info, err := m.Certificate(domain)
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, RenewResponse{Renewed: renewed, Certificate: info})
+	})
+	mux.HandleFunc("POST /v1/certificates/{domain}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		domain, ok := domainValue(w, r)
+		if !ok {
+			return
+		}
+		m, err := certs.Manager()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		if err := m.Revoke(domain); err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+	})
+	mux.HandleFunc("POST /v1/certificates/prune", func(w http.ResponseWriter, r *http.Request) {
+		var req PruneRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON body with a list of domains"})
+				return
+			}
+		}
+		m, err := certs.Manager()
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		removed, err := m.Prune(req.Domains)
+		if err != nil {
+			writeCertificatesError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, PruneResponse{Removed: removed})
+	})
+	return mux
+}
+
+// RequireToken only lets requests through to h that carry token as a bearer token. The API is
+// reachable from the containers on the turkis network, so it must not be left open to them.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid token for turkis-manager"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// domainValue returns the domain in the path of r, which ends up in file names, or responds
+// with an error if it isn't one.
+func domainValue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	domain := r.PathValue("domain")
+	if err := config.ValidateDomain(domain); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return "", false
+	}
+	return domain, true
+}
+
+// writeCertificatesError responds with the status code for an error of the certificate manager.
+func writeCertificatesError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNoCertificateManager), errors.Is(err, certificates.ErrNotSynced):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, certificates.ErrCertificateNotFound), errors.Is(err, certificates.ErrDomainNotManaged):
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Status is the body of GET /v1/status.
+type Status struct {
+	Config ConfigStatus `json:"config"`
+	Apps   []AppStatus  `json:"apps"`
+}
+
+// DrainRequest is the body of POST /v1/apps/{app}/drain and /v1/apps/{app}/undrain.
+type DrainRequest struct {
+	Containers []string `json:"containers"`
+}
+
+// RenewRequest is the body of POST /v1/certificates/{domain}/renew.
+type RenewRequest struct {
+	// Force renews the certificate even when it isn't due.
+	Force bool `json:"force"`
+}
+
+// RenewResponse is the response to POST /v1/certificates/{domain}/renew.
+type RenewResponse struct {
+	Renewed     bool                         `json:"renewed"`
+	Certificate certificates.CertificateInfo `json:"certificate"`
+}
+
+// PruneRequest is the body of POST /v1/certificates/prune.
+type PruneRequest struct {
+	// Domains limits the prune to these domains, all unused ones are removed without it.
+	Domains []string `json:"domains,omitempty"`
+}
+
+// PruneResponse is the response to POST /v1/certificates/prune.
+type PruneResponse struct {
+	Removed []string `json:"removed"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// APIClient talks to the manager API.
+type APIClient struct {
+	BaseURL string
+	// Token is sent with every request, see RequireToken.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewAPIClient returns a client for the manager API at baseURL that authenticates with token.
+func NewAPIClient(baseURL, token string) *APIClient {
+	return &APIClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// do sends req with the token of the client.
+func (c *APIClient) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach turkis-manager at %s: %w", c.BaseURL, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, fmt.Errorf("turkis-manager at %s rejected the token, check %s or TURKIS_MANAGER_TOKEN", c.BaseURL, config.ManagerTokenFileName)
+	}
+	return resp, nil
+}
+
+// Reconcile asks the manager to bring HAProxy in line with the running containers.
+func (c *APIClient) Reconcile(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/reconcile", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(c.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("turkis-manager returned %s for /v1/reconcile", resp.Status)
+	}
+	return nil
+}
+
+// Drain asks the manager to drain the containers and take them out of the app's backend.
+func (c *APIClient) Drain(ctx context.Context, appName string, containerIDs []string) error {
+	return c.postContainers(ctx, "/v1/apps/"+url.PathEscape(appName)+"/drain", containerIDs)
+}
+
+// Undrain asks the manager to put drained containers back into the app's backend.
+func (c *APIClient) Undrain(ctx context.Context, appName string, containerIDs []string) error {
+	return c.postContainers(ctx, "/v1/apps/"+url.PathEscape(appName)+"/undrain", containerIDs)
+}
+
+func (c *APIClient) postContainers(ctx context.Context, path string, containerIDs []string) error {
+	body, err := json.Marshal(DrainRequest{Containers: containerIDs})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(c.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("turkis-manager returned %s for %s", resp.Status, path)
+	}
+	return nil
+}
+
+// AppStatus returns the cutover state of an app.
+func (c *APIClient) AppStatus(ctx context.Context, appName string) (AppStatus, error) {
+	var status AppStatus
+	err := c.get(ctx, "/v1/apps/"+url.PathEscape(appName), &status)
+	return status, err
+}
+
+// Certificates returns the certificates the manager has obtained.
+func (c *APIClient) Certificates(ctx context.Context) ([]certificates.CertificateInfo, error) {
+	var infos []certificates.CertificateInfo
+	err := c.call(ctx, c.HTTPClient, http.MethodGet, "/v1/certificates", nil, &infos)
+	return infos, err
+}
+
+// Certificate returns a domain's certificate with its chain.
+func (c *APIClient) Certificate(ctx context.Context, domain string) (certificates.CertificateInfo, error) {
+	var info certificates.CertificateInfo
+	err := c.call(ctx, c.HTTPClient, http.MethodGet, "/v1/certificates/"+url.PathEscape(domain), nil, &info)
+	return info, err
+}
+
+// RenewCertificate asks the manager to renew a domain's certificate if it is due, or right
+// away with force, and waits for the CA.
+func (c *APIClient) RenewCertificate(ctx context.Context, domain string, force bool) (RenewResponse, error) {
+	var resp RenewResponse
+	err := c.call(ctx, c.orderClient(), http.MethodPost, "/v1/certificates/"+url.PathEscape(domain)+"/renew", RenewRequest{Force: force}, &resp)
+	return resp, err
+}
+
+// RevokeCertificate asks the manager to revoke a domain's certificate and waits for the CA.
+func (c *APIClient) RevokeCertificate(ctx context.Context, domain string) error {
+	return c.call(ctx, c.orderClient(), http.MethodPost, "/v1/certificates/"+url.PathEscape(domain)+"/revoke", nil, nil)
+}
+
+// PruneCertificates asks the manager to delete the certificates of the given domains if no app
+// uses them, or of every unused domain if domains is nil. It returns the removed domains.
+func (c *APIClient) PruneCertificates(ctx context.Context, domains []string) ([]string, error) {
+	var resp PruneResponse
+	err := c.call(ctx, c.HTTPClient, http.MethodPost, "/v1/certificates/prune", PruneRequest{Domains: domains}, &resp)
+	return resp.Removed, err
+}
+
+// orderClient is HTTPClient with a timeout long enough for the CA to validate a challenge,
+// which can take minutes with dns-01.
+func (c *APIClient) orderClient() *http.Client {
+	client := *c.HTTPClient
+	client.Timeout = orderTimeout
+	return &client
+}
+
+// orderTimeout is how long to wait for the manager to renew or revoke a certificate.
+const orderTimeout = 5 * time.Minute
+
+// call sends a request with an optional JSON body and decodes the response into v. The error
+// the manager responds with is returned as is.
+func (c *APIClient) call(ctx context.Context, client *http.Client, method, path string, body, v any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("turkis-manager returned %s for %s", resp.Status, path)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response from turkis-manager: %w", err)
+	}
+	return nil
+}
+
+func (c *APIClient) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(c.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrAppNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("turkis-manager returned %s for %s", resp.Status, path)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response from turkis-manager: %w", err)
+	}
+	return nil
+}
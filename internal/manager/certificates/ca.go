@@ -0,0 +1,166 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+const (
+	// caLifetime is how long the local CA is valid. Clients trust it by hand, so it lives long.
+	caLifetime = 10 * 365 * 24 * time.Hour
+	// selfSignedLifetime is how long a certificate from the local CA is valid, like one from
+	// Let's Encrypt
+	selfSignedLifetime = 90 * 24 * time.Hour
+)
+
+// localCA issues the certificates of ModeSelfSigned domains. It is kept in the ca directory of
+// CertDir, so clients only need to trust ca.crt once.
+type localCA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// loadOrCreateLocalCA loads the CA from dir, creating it the first time
+func loadOrCreateLocalCA(dir string) (*localCA, error) {
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	certPEM, err := os.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return createLocalCA(certPath, keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local CA: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local CA key: %w", err)
+	}
+
+	cert, err := certcrypto.ParsePEMCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local CA: %w", err)
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported local CA key type %T", key)
+	}
+	return &localCA{cert: cert, certPEM: certPEM, key: signer}, nil
+}
+
+// createLocalCA generates a CA and saves it
+func createLocalCA(certPath, keyPath string) (*localCA, error) {
+	key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate local CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "turkis local CA", Organization: []string{"turkis"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	signer := key.(crypto.Signer)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create local CA directory: %w", err)
+	}
+	if err := os.WriteFile(keyPath, certcrypto.PEMEncode(key), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save local CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save local CA: %w", err)
+	}
+	return &localCA{cert: cert, certPEM: certPEM, key: signer}, nil
+}
+
+// issue creates a certificate with a new key for names, bundled with the CA
+func (ca *localCA) issue(names []string) (*certificate.Resource, error) {
+	key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.(crypto.Signer).Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &certificate.Resource{
+		Domain:            names[0],
+		Certificate:       append(certPEM, ca.certPEM...),
+		IssuerCertificate: ca.certPEM,
+		PrivateKey:        certcrypto.PEMEncode(key),
+	}, nil
+}
+
+// issueSelfSigned issues the domain's certificate from the local CA. The caller holds orderMutex.
+func (m *Manager) issueSelfSigned(domain *Domain) (*certificate.Resource, error) {
+	if m.ca == nil {
+		ca, err := loadOrCreateLocalCA(filepath.Join(m.config.CertDir, "ca"))
+		if err != nil {
+			return nil, err
+		}
+		m.ca = ca
+	}
+	m.logger.Infof("Issuing certificate from the local CA for domains: %v", domain.names())
+	return m.ca.issue(domain.names())
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,78 @@
+package certificates
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/providers/dns/acmedns"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/dnsimple"
+	"github.com/go-acme/lego/v4/providers/dns/duckdns"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/gandiv5"
+	"github.com/go-acme/lego/v4/providers/dns/godaddy"
+	"github.com/go-acme/lego/v4/providers/dns/hetzner"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/go-acme/lego/v4/providers/dns/namecheap"
+	"github.com/go-acme/lego/v4/providers/dns/netlify"
+	"github.com/go-acme/lego/v4/providers/dns/ovh"
+	"github.com/go-acme/lego/v4/providers/dns/pdns"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/go-acme/lego/v4/providers/dns/scaleway"
+)
+
+const (
+	// ChallengeHTTP01 proves control of a domain by serving a token on port 80.
+	ChallengeHTTP01 = "http-01"
+	// ChallengeDNS01 proves control of a domain with a TXT record. Wildcards need it.
+	ChallengeDNS01 = "dns-01"
+)
+
+// dnsProviders are the lego DNS providers that can solve dns-01 challenges, by lego's name
+// for them. Only these are linked in, to keep the manager image small. Each provider reads
+// its credentials from the manager's environment, or from the file named by the same
+// variable with a _FILE suffix. See https://go-acme.github.io/lego/dns/ for the variables.
+var dnsProviders = map[string]func() (challenge.Provider, error){
+	"acme-dns":     func() (challenge.Provider, error) { return acmedns.NewDNSProvider() },
+	"digitalocean": func() (challenge.Provider, error) { return digitalocean.NewDNSProvider() },
+	"dnsimple":     func() (challenge.Provider, error) { return dnsimple.NewDNSProvider() },
+	"duckdns":      func() (challenge.Provider, error) { return duckdns.NewDNSProvider() },
+	"exec":         func() (challenge.Provider, error) { return exec.NewDNSProvider() },
+	"gandiv5":      func() (challenge.Provider, error) { return gandiv5.NewDNSProvider() },
+	"godaddy":      func() (challenge.Provider, error) { return godaddy.NewDNSProvider() },
+	"hetzner":      func() (challenge.Provider, error) { return hetzner.NewDNSProvider() },
+	"httpreq":      func() (challenge.Provider, error) { return httpreq.NewDNSProvider() },
+	"namecheap":    func() (challenge.Provider, error) { return namecheap.NewDNSProvider() },
+	"netlify":      func() (challenge.Provider, error) { return netlify.NewDNSProvider() },
+	"ovh":          func() (challenge.Provider, error) { return ovh.NewDNSProvider() },
+	"pdns":         func() (challenge.Provider, error) { return pdns.NewDNSProvider() },
+	"rfc2136":      func() (challenge.Provider, error) { return rfc2136.NewDNSProvider() },
+	"route53":      func() (challenge.Provider, error) { return route53.NewDNSProvider() },
+	"scaleway":     func() (challenge.Provider, error) { return scaleway.NewDNSProvider() },
+}
+
+// DNSProviders returns the names of the supported DNS providers, sorted.
+func DNSProviders() []string {
+	names := make([]string, 0, len(dnsProviders))
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newDNSProvider creates the named DNS provider from the environment.
+func newDNSProvider(name string) (challenge.Provider, error) {
+	newProvider, ok := dnsProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNS provider '%s', expected one of %s", name, strings.Join(DNSProviders(), ", "))
+	}
+	provider, err := newProvider()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure DNS provider '%s': %w", name, err)
+	}
+	return provider, nil
+}
@@ -0,0 +1,115 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/hetzner"
+)
+
+func TestNewDNSProvider(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		env      map[string]string
+		// wantErr is part of the error, empty when the provider is configured
+		wantErr string
+	}{
+		{name: "credentials", provider: "hetzner", env: map[string]string{hetzner.EnvAPIKey: "secret"}},
+		{name: "credentials from a file", provider: "digitalocean", env: map[string]string{digitalocean.EnvAuthToken + "_FILE": tokenFile}},
+		{name: "missing credentials", provider: "hetzner", wantErr: "failed to configure DNS provider 'hetzner'"},
+		{name: "missing credentials of another provider", provider: "digitalocean", env: map[string]string{hetzner.EnvAPIKey: "secret"}, wantErr: digitalocean.EnvAuthToken},
+		{name: "unsupported", provider: "cloudflare", wantErr: "unsupported DNS provider 'cloudflare', expected one of acme-dns, digitalocean"},
+		{name: "empty", provider: "", wantErr: "unsupported DNS provider ''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{hetzner.EnvAPIKey, digitalocean.EnvAuthToken} {
+				t.Setenv(name, tt.env[name])
+				t.Setenv(name+"_FILE", tt.env[name+"_FILE"])
+			}
+			provider, err := newDNSProvider(tt.provider)
+			if tt.wantErr == "" {
+				if err != nil || provider == nil {
+					t.Errorf("newDNSProvider(%q) = %v, %v, want a provider", tt.provider, provider, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newDNSProvider(%q) error = %v, want one containing %q", tt.provider, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSProviders(t *testing.T) {
+	names := DNSProviders()
+	if !slices.IsSorted(names) || len(names) != len(dnsProviders) {
+		t.Errorf("DNSProviders() = %v, want all providers sorted", names)
+	}
+}
+
+func TestClientFor(t *testing.T) {
+	// The clients only read the directory of the CA until they order a certificate.
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"newNonce": "%[1]s/nonce", "newAccount": "%[1]s/account", "newOrder": "%[1]s/order", "revokeCert": "%[1]s/revoke", "keyChange": "%[1]s/key"}`, ca.URL)
+	}))
+	defer ca.Close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{
+		config:     Config{CADirURL: ca.URL},
+		user:       &User{Email: "admin@example.com", privateKey: key},
+		dnsClients: make(map[string]*lego.Client),
+	}
+	if m.client, err = m.newClient(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(hetzner.EnvAPIKey, "secret")
+	t.Setenv(digitalocean.EnvAuthToken, "")
+	t.Setenv(digitalocean.EnvAuthToken+"_FILE", "")
+
+	for _, challenge := range []string{"", ChallengeHTTP01} {
+		if client, err := m.clientFor(&Domain{Name: "example.com", Challenge: challenge}); err != nil || client != m.client {
+			t.Errorf("challenge %q got client %p, %v, want the HTTP-01 client", challenge, client, err)
+		}
+	}
+
+	dns, err := m.clientFor(&Domain{Name: "*.example.com", Challenge: ChallengeDNS01, DNSProvider: "hetzner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dns == m.client {
+		t.Error("dns-01 got the HTTP-01 client")
+	}
+	// Domains with the same provider share its client.
+	if client, err := m.clientFor(&Domain{Name: "*.example.org", Challenge: ChallengeDNS01, DNSProvider: "hetzner"}); err != nil || client != dns {
+		t.Errorf("second hetzner domain got client %p, %v, want %p", client, err, dns)
+	}
+
+	if _, err := m.clientFor(&Domain{Name: "*.example.net", Challenge: ChallengeDNS01, DNSProvider: "digitalocean"}); err == nil || !strings.Contains(err.Error(), digitalocean.EnvAuthToken) {
+		t.Errorf("digitalocean without credentials: %v, want an error naming %s", err, digitalocean.EnvAuthToken)
+	}
+	if _, ok := m.dnsClients["digitalocean"]; ok {
+		t.Error("the digitalocean client without credentials was kept")
+	}
+}
@@ -1,22 +1,23 @@
 package certificates
 
 import (
+	"reflect"
 	"sync"
 )
 
 // DomainProvider is an interface for getting domains from container configurations
 type DomainProvider interface {
-	// GetAllDomains returns all domains currently in use
-	GetAllDomains() map[string][]string // domain -> aliases
+	// GetAllDomains returns all domains currently in use, by name
+	GetAllDomains() map[string]Domain
 }
 
 // DomainWatcher watches for domain changes and updates the certificate manager
 type DomainWatcher struct {
 	manager  *Manager
 	provider DomainProvider
-	
+
 	// For tracking domains we've already processed
-	knownDomains map[string]struct{}
+	knownDomains map[string]Domain
 	domainMutex  sync.Mutex
 }
 
@@ -25,7 +26,7 @@ func NewDomainWatcher(manager *Manager, provider DomainProvider) *DomainWatcher
 	return &DomainWatcher{
 		manager:      manager,
 		provider:     provider,
-		knownDomains: make(map[string]struct{}),
+		knownDomains: make(map[string]Domain),
 	}
 }
 
@@ -33,38 +34,36 @@ func NewDomainWatcher(manager *Manager, provider DomainProvider) *DomainWatcher
 func (dw *DomainWatcher) SyncDomains() {
 	dw.domainMutex.Lock()
 	defer dw.domainMutex.Unlock()
-	
+
 	// Get all domains from the provider
 	domains := dw.provider.GetAllDomains()
-	
-	// Track domains we've seen in this cycle
-	seenDomains := make(map[string]struct{})
-	
+
 	// Add new domains to the certificate manager
-	for domainName, aliases := range domains {
-		seenDomains[domainName] = struct{}{}
-		
+	for domainName, domain := range domains {
 		// Skip if we already know about this domain
-		if _, exists := dw.knownDomains[domainName]; exists {
+		known, exists := dw.knownDomains[domainName]
+		if exists && reflect.DeepEqual(known, domain) {
 			continue
 		}
-		
+		if exists {
+			// The aliases or the challenge changed
+			dw.manager.RemoveDomain(domainName)
+		}
+
 		// Add domain to certificate manager
-		dw.manager.AddDomain(&Domain{
-			Name:    domainName,
-			Aliases: aliases,
-		})
-		
+		dw.manager.AddDomain(&domain)
+
 		// Mark as known
-		dw.knownDomains[domainName] = struct{}{}
+		dw.knownDomains[domainName] = domain
 	}
-	
+
 	// Remove domains that are no longer in use
 	for domainName := range dw.knownDomains {
-		if _, exists := seenDomains[domainName]; !exists {
+		if _, exists := domains[domainName]; !exists {
 			// Domain is no longer in use
 			dw.manager.RemoveDomain(domainName)
 			delete(dw.knownDomains, domainName)
 		}
 	}
-}
\ No newline at end of file
+	dw.manager.markSynced()
+}
@@ -0,0 +1,343 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+var (
+	// ErrCertificateNotFound is returned for a domain without a certificate in CertDir
+	ErrCertificateNotFound = errors.New("certificate not found")
+	// ErrDomainNotManaged is returned for a domain no running app uses
+	ErrDomainNotManaged = errors.New("no running app uses this domain")
+	// ErrNotSynced is returned by Prune before the manager knows which domains are in use
+	ErrNotSynced = errors.New("the certificate manager hasn't seen the domains of the running apps yet, try again in a moment")
+)
+
+// CertificateInfo describes a certificate in CertDir
+type CertificateInfo struct {
+	Domain    string    `json:"domain"`
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// Served is whether a running app uses the domain
+	Served bool `json:"served"`
+
+	// Renewal state, see certState
+	Mode      string    `json:"mode"`
+	RenewAt   time.Time `json:"renewAt,omitempty"`
+	ARI       bool      `json:"ari,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+	RetryAt   time.Time `json:"retryAt,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+
+	// Chain is the leaf followed by the intermediates. Only set by Certificate.
+	Chain []ChainCertificate `json:"chain,omitempty"`
+}
+
+// ChainCertificate describes one certificate of a chain
+type ChainCertificate struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	Serial             string    `json:"serial"`
+	Names              []string  `json:"names,omitempty"`
+	NotBefore          time.Time `json:"notBefore"`
+	NotAfter           time.Time `json:"notAfter"`
+	KeyAlgorithm       string    `json:"keyAlgorithm"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	IsCA               bool      `json:"isCA"`
+}
+
+// Certificates returns the certificates in CertDir, sorted by domain
+func (m *Manager) Certificates() ([]CertificateInfo, error) {
+	files, err := filepath.Glob(filepath.Join(m.config.CertDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]CertificateInfo, 0, len(files))
+	for _, file := range files {
+		info, err := m.certificateInfo(domainName(filepath.Base(file)), false)
+		if err != nil {
+			m.logger.Warnf("Skipping %s: %v", file, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Domain < infos[j].Domain })
+	return infos, nil
+}
+
+// Certificate returns a domain's certificate with its chain
+func (m *Manager) Certificate(domain string) (CertificateInfo, error) {
+	return m.certificateInfo(domain, true)
+}
+
+// Renew checks the domain's certificate for renewal right away, without waiting for a failed
+// order's backoff. With force it is renewed even when it isn't due. It reports whether a new
+// certificate was issued.
+func (m *Manager) Renew(name string, force bool) (bool, error) {
+	domain := m.domain(name)
+	if domain == nil {
+		return false, ErrDomainNotManaged
+	}
+
+	m.orderMutex.Lock()
+	defer m.orderMutex.Unlock()
+
+	_, before, _ := m.loadLeaf(name)
+	m.stateMutex.Lock()
+	st := m.state.certificate(name)
+	st.RetryAt = time.Time{}
+	st.NextCheck = time.Time{}
+	m.stateMutex.Unlock()
+	if _, err := m.checkRenewal(domain, time.Now(), force); err != nil {
+		return false, err
+	}
+
+	_, after, _ := m.loadLeaf(name)
+	return after != nil && (before == nil || !before.Equal(after)), nil
+}
+
+// Revoke revokes the domain's certificate and deletes it. A domain that is still served gets
+// a new certificate right away.
+func (m *Manager) Revoke(name string) error {
+	m.orderMutex.Lock()
+	defer m.orderMutex.Unlock()
+
+	certPEM, _, err := m.loadLeaf(name)
+	if os.IsNotExist(err) {
+		return ErrCertificateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	m.stateMutex.Lock()
+	mode := ModeACME
+	if st, ok := m.state.Certificates[name]; ok {
+		mode = st.mode()
+	}
+	m.stateMutex.Unlock()
+	if mode != ModeACME {
+		return fmt.Errorf("only certificates from the ACME CA can be revoked, the one for %s is %s", name, mode)
+	}
+	client, err := m.acmeClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Certificate.Revoke(certPEM); err != nil {
+		return fmt.Errorf("failed to revoke certificate for %s: %w", name, err)
+	}
+	m.logger.Infof("Revoked certificate for %s", name)
+
+	if domain := m.domain(name); domain != nil {
+		// HAProxy serves the revoked certificate until the new one replaces it
+		m.stateMutex.Lock()
+		delete(m.state.Certificates, name)
+		m.stateMutex.Unlock()
+		if err := m.deleteCertificateFiles(name); err != nil {
+			return err
+		}
+		if _, err := m.checkRenewal(domain, time.Now(), true); err != nil {
+			return fmt.Errorf("revoked certificate for %s, but failed to get a new one: %w", name, err)
+		}
+		return nil
+	}
+	return m.removeCertificate(name)
+}
+
+// Prune deletes the certificates of domains no running app uses, and stops HAProxy from
+// serving them. Only the domains in only are considered, unless it is nil. It returns the
+// removed domains. Right after a start every certificate looks unused, so it refuses to run
+// until the domains of the running apps were synced.
+func (m *Manager) Prune(only []string) ([]string, error) {
+	m.domainMutex.RLock()
+	synced := m.synced
+	m.domainMutex.RUnlock()
+	if !synced {
+		return nil, ErrNotSynced
+	}
+
+	infos, err := m.Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	m.orderMutex.Lock()
+	defer m.orderMutex.Unlock()
+
+	var removed []string
+	for _, info := range infos {
+		if only != nil && !slices.Contains(only, info.Domain) {
+			continue
+		}
+		// A domain can have come back since the list was made
+		if m.domain(info.Domain) != nil {
+			continue
+		}
+		if err := m.removeCertificate(info.Domain); err != nil {
+			return removed, err
+		}
+		m.logger.Infof("Removed certificate for %s, which is no longer served", info.Domain)
+		removed = append(removed, info.Domain)
+	}
+	return removed, nil
+}
+
+// removeCertificate stops serving a domain's certificate, and deletes it and its renewal
+// state. The caller holds orderMutex.
+func (m *Manager) removeCertificate(domain string) error {
+	// Delete the files first, so a reload doesn't load them again
+	if err := m.deleteCertificateFiles(domain); err != nil {
+		return err
+	}
+	m.unloadCertificate(domain)
+
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+	delete(m.state.Certificates, domain)
+	if err := m.state.save(); err != nil {
+		return fmt.Errorf("failed to save renewal state: %w", err)
+	}
+	return nil
+}
+
+// deleteCertificateFiles deletes the files saveCertificate writes
+func (m *Manager) deleteCertificateFiles(domain string) error {
+	for _, ext := range []string{".crt", ".key", ".crt.key"} {
+		err := os.Remove(filepath.Join(m.config.CertDir, fileName(domain)+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete certificate for %s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// unloadCertificate removes a deleted certificate from HAProxy. It goes through the runtime
+// API, and falls back to a graceful reload like loadCertificate.
+func (m *Manager) unloadCertificate(domain string) {
+	if m.runtime != nil {
+		err := m.hotUnloadCertificate(domain)
+		if err == nil {
+			return
+		}
+		m.logger.Warnf("Failed to remove certificate for %s through the HAProxy runtime API, reloading: %v", domain, err)
+	}
+
+	if m.config.Reload != nil {
+		if err := m.config.Reload(m.ctx); err != nil {
+			m.logger.Errorf("Failed to reload HAProxy after deleting the certificate for %s: %v", domain, err)
+		}
+	}
+}
+
+// hotUnloadCertificate removes the certificate from the crt-list of the certificate directory
+func (m *Manager) hotUnloadCertificate(domain string) error {
+	m.runtimeMutex.Lock()
+	defer m.runtimeMutex.Unlock()
+
+	name := path.Join(m.config.HAProxyCertDir, fileName(domain)+".crt")
+	loaded, err := m.runtime.Certificates(m.ctx)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(loaded, name) {
+		return nil
+	}
+	crtList, err := m.certDirCrtList()
+	if err != nil {
+		return err
+	}
+	return m.runtime.RemoveCertificate(m.ctx, crtList, name)
+}
+
+// certificateInfo reads a domain's certificate, and its chain if asked
+func (m *Manager) certificateInfo(domain string, chain bool) (CertificateInfo, error) {
+	bundle, err := os.ReadFile(filepath.Join(m.config.CertDir, fileName(domain)+".crt"))
+	if os.IsNotExist(err) {
+		return CertificateInfo{}, ErrCertificateNotFound
+	}
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	certs, err := certcrypto.ParsePEMBundle(bundle)
+	if err != nil {
+		return CertificateInfo{}, fmt.Errorf("failed to parse certificate for %s: %w", domain, err)
+	}
+	leaf := certs[0]
+
+	info := CertificateInfo{
+		Domain:    domain,
+		Names:     certcrypto.ExtractDomains(leaf),
+		Issuer:    issuerName(leaf),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		Served:    m.domain(domain) != nil,
+		Mode:      ModeACME,
+	}
+	if chain {
+		for _, cert := range certs {
+			info.Chain = append(info.Chain, ChainCertificate{
+				Subject:            cert.Subject.String(),
+				Issuer:             cert.Issuer.String(),
+				Serial:             hex.EncodeToString(cert.SerialNumber.Bytes()),
+				Names:              cert.DNSNames,
+				NotBefore:          cert.NotBefore,
+				NotAfter:           cert.NotAfter,
+				KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+				SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+				IsCA:               cert.IsCA,
+			})
+		}
+	}
+
+	m.stateMutex.Lock()
+	if st, ok := m.state.Certificates[domain]; ok {
+		info.Mode = st.mode()
+		info.RenewAt = st.RenewAt
+		info.ARI = st.ARI
+		info.Failures = st.Failures
+		info.RetryAt = st.RetryAt
+		info.LastError = st.LastError
+	}
+	m.stateMutex.Unlock()
+	return info, nil
+}
+
+// domain returns the managed domain with the name, or nil
+func (m *Manager) domain(name string) *Domain {
+	m.domainMutex.RLock()
+	defer m.domainMutex.RUnlock()
+	return m.domains[name]
+}
+
+// domainName is the reverse of fileName for a certificate file
+func domainName(file string) string {
+	name := strings.TrimSuffix(file, ".crt")
+	if strings.HasPrefix(name, "_.") {
+		return "*" + name[1:]
+	}
+	return name
+}
+
+// issuerName is the organization and common name of the certificate's issuer
+func issuerName(cert *x509.Certificate) string {
+	var parts []string
+	parts = append(parts, cert.Issuer.Organization...)
+	if cert.Issuer.CommonName != "" {
+		parts = append(parts, cert.Issuer.CommonName)
+	}
+	return strings.Join(parts, " ")
+}
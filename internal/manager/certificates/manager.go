@@ -5,12 +5,18 @@ import (
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ameistad/turkis/internal/haproxy"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/http01"
 	"github.com/go-acme/lego/v4/lego"
@@ -29,32 +35,102 @@ type Config struct {
 	// Directory for HTTP-01 challenge responses
 	WebRootDir string
 
-	// HAProxy socket path for notifications
+	// HAProxy socket path for loading new certificates without a reload
 	HAProxySocket string
 
+	// Directory HAProxy loads the certificates in CertDir from
+	HAProxyCertDir string
+
 	// Logger
 	Logger *logrus.Logger
 
 	// Staging mode for testing
 	TlsStaging bool
+
+	// ACME directory URL of the CA. Overrides TlsStaging, empty means Let's Encrypt
+	CADirURL string
+
+	// External Account Binding, required by CAs like ZeroSSL and Google Trust Services
+	EABKeyID   string
+	EABHMACKey string // base64url encoded
+
+	// PEM file with the CAs to trust for the ACME server, e.g. for step-ca or Pebble
+	CABundle string
+
+	// Common name of the root to prefer when the CA offers more than one chain
+	PreferredChain string
+
+	// How often to ask the CA when to renew a certificate, unless it says when to ask again.
+	// Defaults to 24 hours.
+	RenewalInterval time.Duration
+
+	// Called when a new certificate couldn't be loaded through the HAProxy socket
+	Reload func(ctx context.Context) error
 }
 
 // Domain represents a domain for which we need a certificate
 type Domain struct {
 	Name    string   // Primary domain name
 	Aliases []string // Alternative domain names
+
+	// Challenge is ChallengeHTTP01 or ChallengeDNS01. Empty means ChallengeHTTP01.
+	Challenge string
+	// DNSProvider is the lego DNS provider that solves dns-01 challenges
+	DNSProvider string
+
+	// Mode is where the certificate comes from: ModeACME, ModeManual or ModeSelfSigned.
+	// Empty means ModeACME.
+	Mode string
+	// CertFile and KeyFile are the PEM files of a ModeManual certificate
+	CertFile string
+	KeyFile  string
 }
 
+const (
+	// ModeACME obtains certificates from the ACME CA
+	ModeACME = "acme"
+	// ModeManual serves a certificate and key provided by the user
+	ModeManual = "manual"
+	// ModeSelfSigned issues certificates from a CA kept in CertDir
+	ModeSelfSigned = "self-signed"
+)
+
 // Manager handles TLS certificate operations
 type Manager struct {
 	config Config
 	logger *logrus.Logger
 	user   *User
-	client *lego.Client
+
+	// client is created and the account registered when the first ACME certificate is ordered
+	client      *lego.Client
+	clientMutex sync.Mutex
+
+	// dnsClients solve dns-01 challenges, by DNS provider
+	dnsClients map[string]*lego.Client
+	dnsMutex   sync.Mutex
+
+	// runtime loads new certificates into HAProxy. nil without HAProxySocket.
+	runtime      *haproxy.RuntimeClient
+	runtimeMutex sync.Mutex
 
 	// Map of domains to certificate info
 	domains     map[string]*Domain
 	domainMutex sync.RWMutex
+	// synced is set once the domains of the running apps were added. Until then every
+	// certificate looks unused.
+	synced bool
+
+	// orderMutex makes orders, revocations and removals happen one at a time. An order can
+	// take minutes, so it doesn't hold stateMutex while it waits for the CA.
+	orderMutex sync.Mutex
+	// state is when to renew each certificate and what was issued recently, saved in CertDir.
+	// stateMutex is only held while it is read or updated.
+	state      *renewalState
+	stateMutex sync.Mutex
+	// ca issues ModeSelfSigned certificates. Loaded on first use, guarded by orderMutex.
+	ca *localCA
+	// wake makes the renewal loop check the domains right away
+	wake chan struct{}
 
 	// Context for cancellation
 	ctx    context.Context
@@ -88,6 +164,12 @@ func NewManager(cfg Config) (*Manager, error) {
 	if cfg.Logger == nil {
 		cfg.Logger = logrus.New()
 	}
+	if (cfg.EABKeyID == "") != (cfg.EABHMACKey == "") {
+		return nil, fmt.Errorf("external account binding needs both a key ID and an HMAC key, set ACME_EAB_HMAC_KEY or ACME_EAB_HMAC_KEY_FILE")
+	}
+	if cfg.RenewalInterval == 0 {
+		cfg.RenewalInterval = 24 * time.Hour
+	}
 
 	// Create directories if they don't exist
 	if err := os.MkdirAll(cfg.CertDir, 0755); err != nil {
@@ -105,10 +187,20 @@ func NewManager(cfg Config) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create key manager: %w", err)
 	}
 
-	// Load or create user key
-	privateKey, err := keyManager.LoadOrCreateKey(cfg.Email)
+	// Load or create user key. Without an email only certificates that don't come from ACME
+	// can be issued.
+	var privateKey crypto.PrivateKey
+	if cfg.Email != "" {
+		privateKey, err = keyManager.LoadOrCreateKey(cfg.Email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load/create user key: %w", err)
+		}
+	}
+
+	// Load when certificates are due and how recent orders went
+	state, err := loadRenewalState(filepath.Join(cfg.CertDir, "state", "renewals.json"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to load/create user key: %w", err)
+		return nil, err
 	}
 
 	user := &User{
@@ -123,61 +215,146 @@ func NewManager(cfg Config) (*Manager, error) {
 		logger:  cfg.Logger,
 		user:    user,
 		domains: make(map[string]*Domain),
+		state:   state,
+		wake:    make(chan struct{}, 1),
 		ctx:     ctx,
 		cancel:  cancel,
+
+		dnsClients: make(map[string]*lego.Client),
+	}
+	if cfg.HAProxySocket != "" {
+		m.runtime = haproxy.NewRuntimeClient(cfg.HAProxySocket)
 	}
 
-	// Initialize Lego client
+	return m, nil
+}
+
+// acmeClient returns the client for http-01 challenges. The account is registered with the
+// CA the first time, so domains that don't use ACME work without a CA or an email.
+func (m *Manager) acmeClient() (*lego.Client, error) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.client != nil {
+		return m.client, nil
+	}
+	if m.config.Email == "" {
+		return nil, errors.New("ACME certificates need an acmeEmail")
+	}
 	if err := m.initClient(); err != nil {
-		cancel()
 		return nil, err
 	}
-
-	return m, nil
+	if err := m.register(); err != nil {
+		m.client = nil
+		return nil, err
+	}
+	return m.client, nil
 }
 
 // initClient initializes the ACME client
 func (m *Manager) initClient() error {
+	client, err := m.newClient()
+	if err != nil {
+		return err
+	}
+
+	// Configure HTTP challenge provider using a server that listens on port 8080
+	// HAProxy is configured to forward /.well-known/acme-challenge/* requests to this server
+	httpProvider := http01.NewProviderServer("", "8080")
+	err = client.Challenge.SetHTTP01Provider(httpProvider)
+	if err != nil {
+		return fmt.Errorf("failed to set HTTP challenge provider: %w", err)
+	}
+
+	m.client = client
+	return nil
+}
+
+// newClient creates a Lego client for the account, without challenge providers
+func (m *Manager) newClient() (*lego.Client, error) {
 	// Create Lego config
 	config := lego.NewConfig(m.user)
 
-	// Use staging server if in staging mode
-	if m.config.TlsStaging {
+	// Pick the CA, Let's Encrypt unless configured otherwise
+	switch {
+	case m.config.CADirURL != "":
+		config.CADirURL = m.config.CADirURL
+	case m.config.TlsStaging:
 		config.CADirURL = lego.LEDirectoryStaging
-	} else {
+	default:
 		config.CADirURL = lego.LEDirectoryProduction
 	}
 
+	if m.config.CABundle != "" {
+		transport, err := withCABundle(config.HTTPClient.Transport, m.config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		config.HTTPClient.Transport = transport
+	}
+
 	// Create client
 	client, err := lego.NewClient(config)
 	if err != nil {
-		return fmt.Errorf("failed to create lego client: %w", err)
+		return nil, fmt.Errorf("failed to create lego client: %w", err)
 	}
+	return client, nil
+}
 
-	// Configure HTTP challenge provider using a server that listens on port 8080
-	// HAProxy is configured to forward /.well-known/acme-challenge/* requests to this server
-	httpProvider := http01.NewProviderServer("", "8080")
-	err = client.Challenge.SetHTTP01Provider(httpProvider)
-	if err != nil {
-		return fmt.Errorf("failed to set HTTP challenge provider: %w", err)
+// clientFor returns the client that solves the domain's challenge. Lego picks any challenge
+// it has a provider for, so each DNS provider gets a client of its own.
+func (m *Manager) clientFor(domain *Domain) (*lego.Client, error) {
+	client, err := m.acmeClient()
+	if err != nil || domain.Challenge != ChallengeDNS01 {
+		return client, err
 	}
 
-	m.client = client
-	return nil
+	m.dnsMutex.Lock()
+	defer m.dnsMutex.Unlock()
+
+	if client, ok := m.dnsClients[domain.DNSProvider]; ok {
+		return client, nil
+	}
+	provider, err := newDNSProvider(domain.DNSProvider)
+	if err != nil {
+		return nil, err
+	}
+	client, err = m.newClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Challenge.SetDNS01Provider(provider); err != nil {
+		return nil, fmt.Errorf("failed to set DNS challenge provider: %w", err)
+	}
+	m.dnsClients[domain.DNSProvider] = client
+	return client, nil
 }
 
 // Start begins the certificate manager operation
 func (m *Manager) Start() error {
-	// Register user account with Let's Encrypt
-	reg, err := m.client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	// Start goroutine for certificate renewal checks
+	go m.renewalLoop()
+
+	return nil
+}
+
+// register registers the user account with the CA
+func (m *Manager) register() error {
+	var reg *registration.Resource
+	var err error
+	if m.config.EABKeyID != "" {
+		reg, err = m.client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  m.config.EABKeyID,
+			HmacEncoded:          m.config.EABHMACKey,
+		})
+	} else {
+		reg, err = m.client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
 	if err != nil {
 		return fmt.Errorf("failed to register account: %w", err)
 	}
 	m.user.Registration = reg
-
-	// Start goroutine for certificate renewal checks
-	go m.renewalLoop()
-
 	return nil
 }
 
@@ -186,134 +363,157 @@ func (m *Manager) Stop() {
 	m.cancel()
 }
 
-// renewalLoop periodically checks for certificates that need renewal
+// renewalLoop obtains and renews certificates when they are due, and right away when a
+// domain is added
 func (m *Manager) renewalLoop() {
-	ticker := time.NewTicker(24 * time.Hour)
+	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
 
-	// Do an initial check
-	m.checkRenewals()
-
 	for {
+		m.checkRenewals()
+
 		select {
 		case <-ticker.C:
-			m.checkRenewals()
+		case <-m.wake:
 		case <-m.ctx.Done():
 			return
 		}
 	}
 }
 
-// checkRenewals checks all managed domains for certificate renewal
-func (m *Manager) checkRenewals() {
-	m.domainMutex.RLock()
-	domains := make([]*Domain, 0, len(m.domains))
-	for _, domain := range m.domains {
-		domains = append(domains, domain)
-	}
-	m.domainMutex.RUnlock()
-
-	for _, domain := range domains {
-		// Check if certificate exists and needs renewal
-		certFile := filepath.Join(m.config.CertDir, domain.Name+".crt")
-		if _, err := os.Stat(certFile); os.IsNotExist(err) {
-			// Certificate doesn't exist, obtain it
-			m.logger.Infof("Certificate for %s doesn't exist, obtaining new certificate", domain.Name)
-			m.obtainCertificate(domain)
-			continue
-		}
+// obtainCertificate requests a new certificate for the domain
+func (m *Manager) obtainCertificate(domain *Domain) (*certificate.Resource, error) {
+	m.logger.Infof("Obtaining certificate for domains: %v", domain.names())
 
-		// Load cert to check expiry
-		cert, err := tls.LoadX509KeyPair(
-			filepath.Join(m.config.CertDir, domain.Name+".crt"),
-			filepath.Join(m.config.CertDir, domain.Name+".key"),
-		)
-		if err != nil {
-			m.logger.Errorf("Failed to load certificate for %s: %v", domain.Name, err)
-			continue
-		}
+	client, err := m.clientFor(domain)
+	if err != nil {
+		return nil, err
+	}
 
-		// Check if certificate is about to expire (30 days threshold)
-		if len(cert.Certificate) == 0 {
-			m.logger.Errorf("Invalid certificate for %s", domain.Name)
-			continue
-		}
+	return client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains:        domain.names(),
+		Bundle:         true,
+		PreferredChain: m.config.PreferredChain,
+	})
+}
 
-		parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			m.logger.Errorf("Failed to parse certificate for %s: %v", domain.Name, err)
-			continue
+// loadCertificate makes HAProxy serve a saved certificate. It goes through the runtime API
+// so no connection is dropped, and falls back to a graceful reload.
+func (m *Manager) loadCertificate(domain string, pem []byte) {
+	if m.runtime != nil {
+		err := m.hotLoadCertificate(domain, pem)
+		if err == nil {
+			m.logger.Infof("Loaded certificate for %s through the HAProxy runtime API", domain)
+			return
 		}
+		m.logger.Warnf("Failed to load certificate for %s through the HAProxy runtime API, reloading: %v", domain, err)
+	}
 
-		// Renew if certificate expires in less than 30 days
-		if time.Until(parsedCert.NotAfter) < 30*24*time.Hour {
-			m.logger.Infof("Certificate for %s expires soon, renewing", domain.Name)
-			m.renewCertificate(domain)
+	if m.config.Reload != nil {
+		if err := m.config.Reload(m.ctx); err != nil {
+			m.logger.Errorf("Failed to reload HAProxy after saving the certificate for %s: %v", domain, err)
 		}
 	}
 }
 
-// obtainCertificate requests a new certificate for the domain
-func (m *Manager) obtainCertificate(domain *Domain) {
-	// Prepare domains list (main domain + aliases)
-	domains := []string{domain.Name}
-	domains = append(domains, domain.Aliases...)
+// hotLoadCertificate replaces the certificate if HAProxy has loaded it, and adds it to the
+// certificate directory of the bind line otherwise.
+func (m *Manager) hotLoadCertificate(domain string, pem []byte) error {
+	// HAProxy runs one certificate transaction at a time.
+	m.runtimeMutex.Lock()
+	defer m.runtimeMutex.Unlock()
 
-	m.logger.Infof("Obtaining certificate for domains: %v", domains)
+	// The name HAProxy gives the file when it loads the directory, so a reload finds the same one.
+	name := path.Join(m.config.HAProxyCertDir, fileName(domain)+".crt")
+	loaded, err := m.runtime.Certificates(m.ctx)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(loaded, name) {
+		return m.runtime.SetCertificate(m.ctx, name, string(pem))
+	}
 
-	// Request certificate
-	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+	crtList, err := m.certDirCrtList()
+	if err != nil {
+		return err
 	}
+	return m.runtime.AddCertificate(m.ctx, crtList, name, string(pem))
+}
 
-	certificates, err := m.client.Certificate.Obtain(request)
+// certDirCrtList returns the crt-list HAProxy made for the certificate directory of the bind line
+func (m *Manager) certDirCrtList() (string, error) {
+	crtLists, err := m.runtime.CrtLists(m.ctx)
 	if err != nil {
-		m.logger.Errorf("Failed to obtain certificate for %s: %v", domain.Name, err)
-		return
+		return "", err
+	}
+	for _, crtList := range crtLists {
+		if strings.TrimSuffix(crtList, "/") == strings.TrimSuffix(m.config.HAProxyCertDir, "/") {
+			return crtList, nil
+		}
+	}
+	return "", fmt.Errorf("no bind line loads certificates from %s", m.config.HAProxyCertDir)
+}
+
+// withCABundle returns a copy of transport that trusts the CAs in the PEM file at path
+// instead of the system roots
+func withCABundle(transport http.RoundTripper, path string) (http.RoundTripper, error) {
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unexpected HTTP transport %T", transport)
 	}
 
-	// Save the certificate
-	err = m.saveCertificate(domain.Name, certificates)
+	bundle, err := os.ReadFile(path)
 	if err != nil {
-		m.logger.Errorf("Failed to save certificate for %s: %v", domain.Name, err)
-		return
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
 	}
 
-	// TODO: Reload haproxy somehow here.
+	httpTransport = httpTransport.Clone()
+	if httpTransport.TLSClientConfig == nil {
+		httpTransport.TLSClientConfig = &tls.Config{}
+	}
+	httpTransport.TLSClientConfig.RootCAs = pool
+	return httpTransport, nil
 }
 
-// renewCertificate renews an existing certificate
-func (m *Manager) renewCertificate(domain *Domain) {
-	// Implementation similar to obtainCertificate but using Renew instead of Obtain
-	// For now, we'll just reuse obtain since the Lego client handles both cases
-	m.obtainCertificate(domain)
+// fileName is the base name of a domain's certificate files. A wildcard becomes _, which
+// can't be part of a domain name.
+func fileName(domain string) string {
+	return strings.ReplaceAll(domain, "*", "_")
 }
 
-// saveCertificate saves the certificate files to disk
-func (m *Manager) saveCertificate(domain string, cert *certificate.Resource) error {
+// saveCertificate saves the certificate files to disk and returns the combined PEM for HAProxy
+func (m *Manager) saveCertificate(domain string, cert *certificate.Resource) ([]byte, error) {
 	// Save certificate
-	certPath := filepath.Join(m.config.CertDir, domain+".crt")
+	certPath := filepath.Join(m.config.CertDir, fileName(domain)+".crt")
 	if err := os.WriteFile(certPath, cert.Certificate, 0644); err != nil {
-		return fmt.Errorf("failed to save certificate: %w", err)
+		return nil, fmt.Errorf("failed to save certificate: %w", err)
 	}
 
 	// Save private key
-	keyPath := filepath.Join(m.config.CertDir, domain+".key")
+	keyPath := filepath.Join(m.config.CertDir, fileName(domain)+".key")
 	if err := os.WriteFile(keyPath, cert.PrivateKey, 0600); err != nil {
-		return fmt.Errorf("failed to save private key: %w", err)
+		return nil, fmt.Errorf("failed to save private key: %w", err)
 	}
 
 	// Create combined file for HAProxy (concatenate cert and key)
-	combinedPath := filepath.Join(m.config.CertDir, domain+".crt.key")
-	pemContent := append(cert.Certificate, '\n')
-	pemContent = append(pemContent, cert.PrivateKey...)
+	combinedPath := filepath.Join(m.config.CertDir, fileName(domain)+".crt.key")
+	pemContent := combinedPEM(cert)
 
 	if err := os.WriteFile(combinedPath, pemContent, 0600); err != nil {
-		return fmt.Errorf("failed to save combined certificate: %w", err)
+		return nil, fmt.Errorf("failed to save combined certificate: %w", err)
 	}
 
-	return nil
+	return pemContent, nil
+}
+
+// combinedPEM is the certificate followed by its key, the way HAProxy loads them
+func combinedPEM(cert *certificate.Resource) []byte {
+	pemContent := append(slices.Clone(cert.Certificate), '\n')
+	return append(pemContent, cert.PrivateKey...)
 }
 
 // AddDomain adds a domain to be managed for certificates
@@ -328,15 +528,18 @@ func (m *Manager) AddDomain(domain *Domain) {
 
 	m.domains[domain.Name] = domain
 
-	// Start a goroutine to obtain certificate if needed
-	go func() {
-		// Check if certificate exists
-		certFile := filepath.Join(m.config.CertDir, domain.Name+".crt")
-		if _, err := os.Stat(certFile); os.IsNotExist(err) {
-			// Certificate doesn't exist, obtain it
-			m.obtainCertificate(domain)
-		}
-	}()
+	// Let the renewal loop obtain a certificate if it needs one
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markSynced records that the domains of the running apps were added.
+func (m *Manager) markSynced() {
+	m.domainMutex.Lock()
+	defer m.domainMutex.Unlock()
+	m.synced = true
 }
 
 // RemoveDomain removes a domain from being managed
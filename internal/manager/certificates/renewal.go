@@ -0,0 +1,535 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// checkInterval is how often the renewal loop looks for certificates that are due
+	checkInterval = time.Minute
+
+	// Exponential backoff after a failed order, with jitter
+	retryBaseDelay = 5 * time.Minute
+	retryMaxDelay  = 24 * time.Hour
+
+	// Let's Encrypt's rate limits: new certificates per registered domain, and certificates
+	// for the same set of names, within a sliding window
+	rateLimitWindow       = 7 * 24 * time.Hour
+	certificatesPerDomain = 50
+	duplicateCertificates = 5
+)
+
+// certState is what the manager knows about a domain's certificate. It is persisted so a
+// restart neither forgets failures nor renews everything at once.
+type certState struct {
+	CertURL       string `json:"certUrl,omitempty"`
+	CertStableURL string `json:"certStableUrl,omitempty"`
+
+	// RenewAt is when the certificate is renewed: a random time within the ARI window, or two
+	// thirds through its lifetime when the CA has no renewal information
+	RenewAt time.Time `json:"renewAt"`
+	// Mode is where the certificate came from, ModeACME when empty
+	Mode string `json:"mode,omitempty"`
+	// ARI is whether the CA has renewal information for the certificate
+	ARI bool `json:"ari,omitempty"`
+	// WindowStart and WindowEnd are the ARI window RenewAt was picked from
+	WindowStart time.Time `json:"windowStart,omitempty"`
+	WindowEnd   time.Time `json:"windowEnd,omitempty"`
+	// NextCheck is when to ask the CA for renewal information again
+	NextCheck time.Time `json:"nextCheck"`
+
+	// Failures is the number of failed orders since the last certificate was issued
+	Failures  int       `json:"failures,omitempty"`
+	RetryAt   time.Time `json:"retryAt,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// issuance is a certificate that was issued, kept for the rate limits
+type issuance struct {
+	Names    []string  `json:"names"`
+	IssuedAt time.Time `json:"issuedAt"`
+	// Renewal means it replaced a certificate for the same names, which doesn't count
+	// against the limit per registered domain
+	Renewal bool `json:"renewal,omitempty"`
+}
+
+// renewalState is stored in the state directory of CertDir. Not in CertDir itself, since
+// HAProxy loads every file there as a certificate.
+type renewalState struct {
+	path string
+
+	Certificates map[string]*certState `json:"certificates"`
+	Issuances    []issuance            `json:"issuances"`
+}
+
+// loadRenewalState reads the state file, or starts empty when there is none
+func loadRenewalState(path string) (*renewalState, error) {
+	state := &renewalState{path: path, Certificates: make(map[string]*certState)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read renewal state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse renewal state %s: %w", path, err)
+	}
+	if state.Certificates == nil {
+		state.Certificates = make(map[string]*certState)
+	}
+	return state, nil
+}
+
+// save writes the state atomically
+func (s *renewalState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// certificate returns the state of a domain's certificate, creating it if needed
+func (s *renewalState) certificate(domain string) *certState {
+	st, ok := s.Certificates[domain]
+	if !ok {
+		st = &certState{}
+		s.Certificates[domain] = st
+	}
+	return st
+}
+
+// record remembers an issued certificate and forgets the ones outside the rate limit window
+func (s *renewalState) record(names []string, now time.Time, renewal bool) {
+	kept := s.Issuances[:0]
+	for _, iss := range s.Issuances {
+		if now.Sub(iss.IssuedAt) < rateLimitWindow {
+			kept = append(kept, iss)
+		}
+	}
+	s.Issuances = append(kept, issuance{Names: sortedNames(names), IssuedAt: now, Renewal: renewal})
+}
+
+// rateLimited reports whether ordering a certificate for names would exceed the CA's rate
+// limits, and when to try again. Renewals through ARI are exempt.
+func (s *renewalState) rateLimited(names []string, now time.Time, renewal, replacement bool) (time.Time, bool) {
+	if replacement {
+		return time.Time{}, false
+	}
+	set := strings.Join(sortedNames(names), ",")
+	registered := make(map[string]bool)
+	for _, name := range names {
+		registered[registeredDomain(name)] = true
+	}
+
+	var duplicates, perDomain []time.Time
+	for _, iss := range s.Issuances {
+		if now.Sub(iss.IssuedAt) >= rateLimitWindow {
+			continue
+		}
+		if strings.Join(iss.Names, ",") == set {
+			duplicates = append(duplicates, iss.IssuedAt)
+		}
+		if iss.Renewal || renewal {
+			continue
+		}
+		for _, name := range iss.Names {
+			if registered[registeredDomain(name)] {
+				perDomain = append(perDomain, iss.IssuedAt)
+				break
+			}
+		}
+	}
+
+	if len(duplicates) >= duplicateCertificates {
+		return earliest(duplicates).Add(rateLimitWindow), true
+	}
+	if len(perDomain) >= certificatesPerDomain {
+		return earliest(perDomain).Add(rateLimitWindow), true
+	}
+	return time.Time{}, false
+}
+
+// checkRenewals obtains missing certificates and renews the ones that are due
+func (m *Manager) checkRenewals() {
+	m.domainMutex.RLock()
+	domains := make([]*Domain, 0, len(m.domains))
+	for _, domain := range m.domains {
+		domains = append(domains, domain)
+	}
+	m.domainMutex.RUnlock()
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+
+	for _, domain := range domains {
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.orderMutex.Lock()
+		m.checkRenewal(domain, time.Now(), false)
+		m.orderMutex.Unlock()
+	}
+}
+
+// checkRenewal obtains or renews the domain's certificate when it is due, or right away with
+// force, and saves the state when it changed. It reports whether it did, and why an order
+// failed. The caller holds orderMutex.
+func (m *Manager) checkRenewal(domain *Domain, now time.Time, force bool) (bool, error) {
+	// Orders work on a copy, so the certificates can be listed while the CA is busy.
+	m.stateMutex.Lock()
+	st := *m.state.certificate(domain.Name)
+	m.stateMutex.Unlock()
+
+	changed, err := m.checkCertificate(domain, &st, now, force)
+	if changed {
+		m.stateMutex.Lock()
+		*m.state.certificate(domain.Name) = st
+		if err := m.state.save(); err != nil {
+			m.logger.Errorf("Failed to save renewal state: %v", err)
+		}
+		m.stateMutex.Unlock()
+	}
+	return changed, err
+}
+
+// checkCertificate does the work of checkRenewal on st.
+func (m *Manager) checkCertificate(domain *Domain, st *certState, now time.Time, force bool) (bool, error) {
+	if domain.mode() == ModeManual {
+		return m.checkManualCertificate(domain, st)
+	}
+	if !force && now.Before(st.RetryAt) {
+		return false, nil
+	}
+
+	certPEM, leaf, err := m.loadLeaf(domain.Name)
+	if err != nil || !sameNames(certcrypto.ExtractDomains(leaf), domain.names()) || st.mode() != domain.mode() {
+		// No certificate yet, the aliases changed, or it came from elsewhere
+		return true, m.issue(domain, st, nil, nil, now)
+	}
+
+	changed := false
+	if !now.Before(st.NextCheck) {
+		m.updateRenewalTime(domain, st, leaf, now)
+		changed = true
+	}
+	if !force && now.Before(st.RenewAt) {
+		return changed, nil
+	}
+	return true, m.issue(domain, st, certPEM, leaf, now)
+}
+
+// updateRenewalTime asks the CA when to renew the certificate. Without ARI, and for the local
+// CA, it is renewed two thirds through its lifetime.
+func (m *Manager) updateRenewalTime(domain *Domain, st *certState, leaf *x509.Certificate, now time.Time) {
+	st.NextCheck = now.Add(m.config.RenewalInterval)
+	if domain.mode() == ModeSelfSigned {
+		st.RenewAt = defaultRenewAt(leaf)
+		return
+	}
+
+	client, err := m.acmeClient()
+	var info *certificate.RenewalInfoResponse
+	if err == nil {
+		info, err = client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{Cert: leaf})
+	}
+	if err != nil {
+		if !errors.Is(err, api.ErrNoARI) {
+			m.logger.Warnf("Failed to get renewal information for %s: %v", domain.Name, err)
+		}
+		info = nil
+	}
+
+	picked, err := st.applyRenewalInfo(info, leaf, now)
+	if err != nil {
+		m.logger.Warnf("Ignoring the renewal information for %s: %v", domain.Name, err)
+	}
+	if picked {
+		m.logger.Infof("Certificate for %s will be renewed at %s, within the window suggested by the CA (%s to %s)",
+			domain.Name, st.RenewAt.Format(time.RFC3339), st.WindowStart.Format(time.RFC3339), st.WindowEnd.Format(time.RFC3339))
+	}
+}
+
+// applyRenewalInfo sets when to renew leaf from the CA's renewal information: a random time
+// within the suggested window, or right away once the window has started or passed. Without
+// renewal information, which info is nil for, or with a window that makes no sense, a time
+// picked from an earlier window is kept, or it is renewed two thirds through its lifetime.
+// It reports whether a time was picked from a new window.
+func (s *certState) applyRenewalInfo(info *certificate.RenewalInfoResponse, leaf *x509.Certificate, now time.Time) (bool, error) {
+	var err error
+	if info != nil {
+		if window := info.SuggestedWindow; window.Start.IsZero() || window.End.Before(window.Start) {
+			err = fmt.Errorf("invalid renewal window %s to %s", window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
+			info = nil
+		}
+	}
+	if info == nil {
+		if !s.ARI || s.RenewAt.IsZero() {
+			s.ARI = false
+			s.RenewAt = defaultRenewAt(leaf)
+		}
+		return false, err
+	}
+
+	s.ARI = true
+	if info.RetryAfter > 0 {
+		s.NextCheck = now.Add(info.RetryAfter)
+	}
+	window := info.SuggestedWindow
+	if window.Start.Equal(s.WindowStart) && window.End.Equal(s.WindowEnd) && !s.RenewAt.IsZero() {
+		return false, nil
+	}
+	s.WindowStart, s.WindowEnd = window.Start, window.End
+	// A window that has started is only what's left of it
+	start := window.Start
+	if start.Before(now) {
+		start = now
+	}
+	s.RenewAt = start
+	if span := window.End.Sub(start); span > 0 {
+		s.RenewAt = start.Add(time.Duration(rand.Int63n(int64(span))))
+	}
+	return true, nil
+}
+
+// issue orders a certificate: a renewal of certPEM when it is set, a new one otherwise. A
+// failure is retried with exponential backoff.
+func (m *Manager) issue(domain *Domain, st *certState, certPEM []byte, leaf *x509.Certificate, now time.Time) error {
+	names := domain.names()
+	renewal := leaf != nil
+	acme := domain.mode() == ModeACME
+	m.stateMutex.Lock()
+	until, limited := m.state.rateLimited(names, now, renewal, renewal && st.ARI)
+	m.stateMutex.Unlock()
+	if acme && limited {
+		st.RetryAt = until
+		st.LastError = fmt.Sprintf("rate limited until %s", until.Format(time.RFC3339))
+		m.logger.Warnf("Not ordering a certificate for %s to stay within the CA's rate limits, retrying at %s", domain.Name, until.Format(time.RFC3339))
+		return errors.New(st.LastError)
+	}
+
+	var res *certificate.Resource
+	var err error
+	if renewal {
+		m.logger.Infof("Renewing certificate for %s, it expires at %s", domain.Name, leaf.NotAfter.Format(time.RFC3339))
+	}
+	switch {
+	case !acme:
+		res, err = m.issueSelfSigned(domain)
+	case renewal:
+		res, err = m.renewCertificate(domain, st, certPEM, leaf)
+	default:
+		res, err = m.obtainCertificate(domain)
+	}
+	if err == nil {
+		var pem []byte
+		if pem, err = m.saveCertificate(domain.Name, res); err == nil {
+			m.loadCertificate(domain.Name, pem)
+		}
+	}
+	if err != nil {
+		st.Failures++
+		st.RetryAt = now.Add(backoff(st.Failures))
+		st.LastError = err.Error()
+		m.logger.Errorf("Failed to get a certificate for %s (attempt %d), retrying at %s: %v",
+			domain.Name, st.Failures, st.RetryAt.Format(time.RFC3339), err)
+		return err
+	}
+
+	if acme {
+		m.stateMutex.Lock()
+		m.state.record(names, now, renewal)
+		m.stateMutex.Unlock()
+	}
+	*st = certState{Mode: domain.mode(), CertURL: res.CertURL, CertStableURL: res.CertStableURL}
+	if newLeaf, err := certcrypto.ParsePEMCertificate(res.Certificate); err == nil {
+		m.updateRenewalTime(domain, st, newLeaf, now)
+	}
+	return nil
+}
+
+// renewCertificate renews an existing certificate. With ARI the order says which certificate
+// it replaces, which exempts it from rate limits. A new private key is generated either way.
+func (m *Manager) renewCertificate(domain *Domain, st *certState, certPEM []byte, leaf *x509.Certificate) (*certificate.Resource, error) {
+	client, err := m.clientFor(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.ARI {
+		replaces, err := certificate.MakeARICertID(leaf)
+		if err != nil {
+			return nil, err
+		}
+		return client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains:        certcrypto.ExtractDomains(leaf),
+			Bundle:         true,
+			PreferredChain: m.config.PreferredChain,
+			ReplacesCertID: replaces,
+		})
+	}
+
+	res := certificate.Resource{
+		Domain:        domain.Name,
+		CertURL:       st.CertURL,
+		CertStableURL: st.CertStableURL,
+		Certificate:   certPEM,
+	}
+	return client.Certificate.RenewWithOptions(res, &certificate.RenewOptions{
+		Bundle:         true,
+		PreferredChain: m.config.PreferredChain,
+	})
+}
+
+// checkManualCertificate copies a ModeManual certificate into CertDir and loads it when it
+// changed. It reports whether the state changed, and what is wrong with the certificate.
+func (m *Manager) checkManualCertificate(domain *Domain, st *certState) (bool, error) {
+	certPEM, err := os.ReadFile(domain.CertFile)
+	var keyPEM []byte
+	if err == nil {
+		keyPEM, err = os.ReadFile(domain.KeyFile)
+	}
+	var leaf *x509.Certificate
+	if err == nil {
+		leaf, err = certcrypto.ParsePEMCertificate(certPEM)
+	}
+	if err == nil {
+		_, err = tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid certificate for %s in %s and %s: %w", domain.Name, domain.CertFile, domain.KeyFile, err)
+		// Only log it once, the files are checked every minute
+		if st.LastError == err.Error() {
+			return false, err
+		}
+		st.LastError = err.Error()
+		m.logger.Errorf("%v", err)
+		return true, err
+	}
+
+	res := &certificate.Resource{Domain: domain.Name, Certificate: certPEM, PrivateKey: keyPEM}
+	saved, _ := os.ReadFile(filepath.Join(m.config.CertDir, fileName(domain.Name)+".crt.key"))
+	if st.mode() == ModeManual && st.LastError == "" && bytes.Equal(saved, combinedPEM(res)) {
+		return false, nil
+	}
+
+	for _, name := range domain.names() {
+		// A wildcard has to cover any subdomain
+		host := strings.Replace(name, "*", "turkis-check", 1)
+		if leaf.VerifyHostname(host) != nil {
+			m.logger.Warnf("The certificate in %s isn't valid for %s", domain.CertFile, name)
+		}
+	}
+	pem, err := m.saveCertificate(domain.Name, res)
+	if err != nil {
+		st.LastError = err.Error()
+		return true, err
+	}
+	m.loadCertificate(domain.Name, pem)
+	*st = certState{Mode: ModeManual}
+	m.logger.Infof("Loaded certificate for %s from %s", domain.Name, domain.CertFile)
+	return true, nil
+}
+
+// loadLeaf reads a domain's saved certificate
+func (m *Manager) loadLeaf(domain string) ([]byte, *x509.Certificate, error) {
+	certPEM, err := os.ReadFile(filepath.Join(m.config.CertDir, fileName(domain)+".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := certcrypto.ParsePEMCertificate(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate for %s: %w", domain, err)
+	}
+	return certPEM, leaf, nil
+}
+
+// mode returns where the domain's certificate comes from
+func (d *Domain) mode() string {
+	if d.Mode == "" {
+		return ModeACME
+	}
+	return d.Mode
+}
+
+// mode returns where the certificate came from
+func (s *certState) mode() string {
+	if s.Mode == "" {
+		return ModeACME
+	}
+	return s.Mode
+}
+
+// names returns the domain and its aliases
+func (d *Domain) names() []string {
+	return append([]string{d.Name}, d.Aliases...)
+}
+
+// defaultRenewAt is two thirds through the certificate's lifetime
+func defaultRenewAt(leaf *x509.Certificate) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotAfter.Add(-lifetime / 3)
+}
+
+// backoff is the delay before the next attempt after failures, with jitter so certificates
+// that failed together aren't retried together
+func backoff(failures int) time.Duration {
+	delay := retryMaxDelay
+	if failures < 20 {
+		delay = min(retryBaseDelay<<(failures-1), retryMaxDelay)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// registeredDomain returns the domain a name was registered as, e.g. example.co.uk for
+// www.example.co.uk
+func registeredDomain(name string) string {
+	name = strings.TrimPrefix(name, "*.")
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return registered
+	}
+	return name
+}
+
+func sortedNames(names []string) []string {
+	sorted := slices.Clone(names)
+	sort.Strings(sorted)
+	return slices.Compact(sorted)
+}
+
+func sameNames(a, b []string) bool {
+	return slices.Equal(sortedNames(a), sortedNames(b))
+}
+
+func earliest(times []time.Time) time.Time {
+	first := times[0]
+	for _, t := range times[1:] {
+		if t.Before(first) {
+			first = t
+		}
+	}
+	return first
+}
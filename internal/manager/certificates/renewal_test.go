@@ -0,0 +1,180 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+var testNow = time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 5 * time.Minute},
+		{failures: 2, want: 10 * time.Minute},
+		{failures: 5, want: 80 * time.Minute},
+		{failures: 9, want: 1280 * time.Minute},
+		{failures: 10, want: 24 * time.Hour},
+		{failures: 20, want: 24 * time.Hour},
+		// Large enough to overflow the shift
+		{failures: 100, want: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if got := backoff(tt.failures); got < tt.want/2 || got >= tt.want {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.failures, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+// issuances returns n issuances of names, one an hour until an hour before testNow.
+func issuances(n int, names []string, renewal bool) []issuance {
+	var issued []issuance
+	for i := n; i > 0; i-- {
+		issued = append(issued, issuance{Names: names, IssuedAt: testNow.Add(-time.Duration(i) * time.Hour), Renewal: renewal})
+	}
+	return issued
+}
+
+func TestRateLimited(t *testing.T) {
+	names := []string{"example.com", "www.example.com"}
+	var subdomains []issuance
+	for i := range certificatesPerDomain {
+		subdomains = append(subdomains, issuance{Names: []string{fmt.Sprintf("app%d.example.com", i)}, IssuedAt: testNow.Add(-time.Duration(i+1) * time.Minute)})
+	}
+
+	tests := []struct {
+		name        string
+		issuances   []issuance
+		names       []string
+		renewal     bool
+		replacement bool
+		wantLimited bool
+		// wantRetry is when to try again
+		wantRetry time.Time
+	}{
+		{name: "nothing issued", names: names},
+		{name: "duplicates below the limit", issuances: issuances(duplicateCertificates-1, names, true), names: names, renewal: true},
+		{
+			name:        "duplicates",
+			issuances:   issuances(duplicateCertificates, names, true),
+			names:       []string{"www.example.com", "example.com"},
+			renewal:     true,
+			wantLimited: true,
+			wantRetry:   testNow.Add(-time.Duration(duplicateCertificates) * time.Hour).Add(rateLimitWindow),
+		},
+		{
+			name:      "duplicates outside the window",
+			issuances: append([]issuance{{Names: names, IssuedAt: testNow.Add(-rateLimitWindow)}}, issuances(duplicateCertificates-1, names, true)...),
+			names:     names,
+			renewal:   true,
+		},
+		{name: "ARI replacements are exempt", issuances: issuances(duplicateCertificates, names, true), names: names, renewal: true, replacement: true},
+		{
+			name:        "per registered domain",
+			issuances:   subdomains,
+			names:       []string{"new.example.com"},
+			wantLimited: true,
+			wantRetry:   testNow.Add(-time.Duration(certificatesPerDomain) * time.Minute).Add(rateLimitWindow),
+		},
+		{name: "renewals don't count per registered domain", issuances: subdomains, names: []string{"app1.example.com"}, renewal: true},
+		{name: "other registered domains", issuances: subdomains, names: []string{"example.org"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.issuances {
+				tt.issuances[i].Names = sortedNames(tt.issuances[i].Names)
+			}
+			s := &renewalState{Issuances: tt.issuances}
+			retry, limited := s.rateLimited(tt.names, testNow, tt.renewal, tt.replacement)
+			if limited != tt.wantLimited || !retry.Equal(tt.wantRetry) {
+				t.Errorf("rateLimited() = %s, %t, want %s, %t", retry, limited, tt.wantRetry, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	s := &renewalState{Issuances: []issuance{
+		{Names: []string{"old.example.com"}, IssuedAt: testNow.Add(-rateLimitWindow)},
+		{Names: []string{"recent.example.com"}, IssuedAt: testNow.Add(-time.Hour)},
+	}}
+	s.record([]string{"www.example.com", "example.com"}, testNow, false)
+
+	if len(s.Issuances) != 2 || s.Issuances[0].Names[0] != "recent.example.com" {
+		t.Fatalf("issuances = %v, want the recent one and the new one", s.Issuances)
+	}
+	if got := s.Issuances[1]; !sameNames(got.Names, []string{"example.com", "www.example.com"}) || !got.IssuedAt.Equal(testNow) {
+		t.Errorf("recorded %v", got)
+	}
+}
+
+func TestApplyRenewalInfo(t *testing.T) {
+	leaf := &x509.Certificate{NotBefore: testNow.Add(-30 * 24 * time.Hour), NotAfter: testNow.Add(60 * 24 * time.Hour)}
+	lifetime := testNow.Add(30 * 24 * time.Hour)
+	window := func(start, end time.Duration) *certificate.RenewalInfoResponse {
+		return &certificate.RenewalInfoResponse{RenewalInfoResponse: acme.RenewalInfoResponse{
+			SuggestedWindow: acme.Window{Start: testNow.Add(start), End: testNow.Add(end)},
+		}}
+	}
+	earlier := certState{ARI: true, RenewAt: testNow.Add(time.Hour), WindowStart: testNow, WindowEnd: testNow.Add(2 * time.Hour)}
+
+	tests := []struct {
+		name  string
+		state certState
+		info  *certificate.RenewalInfoResponse
+		// RenewAt is wanted between from and to, to excluded unless they are equal
+		from, to   time.Time
+		wantARI    bool
+		wantPicked bool
+		wantErr    bool
+	}{
+		{name: "no renewal information", info: nil, from: lifetime, to: lifetime},
+		{name: "no renewal information keeps an earlier window", state: earlier, info: nil, from: earlier.RenewAt, to: earlier.RenewAt, wantARI: true},
+		{name: "window ahead", info: window(24*time.Hour, 48*time.Hour), from: testNow.Add(24 * time.Hour), to: testNow.Add(48 * time.Hour), wantARI: true, wantPicked: true},
+		{name: "window started", info: window(-time.Hour, time.Hour), from: testNow, to: testNow.Add(time.Hour), wantARI: true, wantPicked: true},
+		{name: "window passed", info: window(-48*time.Hour, -24*time.Hour), from: testNow, to: testNow, wantARI: true, wantPicked: true},
+		{name: "same window", state: earlier, info: window(0, 2*time.Hour), from: earlier.RenewAt, to: earlier.RenewAt, wantARI: true},
+		{name: "window ends before it starts", info: window(48*time.Hour, 24*time.Hour), from: lifetime, to: lifetime, wantErr: true},
+		{name: "window ends before it starts keeps an earlier window", state: earlier, info: window(48*time.Hour, 24*time.Hour), from: earlier.RenewAt, to: earlier.RenewAt, wantARI: true, wantErr: true},
+		{name: "no window", info: &certificate.RenewalInfoResponse{}, from: lifetime, to: lifetime, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := tt.state
+			picked, err := st.applyRenewalInfo(tt.info, leaf, testNow)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyRenewalInfo() error = %v, want an error: %t", err, tt.wantErr)
+			}
+			if picked != tt.wantPicked || st.ARI != tt.wantARI {
+				t.Errorf("picked = %t, ARI = %t, want %t, %t", picked, st.ARI, tt.wantPicked, tt.wantARI)
+			}
+			if st.RenewAt.Before(tt.from) || st.RenewAt.After(tt.to) || (st.RenewAt.Equal(tt.to) && !tt.from.Equal(tt.to)) {
+				t.Errorf("RenewAt = %s, want between %s and %s", st.RenewAt, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestApplyRenewalInfoRetryAfter(t *testing.T) {
+	leaf := &x509.Certificate{NotBefore: testNow.Add(-30 * 24 * time.Hour), NotAfter: testNow.Add(60 * 24 * time.Hour)}
+	st := certState{NextCheck: testNow.Add(24 * time.Hour)}
+	info := &certificate.RenewalInfoResponse{
+		RenewalInfoResponse: acme.RenewalInfoResponse{SuggestedWindow: acme.Window{Start: testNow.Add(time.Hour), End: testNow.Add(2 * time.Hour)}},
+		RetryAfter:          6 * time.Hour,
+	}
+	if _, err := st.applyRenewalInfo(info, leaf, testNow); err != nil {
+		t.Fatal(err)
+	}
+	if want := testNow.Add(6 * time.Hour); !st.NextCheck.Equal(want) {
+		t.Errorf("NextCheck = %s, want %s", st.NextCheck, want)
+	}
+}
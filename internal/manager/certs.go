@@ -0,0 +1,216 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/manager/certificates"
+)
+
+// Certificates keeps a certificates.Manager in line with the domains of the running
+// deployments. The ACME account is created from the email and account settings in the
+// container labels, so the certificate manager restarts when the account settings change.
+// Domains with tls mode none get no certificate.
+//
+// Like the Reconciler, Sync never blocks and Run does the work, so talking to the ACME server
+// doesn't hold up routing.
+type Certificates struct {
+	config certificates.Config
+
+	domainsMutex sync.Mutex
+	domains      map[string]certificates.Domain
+	account      certificates.Config
+
+	dirty chan struct{}
+	// manager is set by Run and read by the API handlers.
+	managerMutex sync.Mutex
+	manager      *certificates.Manager
+	watcher      *certificates.DomainWatcher
+	// running is the config manager was started with.
+	running certificates.Config
+}
+
+// NewCertificates creates Certificates. cfg.Email is taken from the deployments, and so are
+// the other ACME account settings when apps.yml sets them.
+func NewCertificates(cfg certificates.Config) *Certificates {
+	return &Certificates{
+		config:  cfg,
+		domains: make(map[string]certificates.Domain),
+		dirty:   make(chan struct{}, 1),
+	}
+}
+
+// GetAllDomains returns the canonical domains of the running deployments with their aliases
+// and how to prove control of them. It implements certificates.DomainProvider.
+func (c *Certificates) GetAllDomains() map[string]certificates.Domain {
+	c.domainsMutex.Lock()
+	defer c.domainsMutex.Unlock()
+
+	domains := make(map[string]certificates.Domain, len(c.domains))
+	for name, domain := range c.domains {
+		domains[name] = domain
+	}
+	return domains
+}
+
+// Sync records the domains of deployments. Certificates are obtained in the background by Run.
+func (c *Certificates) Sync(deployments []Deployment) {
+	domains := make(map[string]certificates.Domain)
+	account := c.config
+	// Deployments come in no particular order, so pick the account by app name.
+	sorted := append([]Deployment(nil), deployments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Labels.AppName < sorted[j].Labels.AppName })
+	for _, d := range sorted {
+		if d.Labels.ACMEEmail != "" && account.Email == "" {
+			account = c.accountConfig(d.Labels)
+		}
+		for _, domain := range d.Labels.Domains {
+			if domain.Canonical == "" || !domain.ServesHTTPS() {
+				continue
+			}
+			// Apps sharing a domain through paths share its certificate, with the aliases of all of them.
+			if existing, ok := domains[domain.Canonical]; ok {
+				for _, alias := range domain.Aliases {
+					if !slices.Contains(existing.Aliases, alias) {
+						existing.Aliases = append(existing.Aliases, alias)
+					}
+				}
+				domains[domain.Canonical] = existing
+				continue
+			}
+			domains[domain.Canonical] = certificates.Domain{
+				Name:        domain.Canonical,
+				Aliases:     slices.Clone(domain.Aliases),
+				Challenge:   d.Labels.TLS.Challenge,
+				DNSProvider: d.Labels.TLS.DNSProvider,
+				Mode:        domain.TLS.Mode,
+				CertFile:    domain.TLS.Cert,
+				KeyFile:     domain.TLS.Key,
+			}
+		}
+	}
+
+	c.domainsMutex.Lock()
+	c.domains = domains
+	c.account = account
+	c.domainsMutex.Unlock()
+
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the certificate manager and syncs its domains after every Sync, until ctx is done.
+func (c *Certificates) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if c.manager != nil {
+				c.manager.Stop()
+			}
+			return
+		case <-c.dirty:
+		}
+
+		c.domainsMutex.Lock()
+		account := c.account
+		c.domainsMutex.Unlock()
+
+		if c.manager != nil && !sameAccount(c.running, account) {
+			log.Printf("ACME account settings changed, restarting the certificate manager")
+			c.manager.Stop()
+			c.setManager(nil)
+		}
+		if c.manager == nil && !c.start(account) {
+			continue
+		}
+		c.watcher.SyncDomains()
+	}
+}
+
+// start creates and starts the certificate manager. It reports whether it is running; a
+// failure is retried on the next Sync.
+func (c *Certificates) start(cfg certificates.Config) bool {
+	m, err := certificates.NewManager(cfg)
+	if err != nil {
+		log.Printf("Failed to create certificate manager: %v", err)
+		return false
+	}
+	if err := m.Start(); err != nil {
+		log.Printf("Failed to start certificate manager: %v", err)
+		m.Stop()
+		return false
+	}
+
+	switch {
+	case cfg.Email == "":
+		log.Printf("Certificate manager started without an ACME account, no app sets an acmeEmail")
+	case cfg.CADirURL != "":
+		log.Printf("Certificate manager started for %s using %s", cfg.Email, cfg.CADirURL)
+	case cfg.TlsStaging:
+		log.Printf("Certificate manager started for %s using the Let's Encrypt staging server", cfg.Email)
+	default:
+		log.Printf("Certificate manager started for %s", cfg.Email)
+	}
+	c.setManager(m)
+	c.running = cfg
+	c.watcher = certificates.NewDomainWatcher(m, c)
+	return true
+}
+
+// ErrNoCertificateManager is returned for certificate requests before the certificate manager
+// has started, or when it is disabled by dry-run mode.
+var ErrNoCertificateManager = errors.New("the certificate manager isn't running")
+
+// Manager returns the running certificate manager. Certificates can be nil in dry-run mode.
+func (c *Certificates) Manager() (*certificates.Manager, error) {
+	if c == nil {
+		return nil, ErrNoCertificateManager
+	}
+	c.managerMutex.Lock()
+	defer c.managerMutex.Unlock()
+	if c.manager == nil {
+		return nil, ErrNoCertificateManager
+	}
+	return c.manager, nil
+}
+
+func (c *Certificates) setManager(m *certificates.Manager) {
+	c.managerMutex.Lock()
+	c.manager = m
+	c.managerMutex.Unlock()
+}
+
+// accountConfig returns the manager's config with the account settings of labels. Settings
+// from apps.yml win over the manager's environment.
+func (c *Certificates) accountConfig(labels *config.ContainerLabels) certificates.Config {
+	cfg := c.config
+	cfg.Email = labels.ACMEEmail
+	if labels.TLS.CADirectory != "" {
+		cfg.CADirURL = labels.TLS.CADirectory
+	}
+	// The HMAC key never comes from the labels, it is always the manager's.
+	if labels.TLS.EAB.KeyID != "" {
+		cfg.EABKeyID = labels.TLS.EAB.KeyID
+	}
+	if labels.TLS.CABundle != "" {
+		cfg.CABundle = labels.TLS.CABundle
+	}
+	if labels.TLS.PreferredChain != "" {
+		cfg.PreferredChain = labels.TLS.PreferredChain
+	}
+	return cfg
+}
+
+// sameAccount reports whether a and b create the same ACME account and certificates.
+func sameAccount(a, b certificates.Config) bool {
+	return a.Email == b.Email && a.CADirURL == b.CADirURL && a.TlsStaging == b.TlsStaging &&
+		a.EABKeyID == b.EABKeyID && a.EABHMACKey == b.EABHMACKey &&
+		a.CABundle == b.CABundle && a.PreferredChain == b.PreferredChain
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 
 	"github.com/ameistad/turkis/internal/config"
 	"github.com/docker/docker/api/types"
@@ -11,10 +12,26 @@ import (
 )
 
 type DeploymentInstance struct {
-	IP   string
-	Port string
+	ContainerID  string
+	DeploymentID string
+	IP           string
+	Port         string
+	// Weight is the HAProxy server weight. It is 1 unless a canary splits the traffic.
+	Weight int
 }
 
+// ServerName is the name of the instance's server line in its HAProxy backend.
+// It is derived from the container so it stays stable across config regenerations.
+func (i DeploymentInstance) ServerName() string {
+	id := i.ContainerID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return fmt.Sprintf("%s_%s", i.DeploymentID, id)
+}
+
+// Deployment is an app with all of its running containers. During a rolling deploy the
+// instances can belong to more than one deployment ID. Labels come from the newest one.
 type Deployment struct {
 	Labels    *config.ContainerLabels
 	Instances []DeploymentInstance
@@ -35,9 +52,10 @@ func CreateDeployments(ctx context.Context, dockerClient *client.Client) ([]Depl
 		}
 
 		labels, err := config.ParseContainerLabels(container.Config.Labels)
-		if err != nil {
+		if err != nil || labels.Ignore {
 			continue
 		}
+		loadUsersFiles(labels)
 
 		ip, err := ContainerNetworkIP(container, config.DockerNetwork)
 		if err != nil {
@@ -52,30 +70,84 @@ func CreateDeployments(ctx context.Context, dockerClient *client.Client) ([]Depl
 			port = config.DefaultContainerPort
 		}
 
-		instance := DeploymentInstance{IP: ip, Port: port}
+		instance := DeploymentInstance{ContainerID: container.ID, DeploymentID: labels.DeploymentID, IP: ip, Port: port, Weight: 1}
 
+		// Old containers keep serving until the turkis CLI drains them, so every running
+		// container of the app is an instance.
 		if deployment, exists := deploymentsMap[labels.AppName]; exists {
-			// There is a appName match, check if the deployment ID matches.
-			if deployment.Labels.DeploymentID == labels.DeploymentID {
-				deployment.Instances = append(deployment.Instances, instance)
-				deploymentsMap[labels.AppName] = deployment
-			} else {
-				// Replace the deployment if the new one has a higher deployment ID indicating a newer deployment.
-				if deployment.Labels.DeploymentID < labels.DeploymentID {
-					deploymentsMap[labels.AppName] = Deployment{Labels: labels, Instances: []DeploymentInstance{instance}}
-				}
+			deployment.Instances = append(deployment.Instances, instance)
+			// The newest deployment decides the domains and settings.
+			if deployment.Labels.DeploymentID < labels.DeploymentID {
+				deployment.Labels = labels
 			}
+			deploymentsMap[labels.AppName] = deployment
 		} else {
 			deploymentsMap[labels.AppName] = Deployment{Labels: labels, Instances: []DeploymentInstance{instance}}
 		}
 	}
 	var deployments []Deployment
 	for _, deployment := range deploymentsMap {
+		sort.Slice(deployment.Instances, func(i, j int) bool {
+			a, b := deployment.Instances[i], deployment.Instances[j]
+			if a.DeploymentID != b.DeploymentID {
+				return a.DeploymentID < b.DeploymentID
+			}
+			return a.ContainerID < b.ContainerID
+		})
+		setCanaryWeights(&deployment)
 		deployments = append(deployments, deployment)
 	}
+	// Keep the order stable so the generated config only changes when the deployments do.
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Labels.AppName < deployments[j].Labels.AppName
+	})
 	return deployments, nil
 }
 
+// maxServerWeight is the highest weight HAProxy accepts for a server.
+const maxServerWeight = 256
+
+// setCanaryWeights gives the instances of a canary deployment its percentage of the traffic
+// and splits the rest between the older instances. Without a canary every weight stays 1.
+func setCanaryWeights(d *Deployment) {
+	percent := d.Labels.Canary
+	var canary, other int
+	for _, inst := range d.Instances {
+		if inst.DeploymentID == d.Labels.DeploymentID {
+			canary++
+		} else {
+			other++
+		}
+	}
+	if percent <= 0 || canary == 0 || other == 0 {
+		return
+	}
+
+	// Each server's share is its weight divided by the sum of all weights.
+	canaryWeight, otherWeight := percent*other, (100-percent)*canary
+	g := gcd(canaryWeight, otherWeight)
+	canaryWeight, otherWeight = canaryWeight/g, otherWeight/g
+	if highest := max(canaryWeight, otherWeight); highest > maxServerWeight {
+		canaryWeight = max(1, canaryWeight*maxServerWeight/highest)
+		otherWeight = max(1, otherWeight*maxServerWeight/highest)
+	}
+
+	for i := range d.Instances {
+		if d.Instances[i].DeploymentID == d.Labels.DeploymentID {
+			d.Instances[i].Weight = canaryWeight
+		} else {
+			d.Instances[i].Weight = otherWeight
+		}
+	}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
 // ContainerNetworkInfo extracts the container's IP address and exposed ports
 func ContainerNetworkIP(container types.ContainerJSON, networkName string) (string, error) {
 	// Check if the network exists
@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// canaryDeployment is a deployment with canary replicas of the newest deployment next to
+// stable replicas of an older one.
+func canaryDeployment(percent, canary, stable int) Deployment {
+	d := Deployment{Labels: &config.ContainerLabels{AppName: "app", DeploymentID: "20240102000000", Canary: percent}}
+	for i := range stable {
+		d.Instances = append(d.Instances, DeploymentInstance{ContainerID: fmt.Sprintf("stable%d", i), DeploymentID: "20240101000000", Weight: 1})
+	}
+	for i := range canary {
+		d.Instances = append(d.Instances, DeploymentInstance{ContainerID: fmt.Sprintf("canary%d", i), DeploymentID: "20240102000000", Weight: 1})
+	}
+	return d
+}
+
+func TestSetCanaryWeights(t *testing.T) {
+	tests := []struct {
+		name                    string
+		percent, canary, stable int
+		wantCanary, wantStable  int
+	}{
+		{name: "not a canary", percent: 0, canary: 1, stable: 1, wantCanary: 1, wantStable: 1},
+		{name: "promoted", percent: 10, canary: 2, stable: 0, wantCanary: 1},
+		{name: "one replica each", percent: 10, canary: 1, stable: 1, wantCanary: 1, wantStable: 9},
+		{name: "half", percent: 50, canary: 1, stable: 1, wantCanary: 1, wantStable: 1},
+		{name: "one canary replica", percent: 25, canary: 1, stable: 3, wantCanary: 1, wantStable: 1},
+		{name: "more canary replicas", percent: 20, canary: 2, stable: 4, wantCanary: 1, wantStable: 2},
+		{name: "all traffic", percent: 100, canary: 1, stable: 2, wantCanary: 1, wantStable: 0},
+		{name: "highest percentage", percent: 99, canary: 1, stable: 1, wantCanary: 99, wantStable: 1},
+		// 1 to 297 is scaled down to the highest weight HAProxy accepts.
+		{name: "above the highest weight", percent: 1, canary: 3, stable: 1, wantCanary: 1, wantStable: maxServerWeight},
+		// 297 to 1 would leave the stable replicas with weight 0.
+		{name: "stable rounded up", percent: 99, canary: 1, stable: 3, wantCanary: maxServerWeight, wantStable: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := canaryDeployment(tt.percent, tt.canary, tt.stable)
+			setCanaryWeights(&d)
+			for _, inst := range d.Instances {
+				want := tt.wantStable
+				if inst.DeploymentID == d.Labels.DeploymentID {
+					want = tt.wantCanary
+				}
+				if inst.Weight != want {
+					t.Errorf("%s has weight %d, want %d", inst.ContainerID, inst.Weight, want)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package manager
 import (
 	"bytes"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"text/template"
 
@@ -10,85 +12,216 @@ import (
 	"github.com/ameistad/turkis/internal/embed"
 )
 
-func CreateHAProxyConfig(deployments []Deployment) (bytes.Buffer, error) {
+// haproxySections holds the dynamically generated parts of haproxy.cfg.
+type haproxySections struct {
+	HTTPFrontend  string
+	HTTPSFrontend string
+	Backends      string
+}
 
+func CreateHAProxyConfig(deployments []Deployment) (bytes.Buffer, error) {
 	var buf bytes.Buffer
-	var httpsFrontend string
-	var httpFrontend string
-	var backends string
+
+	data, err := embed.TemplatesFS.ReadFile(fmt.Sprintf("templates/%s", config.HAProxyConfigFileName))
+	if err != nil {
+		return buf, fmt.Errorf("failed to read embedded file: %w", err)
+	}
+
+	tmpl, err := template.New("config").Parse(string(data))
+	if err != nil {
+		return buf, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	if err := tmpl.Execute(&buf, createSections(deployments)); err != nil {
+		return buf, fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	return buf, nil
+}
+
+// FrontendChanged reports whether going from previous to next changes anything but the
+// servers inside existing backends and the entries of the map files. Those can be applied
+// through the runtime API, everything else needs a reload.
+func FrontendChanged(previous, next []Deployment) bool {
+	prev := createSections(previous)
+	curr := createSections(next)
+	if prev.HTTPFrontend != curr.HTTPFrontend || prev.HTTPSFrontend != curr.HTTPSFrontend {
+		return true
+	}
+	if suffixMapsChanged(createMaps(previous), createMaps(next)) {
+		return true
+	}
+	return withoutServers(prev.Backends) != withoutServers(curr.Backends)
+}
+
+// withoutServers drops the server lines from generated backends
+func withoutServers(backends string) string {
+	var kept []string
+	for _, line := range strings.Split(backends, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "server ") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// createSections generates the frontend rules that route through the map files, and a
+// backend for every app. Only the rules for stripping path prefixes depend on the domains.
+func createSections(deployments []Deployment) haproxySections {
+	var backends, tables, userlists string
 	const indent = "    "
 
-	for _, d := range deployments {
-		backendName := d.Labels.AppName
-		var canonicalACLs []string
-
-		for _, domain := range d.Labels.Domains {
-			if domain.Canonical != "" {
-				canonicalKey := strings.ReplaceAll(domain.Canonical, ".", "_")
-				canonicalACLName := fmt.Sprintf("%s_%s_canonical", backendName, canonicalKey)
-
-				httpsFrontend += fmt.Sprintf("%sacl %s hdr(host) -i %s\n", indent, canonicalACLName, domain.Canonical)
-				canonicalACLs = append(canonicalACLs, canonicalACLName)
-
-				httpFrontend += fmt.Sprintf("%sacl %s hdr(host) -i %s\n", indent, canonicalACLName, domain.Canonical)
-				httpFrontend += fmt.Sprintf("%shttp-request redirect code 301 location https://%s%%[path] if %s\n",
-					indent, domain.Canonical, canonicalACLName)
-
-				for _, alias := range domain.Aliases {
-					if alias != "" {
-						aliasKey := strings.ReplaceAll(alias, ".", "_")
-						aliasACLName := fmt.Sprintf("%s_%s_alias", backendName, aliasKey)
-
-						httpsFrontend += fmt.Sprintf("%sacl %s hdr(host) -i %s\n", indent, aliasACLName, alias)
-						httpsFrontend += fmt.Sprintf("%shttp-request redirect code 301 location https://%s%%[path] if %s\n",
-							indent, domain.Canonical, aliasACLName)
-
-						httpFrontend += fmt.Sprintf("%sacl %s hdr(host) -i %s\n", indent, aliasACLName, alias)
-						httpFrontend += fmt.Sprintf("%shttp-request redirect code 301 location https://%s%%[path] if %s\n",
-							indent, domain.Canonical, aliasACLName)
-					}
-				}
-			}
+	// Exact hosts are looked up before wildcards, so a host with a domain or alias of its own
+	// never goes to a wildcard app.
+	lines := func(lines ...string) string {
+		var section string
+		for _, line := range lines {
+			section += indent + line + "\n"
 		}
+		return section
+	}
+	host := "var(txn.turkis_host)"
+	noSite := "!{ var(txn.turkis_site) -m found }"
+	noRedirect := "!{ var(txn.turkis_redirect) -m found }"
+	found := func(fetch string) string {
+		return fmt.Sprintf("{ %s -m found }", fetch)
+	}
+	siteMap := func(name string) string { return fmt.Sprintf("%s,map(%s)", host, name) }
+	wildcardMap := func(name string) string { return fmt.Sprintf("%s,map_end(%s)", host, name) }
+
+	// The route is the backend, followed by :<n> when the first n bytes of the path are stripped.
+	stripLengths := createMaps(deployments).stripLengths()
+	routing := func(condition string) []string {
+		rules := []string{
+			"http-request set-var(txn.turkis_route) var(txn.turkis_site),concat(,txn.turkis_path),map_beg(" + routesMap + ") if { var(txn.turkis_site) -m found }" + condition,
+		}
+		for _, n := range stripLengths {
+			rules = append(rules, fmt.Sprintf("http-request set-path /%%[path,bytes(%s)] if { var(txn.turkis_route),field(2,:) -m str %s }", n, n))
+		}
+		return append(rules, "use_backend %[var(txn.turkis_route),field(1,:)] if { var(txn.turkis_route) -m found }")
+	}
 
-		if len(canonicalACLs) > 0 {
-			httpsFrontend += fmt.Sprintf("%suse_backend %s if %s\n", indent, backendName, strings.Join(canonicalACLs, " or "))
+	// A host either gets a site or a redirect, see redirect for its fields. The location is the
+	// target, the requested host when the target ends in //, and the path.
+	redirecting := func(condition string) []string {
+		rules := []string{
+			"http-request set-var(txn.turkis_location) var(txn.turkis_redirect),field(3,|) if { var(txn.turkis_redirect) -m found }",
+			"http-request set-var(txn.turkis_location) var(txn.turkis_location),concat(,txn.turkis_host) if { var(txn.turkis_location) -m end // }",
+			"http-request set-var(txn.turkis_uri) path if { var(txn.turkis_redirect),field(2,|) -m str path }",
+			"http-request set-var(txn.turkis_uri) pathq if { var(txn.turkis_redirect),field(2,|) -m str pathq }",
+		}
+		for _, code := range []int{301, 302, 307, 308} {
+			rules = append(rules, fmt.Sprintf("http-request redirect code %d location %%[var(txn.turkis_location)]%%[var(txn.turkis_uri)] if { var(txn.turkis_redirect),field(1,|) -m str %d }%s", code, code, condition))
 		}
+		return rules
 	}
 
+	// Paths are normalized before they are routed, or a path with access settings of its own,
+	// e.g. /admin, could be reached past them as //admin, /./admin, /x/../admin or /%61dmin,
+	// which most backends treat as /admin. Decoding comes first, %2e is a dot.
+	normalize := lines(
+		"http-request normalize-uri percent-decode-unreserved",
+		"http-request normalize-uri path-merge-slashes",
+		"http-request normalize-uri path-strip-dot",
+		"http-request normalize-uri path-strip-dotdot full",
+	)
+
+	httpFrontend := normalize + lines(
+		"http-request set-var(txn.turkis_host) req.hdr(host),lower",
+		"http-request set-var(txn.turkis_path) path,concat(/)",
+		fmt.Sprintf("http-request set-var(txn.turkis_site) %s", siteMap(httpSitesMap)),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s", siteMap(upgradesMap), noSite),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s %s", siteMap(redirectsMap), noSite, noRedirect),
+		fmt.Sprintf("http-request set-var(txn.turkis_site) %s if %s %s", wildcardMap(httpWildcardsMap), noSite, noRedirect),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s %s", wildcardMap(wildcardUpgradesMap), noSite, noRedirect),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s %s", wildcardMap(wildcardRedirectsMap), noSite, noRedirect),
+	) + lines(redirecting(" !is_acme_challenge")...) + lines(routing(" !is_acme_challenge")...)
+
+	// Hosts served over plain HTTP only are exact hosts too.
+	notHTTP := "!" + found(siteMap(httpSitesMap))
+	httpsFrontend := normalize + lines(
+		"http-request set-var(txn.turkis_host) req.hdr(host),lower",
+		"http-request set-var(txn.turkis_path) path,concat(/)",
+		fmt.Sprintf("http-request set-var(txn.turkis_site) %s", siteMap(httpsSitesMap)),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s", siteMap(redirectsMap), noSite),
+		fmt.Sprintf("http-request set-var(txn.turkis_site) %s if %s %s %s", wildcardMap(httpsWildcardsMap), noSite, noRedirect, notHTTP),
+		fmt.Sprintf("http-request set-var(txn.turkis_redirect) %s if %s %s %s", wildcardMap(wildcardRedirectsMap), noSite, noRedirect, notHTTP),
+	) + lines(redirecting("")...) + lines(routing("")...)
+
 	for _, d := range deployments {
 		backendName := d.Labels.AppName
 		backends += fmt.Sprintf("backend %s\n", backendName)
-		for i, inst := range d.Instances {
-			backends += fmt.Sprintf("%sserver app%d %s:%s check\n", indent, i+1, inst.IP, inst.Port)
+		limits, table := rateLimitRules(d.Labels)
+		backends += lines(limits...)
+		access, userlist := accessRules(d.Labels)
+		backends += lines(access...)
+		backends += lines(headerRules(d.Labels.HTTP)...)
+		if d.Labels.MaxConnections > 0 {
+			// Requests over the limit wait in the backend's queue. Servers added through the
+			// runtime API don't get default-server, the updater passes maxconn for them.
+			backends += lines(fmt.Sprintf("default-server maxconn %d", d.Labels.MaxConnections))
+		}
+		tables += table
+		userlists += userlist
+		for _, inst := range d.Instances {
+			server := fmt.Sprintf("%sserver %s %s:%s check", indent, inst.ServerName(), inst.IP, inst.Port)
+			if inst.Weight != 1 {
+				server += fmt.Sprintf(" weight %d", inst.Weight)
+			}
+			backends += server + "\n"
 		}
 	}
 
-	data, err := embed.TemplatesFS.ReadFile(fmt.Sprintf("templates/%s", config.HAProxyConfigFileName))
-	if err != nil {
-		return buf, fmt.Errorf("failed to read embedded file: %w", err)
+	return haproxySections{
+		HTTPFrontend:  httpFrontend,
+		HTTPSFrontend: httpsFrontend,
+		Backends:      backends + tables + userlists,
 	}
+}
 
-	tmpl, err := template.New("config").Parse(string(data))
-	if err != nil {
-		return buf, fmt.Errorf("failed to parse template: %w", err)
-	}
+func isWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
 
-	templateData := struct {
-		HTTPFrontend  string
-		HTTPSFrontend string
-		Backends      string
-	}{
-		HTTPFrontend:  httpFrontend,
-		HTTPSFrontend: httpsFrontend,
-		Backends:      backends,
+// redirectTarget is where requests for the aliases of domain go: HTTPS, unless the domain is
+// served over plain HTTP only, or over both when it isn't redirected to HTTPS and the scheme
+// of the request is kept. A wildcard canonical domain keeps the requested host.
+func redirectTarget(domain config.Domain, http config.HTTPConfig) string {
+	scheme := "https://"
+	if !domain.ServesHTTPS() {
+		scheme = "http://"
+	} else if !http.RedirectsToHTTPS() {
+		scheme = "//"
+	}
+	if isWildcard(domain.Canonical) {
+		return scheme
 	}
+	return scheme + strings.ToLower(domain.Canonical)
+}
 
-	if err := tmpl.Execute(&buf, templateData); err != nil {
-		return buf, fmt.Errorf("failed to execute template: %w", err)
+// headerRules sets the request and response headers of an app. HSTS is only sent over HTTPS.
+func headerRules(http config.HTTPConfig) []string {
+	var rules []string
+	for _, name := range slices.Sorted(maps.Keys(http.RequestHeaders)) {
+		rules = append(rules, fmt.Sprintf("http-request set-header %s %s", name, quoteHeaderValue(http.RequestHeaders[name])))
+	}
+	for _, name := range slices.Sorted(maps.Keys(http.ResponseHeaders)) {
+		rules = append(rules, fmt.Sprintf("http-response set-header %s %s", name, quoteHeaderValue(http.ResponseHeaders[name])))
+	}
+	if hsts := http.HSTS.HeaderValue(); hsts != "" {
+		rules = append(rules, fmt.Sprintf("http-response set-header Strict-Transport-Security %s if { ssl_fc }", quoteHeaderValue(hsts)))
 	}
+	return rules
+}
 
-	return buf, nil
+// quoteHeaderValue quotes a header value for haproxy.cfg. A % starts a sample fetch in a
+// log-format string.
+func quoteHeaderValue(value string) string {
+	return quote(strings.ReplaceAll(value, "%", "%%"))
 }
 
-// TODO: investigate options to use the running haproxy container to validate the config file.
+// quote quotes a value for haproxy.cfg. Single quotes keep environment variables from being
+// expanded, e.g. in the $ of a bcrypt hash.
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// normalizePath applies the normalize-uri rules of a frontend to path the way HAProxy does.
+// It fails the test for rules it doesn't know and for rules after the path is routed.
+func normalizePath(t *testing.T, frontend, path string) string {
+	t.Helper()
+	routed := false
+	for _, line := range strings.Split(frontend, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "set-var(txn.turkis_path)") {
+			routed = true
+		}
+		action, ok := strings.CutPrefix(line, "http-request normalize-uri ")
+		if !ok {
+			continue
+		}
+		if routed {
+			t.Fatalf("%q comes after the path is routed", line)
+		}
+		switch action {
+		case "percent-decode-unreserved":
+			path = decodeUnreserved(path)
+		case "path-merge-slashes":
+			for strings.Contains(path, "//") {
+				path = strings.ReplaceAll(path, "//", "/")
+			}
+		case "path-strip-dot":
+			path = stripSegments(path, false)
+		case "path-strip-dotdot full":
+			path = stripSegments(path, true)
+		default:
+			t.Fatalf("unknown rule %q", line)
+		}
+	}
+	if !routed {
+		t.Fatal("the frontend doesn't route the path")
+	}
+	return path
+}
+
+// decodeUnreserved decodes the percent-encoded letters, digits and -._~ of path.
+func decodeUnreserved(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+3], 16, 8); err == nil {
+				if c := byte(n); c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+					b.WriteByte(c)
+					i += 2
+					continue
+				}
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// stripSegments removes the . segments of path, or resolves its .. segments against the
+// segment before them. A .. at the root is dropped.
+func stripSegments(path string, dotdot bool) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var kept []string
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch {
+		case s == "." && !dotdot, s == ".." && dotdot:
+			if dotdot && len(kept) > 0 {
+				kept = kept[:len(kept)-1]
+			}
+			// A trailing dot segment leaves its slash behind
+			if last {
+				kept = append(kept, "")
+			}
+		default:
+			kept = append(kept, s)
+		}
+	}
+	return "/" + strings.Join(kept, "/")
+}
+
+// routeAccess looks up the route of a request like the frontend does, and returns the access
+// settings it carries.
+func routeAccess(routes map[string]string, site, path string) string {
+	key := site + path + "/"
+	best := ""
+	for prefix := range routes {
+		if strings.HasPrefix(key, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	fields := strings.Split(routes[best], ":")
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+func TestPathAccessBypass(t *testing.T) {
+	labels := &config.ContainerLabels{
+		AppName: "app",
+		Domains: []config.Domain{{
+			Canonical: "example.com",
+			Paths: []config.Path{
+				{Prefix: "/admin", Access: &config.Access{Allow: []string{"10.0.0.0/8"}}},
+				{Prefix: "/"},
+			},
+		}},
+	}
+	deployments := []Deployment{{Labels: labels}}
+	sections := createSections(deployments)
+	routes := createMaps(deployments)[routesMap]
+	admin := accessName(0, 0)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/admin", want: admin},
+		{path: "/admin/users", want: admin},
+		{path: "//admin", want: admin},
+		{path: "/./admin", want: admin},
+		{path: "/x/../admin", want: admin},
+		{path: "/../admin", want: admin},
+		{path: "/%61dmin", want: admin},
+		{path: "/%2e/admin", want: admin},
+		{path: "/%2E%2E/admin", want: admin},
+		{path: "/public//../admin/", want: admin},
+		{path: "/", want: ""},
+		{path: "/administrator", want: ""},
+		{path: "/admin/..", want: ""},
+	}
+	for name, frontend := range map[string]string{"http": sections.HTTPFrontend, "https": sections.HTTPSFrontend} {
+		for _, tt := range tests {
+			path := normalizePath(t, frontend, tt.path)
+			if got := routeAccess(routes, "example.com", path); got != tt.want {
+				t.Errorf("%s %s is routed as %s with access %q, want %q", name, tt.path, path, got, tt.want)
+			}
+		}
+	}
+}
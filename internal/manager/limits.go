@@ -0,0 +1,44 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// stickTableSize is how many client IPs a rate limit keeps track of. The ones seen least
+// recently make room for new ones.
+const stickTableSize = "100k"
+
+// rateLimitRules counts the requests of every client IP in stick tables and turns away the
+// ones over the app's rate limit. The backend of the app holds the table for the period, the
+// table for the burst needs a backend of its own, which is returned as well. Its name starts
+// with config.ReservedNamePrefix, so no app is named like it.
+func rateLimitRules(labels *config.ContainerLabels) (rules []string, tables string) {
+	rateLimit := labels.RateLimit
+	if !rateLimit.Enabled() {
+		return nil, ""
+	}
+
+	period := haproxyDuration(rateLimit.Window())
+	rules = []string{
+		fmt.Sprintf("stick-table type ipv6 size %s expire %s store http_req_rate(%s)", stickTableSize, period, period),
+		"http-request track-sc0 src",
+		fmt.Sprintf("http-request deny deny_status %d if { sc_http_req_rate(0) gt %d }", rateLimit.Status, rateLimit.Requests),
+	}
+	if rateLimit.Burst > 0 {
+		table := config.ReservedNamePrefix + "burst_" + labels.AppName
+		rules = append(rules,
+			fmt.Sprintf("http-request track-sc1 src table %s", table),
+			fmt.Sprintf("http-request deny deny_status %d if { sc_http_req_rate(1) gt %d }", rateLimit.Status, rateLimit.Burst),
+		)
+		tables = fmt.Sprintf("backend %s\n    stick-table type ipv6 size %s expire 1s store http_req_rate(1s)\n", table, stickTableSize)
+	}
+	return rules, tables
+}
+
+// haproxyDuration formats d in milliseconds, which HAProxy takes everywhere unlike Go's 1m30s.
+func haproxyDuration(d time.Duration) string {
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+func TestRateLimitBackends(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit config.RateLimit
+		want      string
+	}{
+		{
+			name: "no limit",
+			want: `backend app
+    server 1_aaa 10.0.0.1:8080 check
+`,
+		},
+		{
+			name:      "limit",
+			rateLimit: config.RateLimit{Requests: 100, Period: "10s", Status: 429},
+			want: `backend app
+    stick-table type ipv6 size 100k expire 10000ms store http_req_rate(10000ms)
+    http-request track-sc0 src
+    http-request deny deny_status 429 if { sc_http_req_rate(0) gt 100 }
+    server 1_aaa 10.0.0.1:8080 check
+`,
+		},
+		{
+			name:      "limit with a burst",
+			rateLimit: config.RateLimit{Requests: 100, Period: "1m30s", Burst: 20, Status: 503},
+			want: `backend app
+    stick-table type ipv6 size 100k expire 90000ms store http_req_rate(90000ms)
+    http-request track-sc0 src
+    http-request deny deny_status 503 if { sc_http_req_rate(0) gt 100 }
+    http-request track-sc1 src table turkis_burst_app
+    http-request deny deny_status 503 if { sc_http_req_rate(1) gt 20 }
+    server 1_aaa 10.0.0.1:8080 check
+backend turkis_burst_app
+    stick-table type ipv6 size 100k expire 1s store http_req_rate(1s)
+`,
+		},
+		{
+			name:      "invalid period",
+			rateLimit: config.RateLimit{Requests: 5, Period: "often", Status: 429},
+			want: `backend app
+    stick-table type ipv6 size 100k expire 10000ms store http_req_rate(10000ms)
+    http-request track-sc0 src
+    http-request deny deny_status 429 if { sc_http_req_rate(0) gt 5 }
+    server 1_aaa 10.0.0.1:8080 check
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Deployment{
+				Labels:    &config.ContainerLabels{AppName: "app", RateLimit: tt.rateLimit},
+				Instances: []DeploymentInstance{{ContainerID: "aaa", DeploymentID: "1", IP: "10.0.0.1", Port: "8080", Weight: 1}},
+			}
+			if got := createSections([]Deployment{d}).Backends; got != tt.want {
+				t.Errorf("backends:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// Map files the generated config routes with. HAProxy reads them from the directory of
+// haproxy.cfg, and the manager changes their entries through the runtime API, so domains come
+// and go without a reload. Hosts are lowercase.
+const (
+	// httpsSitesMap maps the canonical domains served over HTTPS to themselves.
+	httpsSitesMap = "https-sites.map"
+	// httpsWildcardsMap maps the suffix of a wildcard domain served over HTTPS, e.g.
+	// .example.com, to the domain.
+	httpsWildcardsMap = "https-wildcards.map"
+	// httpSitesMap and httpWildcardsMap are the same for domains with tls mode none.
+	httpSitesMap     = "http-sites.map"
+	httpWildcardsMap = "http-wildcards.map"
+	// upgradesMap maps the canonical domains whose plain HTTP requests are redirected to HTTPS
+	// to the redirect, see redirect. wildcardUpgradesMap does the same for wildcard domains.
+	upgradesMap         = "upgrades.map"
+	wildcardUpgradesMap = "wildcard-upgrades.map"
+	// redirectsMap maps aliases to the redirect to their canonical domain.
+	redirectsMap = "redirects.map"
+	// wildcardRedirectsMap maps the suffix of a wildcard alias to the redirect to its canonical domain.
+	wildcardRedirectsMap = "wildcard-redirects.map"
+	// routesMap maps a canonical domain followed by a path prefix and a slash, e.g.
+	// example.com/api/, to the backend. The longest match wins. The backend is followed by
+	// :<n> when the first n bytes of the path, the prefix and its slash, are stripped, and by
+	// :<n>:<access> when the path has access settings of its own, see accessName.
+	routesMap = "routes.map"
+)
+
+// mapFiles are all map files, the generated config uses every one of them.
+var mapFiles = []string{httpsSitesMap, httpsWildcardsMap, httpSitesMap, httpWildcardsMap, upgradesMap, wildcardUpgradesMap, redirectsMap, wildcardRedirectsMap, routesMap}
+
+// suffixMaps are matched with map_end, where the first matching entry wins rather than the
+// best one. Their entries are ordered, so changing them takes a reload.
+var suffixMaps = []string{httpsWildcardsMap, httpWildcardsMap, wildcardUpgradesMap, wildcardRedirectsMap}
+
+// haproxyMaps holds the entries of every map file by file name.
+type haproxyMaps map[string]map[string]string
+
+func createMaps(deployments []Deployment) haproxyMaps {
+	m := make(haproxyMaps, len(mapFiles))
+	for _, name := range mapFiles {
+		m[name] = make(map[string]string)
+	}
+
+	var routes []route
+	for _, d := range deployments {
+		for i, domain := range d.Labels.Domains {
+			if domain.Canonical == "" {
+				continue
+			}
+			site := strings.ToLower(domain.Canonical)
+			for j, path := range domain.RoutePaths() {
+				r := route{backend: d.Labels.AppName, site: site, path: path}
+				if path.Access != nil {
+					r.access = accessName(i, j)
+				}
+				routes = append(routes, r)
+			}
+
+			// A domain is served over plain HTTP when it has no certificate, or when it isn't
+			// redirected to HTTPS.
+			http := d.Labels.HTTP
+			if domain.ServesHTTPS() {
+				m.addSite(httpsSitesMap, httpsWildcardsMap, site, site)
+				if http.RedirectsToHTTPS() {
+					m.addSite(upgradesMap, wildcardUpgradesMap, site, redirect(http, "https://"))
+				}
+			}
+			if !domain.ServesHTTPS() || !http.RedirectsToHTTPS() {
+				m.addSite(httpSitesMap, httpWildcardsMap, site, site)
+			}
+
+			for _, alias := range domain.Aliases {
+				alias = strings.ToLower(alias)
+				switch {
+				case alias == "":
+				case isWildcard(alias):
+					m.add(wildcardRedirectsMap, strings.TrimPrefix(alias, "*"), redirect(http, redirectTarget(domain, http)))
+				default:
+					m.add(redirectsMap, alias, redirect(http, redirectTarget(domain, http)))
+				}
+			}
+		}
+	}
+
+	sortRoutes(routes)
+	for i, r := range routes {
+		if r.shadowed(routes[:i]) {
+			continue
+		}
+		value := r.backend
+		if r.path.StripPrefix || r.access != "" {
+			value += ":"
+		}
+		if r.path.StripPrefix {
+			value += fmt.Sprint(len(r.path.Prefix) + 1)
+		}
+		if r.access != "" {
+			value += ":" + r.access
+		}
+		m.add(routesMap, r.key(), value)
+	}
+	return m
+}
+
+// add sets an entry unless the map has one for the key. Apps sharing a domain add it more than once.
+func (m haproxyMaps) add(name, key, value string) {
+	if _, ok := m[name][key]; !ok {
+		m[name][key] = value
+	}
+}
+
+// addSite adds a canonical domain to the map for exact hosts, or the suffix of a wildcard
+// domain to the map for wildcards.
+func (m haproxyMaps) addSite(sites, wildcards, site, value string) {
+	if isWildcard(site) {
+		m.add(wildcards, strings.TrimPrefix(site, "*"), value)
+	} else {
+		m.add(sites, site, value)
+	}
+}
+
+// redirect is the value of a redirect in the map files: the status code, whether the query
+// string is kept (pathq) or dropped (path), and the target, separated by |. A target ending
+// in // is followed by the requested host.
+func redirect(http config.HTTPConfig, target string) string {
+	code := http.RedirectCode
+	if code == 0 {
+		code = config.DefaultRedirectCode
+	}
+	uri := "path"
+	if http.PreserveQuery {
+		uri = "pathq"
+	}
+	return fmt.Sprintf("%d|%s|%s", code, uri, target)
+}
+
+// files renders the map files. The longest keys come first, so a more specific wildcard is
+// matched before a shorter one.
+func (m haproxyMaps) files() map[string][]byte {
+	files := make(map[string][]byte, len(m))
+	for name, entries := range m {
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) > len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+
+		var buf bytes.Buffer
+		buf.WriteString("# Generated by turkis-manager\n")
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "%s %s\n", key, entries[key])
+		}
+		files[name] = buf.Bytes()
+	}
+	return files
+}
+
+// stripLengths returns how many bytes the routes strip from paths, without duplicates and
+// sorted. The generated config has a rule for each.
+func (m haproxyMaps) stripLengths() []string {
+	seen := make(map[string]bool)
+	var lengths []string
+	for _, value := range m[routesMap] {
+		if fields := strings.Split(value, ":"); len(fields) > 1 && fields[1] != "" && !seen[fields[1]] {
+			n := fields[1]
+			seen[n] = true
+			lengths = append(lengths, n)
+		}
+	}
+	sort.Strings(lengths)
+	return lengths
+}
+
+// suffixMapsChanged reports whether going from previous to next changes a map that can't be
+// updated through the runtime API.
+func suffixMapsChanged(previous, next haproxyMaps) bool {
+	for _, name := range suffixMaps {
+		if !maps.Equal(previous[name], next[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// route sends the requests for a path prefix of a canonical domain to an app
+type route struct {
+	backend string
+	// site is the lowercase canonical domain
+	site string
+	path config.Path
+	// access names the access settings of the path, empty when the app's apply
+	access string
+}
+
+// key is the routesMap key of the route
+func (r route) key() string {
+	return r.site + strings.TrimSuffix(r.path.Prefix, "/") + "/"
+}
+
+// shadowed reports whether one of the routes before r takes all its requests: the same
+// domain and path, or a shorter path with a higher priority.
+func (r route) shadowed(before []route) bool {
+	for _, other := range before {
+		if other.site == r.site && other.path.Covers(r.path) && (other.path.Prefix == r.path.Prefix || other.path.Priority > r.path.Priority) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRoutes puts the routes in order of precedence: highest priority first, then longest
+// prefix first.
+func sortRoutes(routes []route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].path, routes[j].path
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return len(a.Prefix) > len(b.Prefix)
+	})
+}
@@ -0,0 +1,192 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// firstMatch returns the value of the first entry of a rendered map file whose key matches,
+// the way HAProxy matches map_end and map_beg.
+func firstMatch(file []byte, match func(key string) bool) string {
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if ok && !strings.HasPrefix(key, "#") && match(key) {
+			return value
+		}
+	}
+	return ""
+}
+
+// routeBackend looks up the backend of an HTTPS request like the frontend does: the exact
+// host first, then the wildcards, then the path prefix of the site.
+func routeBackend(m haproxyMaps, host, path string) string {
+	files := m.files()
+	site := m[httpsSitesMap][host]
+	if site == "" {
+		site = firstMatch(files[httpsWildcardsMap], func(key string) bool { return strings.HasSuffix(host, key) })
+	}
+	if site == "" {
+		return ""
+	}
+	route := firstMatch(files[routesMap], func(key string) bool { return strings.HasPrefix(site+path+"/", key) })
+	backend, _, _ := strings.Cut(route, ":")
+	return backend
+}
+
+// routedApp is a deployment of app serving domain with paths.
+func routedApp(app, domain string, paths ...config.Path) Deployment {
+	return Deployment{Labels: &config.ContainerLabels{
+		AppName: app,
+		Domains: []config.Domain{{Canonical: domain, Paths: paths}},
+	}}
+}
+
+func TestRouting(t *testing.T) {
+	type request struct {
+		host, path, want string
+	}
+	tests := []struct {
+		name        string
+		deployments []Deployment
+		requests    []request
+	}{
+		{
+			name: "longest prefix",
+			deployments: []Deployment{
+				routedApp("site", "example.com"),
+				routedApp("api", "example.com", config.Path{Prefix: "/api"}),
+			},
+			requests: []request{
+				{host: "example.com", path: "/", want: "site"},
+				{host: "example.com", path: "/api", want: "api"},
+				{host: "example.com", path: "/api/users", want: "api"},
+				{host: "example.com", path: "/apis", want: "site"},
+			},
+		},
+		{
+			name: "equal-length prefixes",
+			deployments: []Deployment{
+				routedApp("site", "example.com"),
+				routedApp("api", "example.com", config.Path{Prefix: "/api"}),
+				routedApp("app", "example.com", config.Path{Prefix: "/app"}),
+			},
+			requests: []request{
+				{host: "example.com", path: "/api/x", want: "api"},
+				{host: "example.com", path: "/app/x", want: "app"},
+				{host: "example.com", path: "/apx", want: "site"},
+			},
+		},
+		{
+			name: "priority over a longer prefix",
+			deployments: []Deployment{
+				routedApp("api", "example.com", config.Path{Prefix: "/api"}),
+				routedApp("maintenance", "example.com", config.Path{Prefix: "/", Priority: 10}),
+			},
+			requests: []request{
+				{host: "example.com", path: "/", want: "maintenance"},
+				{host: "example.com", path: "/api", want: "maintenance"},
+			},
+		},
+		{
+			name: "priority below a longer prefix",
+			deployments: []Deployment{
+				routedApp("site", "example.com", config.Path{Prefix: "/"}),
+				routedApp("api", "example.com", config.Path{Prefix: "/api", Priority: 10}),
+			},
+			requests: []request{
+				{host: "example.com", path: "/", want: "site"},
+				{host: "example.com", path: "/api", want: "api"},
+			},
+		},
+		{
+			name: "exact domain before a wildcard",
+			deployments: []Deployment{
+				routedApp("wildcard", "*.example.com"),
+				routedApp("api", "api.example.com"),
+			},
+			requests: []request{
+				{host: "api.example.com", path: "/", want: "api"},
+				{host: "www.example.com", path: "/", want: "wildcard"},
+				{host: "a.b.example.com", path: "/", want: "wildcard"},
+				{host: "example.com", path: "/", want: ""},
+			},
+		},
+		{
+			name: "longer wildcard first",
+			deployments: []Deployment{
+				routedApp("wildcard", "*.example.com"),
+				routedApp("eu", "*.eu.example.com"),
+			},
+			requests: []request{
+				{host: "www.eu.example.com", path: "/", want: "eu"},
+				{host: "www.example.com", path: "/", want: "wildcard"},
+				{host: "eu.example.com", path: "/", want: "wildcard"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := createMaps(tt.deployments)
+			for _, r := range tt.requests {
+				if got := routeBackend(m, r.host, r.path); got != r.want {
+					t.Errorf("%s%s goes to %q, want %q", r.host, r.path, got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSortRoutes(t *testing.T) {
+	newRoute := func(backend, prefix string, priority int) route {
+		return route{backend: backend, site: "example.com", path: config.Path{Prefix: prefix, Priority: priority}}
+	}
+	routes := []route{
+		newRoute("site", "/", 0),
+		newRoute("api", "/api", 0),
+		newRoute("app", "/app", 0),
+		newRoute("v1", "/api/v1", 0),
+		newRoute("maintenance", "/", 10),
+	}
+	sortRoutes(routes)
+
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.backend)
+	}
+	// Equal priorities and lengths keep their order.
+	if want := "maintenance v1 api app site"; strings.Join(got, " ") != want {
+		t.Errorf("order = %v, want %s", got, want)
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	newRoute := func(site, prefix string, priority int) route {
+		return route{backend: "app", site: site, path: config.Path{Prefix: prefix, Priority: priority}}
+	}
+	tests := []struct {
+		name   string
+		before []route
+		r      route
+		want   bool
+	}{
+		{name: "same prefix", before: []route{newRoute("example.com", "/api", 0)}, r: newRoute("example.com", "/api", 0), want: true},
+		{name: "shorter prefix with a higher priority", before: []route{newRoute("example.com", "/", 10)}, r: newRoute("example.com", "/api", 0), want: true},
+		{name: "shorter prefix with the same priority", before: []route{newRoute("example.com", "/", 0)}, r: newRoute("example.com", "/api", 0)},
+		{name: "longer prefix", before: []route{newRoute("example.com", "/api/v1", 10)}, r: newRoute("example.com", "/api", 0)},
+		{name: "prefix of the name", before: []route{newRoute("example.com", "/api", 10)}, r: newRoute("example.com", "/apis", 0)},
+		{name: "other domain", before: []route{newRoute("example.org", "/", 10)}, r: newRoute("example.com", "/api", 0)},
+		{name: "wildcard", before: []route{newRoute("*.example.com", "/", 10)}, r: newRoute("api.example.com", "/", 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.shadowed(tt.before); got != tt.want {
+				t.Errorf("shadowed() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
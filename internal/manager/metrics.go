@@ -0,0 +1,51 @@
+package manager
+
+import "sync/atomic"
+
+// Metrics counts how the manager brought HAProxy in line with the containers. Safe for
+// concurrent use.
+type Metrics struct {
+	// Triggers is the number of events, timer ticks and API requests that asked for a reconcile.
+	Triggers atomic.Int64
+	// Coalesced is the number of triggers merged into a reconcile that was already pending.
+	Coalesced atomic.Int64
+	// Reconciles is the number of reconciles that ran.
+	Reconciles atomic.Int64
+	// Unchanged is the number of reconciles that found HAProxy already up to date.
+	Unchanged atomic.Int64
+	// RuntimeUpdates is the number of changes applied through the runtime API without a reload.
+	RuntimeUpdates atomic.Int64
+	// Reloads is the number of full HAProxy reloads.
+	Reloads atomic.Int64
+	// Rejected is the number of generated configs that failed validation and were not applied.
+	Rejected atomic.Int64
+}
+
+// MetricsSnapshot is a point-in-time copy of Metrics, returned by GET /v1/metrics.
+type MetricsSnapshot struct {
+	Triggers       int64 `json:"triggers"`
+	Coalesced      int64 `json:"coalesced"`
+	Reconciles     int64 `json:"reconciles"`
+	Unchanged      int64 `json:"unchanged"`
+	RuntimeUpdates int64 `json:"runtimeUpdates"`
+	Reloads        int64 `json:"reloads"`
+	Rejected       int64 `json:"rejected"`
+	// ReloadsAvoided counts the triggers that didn't end in a reload: they were coalesced,
+	// changed nothing or were applied through the runtime API.
+	ReloadsAvoided int64 `json:"reloadsAvoided"`
+}
+
+// Snapshot returns the current values.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		Triggers:       m.Triggers.Load(),
+		Coalesced:      m.Coalesced.Load(),
+		Reconciles:     m.Reconciles.Load(),
+		Unchanged:      m.Unchanged.Load(),
+		RuntimeUpdates: m.RuntimeUpdates.Load(),
+		Reloads:        m.Reloads.Load(),
+		Rejected:       m.Rejected.Load(),
+	}
+	s.ReloadsAvoided = s.Coalesced + s.Unchanged + s.RuntimeUpdates
+	return s
+}
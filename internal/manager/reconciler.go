@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// DefaultDebounce is how long the reconciler waits for more triggers before it reconciles.
+const DefaultDebounce = time.Second
+
+// Reconciler brings HAProxy in line with the containers that are running. The desired state is
+// built from scratch with CreateDeployments every time, so it doesn't matter which event
+// triggered it or whether events were missed. The Updater only touches HAProxy when the
+// desired state differs from what it runs.
+//
+// Triggers are coalesced: Run is the only writer, and a burst of triggers within the debounce
+// window results in a single reconcile.
+type Reconciler struct {
+	dockerClient *client.Client
+	updater      *Updater
+	certificates *Certificates
+	debounce     time.Duration
+	// after is time.After and reconcile is Reconcile, tests replace them.
+	after     func(time.Duration) <-chan time.Time
+	reconcile func(ctx context.Context, reason string) error
+
+	// dirty has room for one signal, set while a reconcile is pending.
+	dirty   chan struct{}
+	mu      sync.Mutex
+	pending bool
+	reasons []string
+}
+
+// NewReconciler creates a Reconciler that applies the running containers through updater.
+// debounce is how long Run waits after a trigger for more to arrive. certificates is synced
+// with the domains of the running deployments on every reconcile, unless it is nil.
+func NewReconciler(dockerClient *client.Client, updater *Updater, certificates *Certificates, debounce time.Duration) *Reconciler {
+	r := &Reconciler{
+		dockerClient: dockerClient,
+		updater:      updater,
+		certificates: certificates,
+		debounce:     debounce,
+		after:        time.After,
+		dirty:        make(chan struct{}, 1),
+	}
+	r.reconcile = r.Reconcile
+	return r
+}
+
+// Trigger asks for a reconcile. It never blocks. reason is logged when something changed.
+func (r *Reconciler) Trigger(reason string) {
+	r.updater.metrics.Triggers.Add(1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasons = append(r.reasons, reason)
+	if r.pending {
+		r.updater.metrics.Coalesced.Add(1)
+		return
+	}
+	r.pending = true
+	r.dirty <- struct{}{}
+}
+
+// Run reconciles whenever a trigger arrives, until ctx is done. Triggers that arrive while a
+// reconcile runs are handled right after it.
+func (r *Reconciler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.dirty:
+		}
+
+		// Let a burst of events settle.
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.after(r.debounce):
+		}
+
+		r.mu.Lock()
+		reasons := r.reasons
+		r.reasons = nil
+		r.pending = false
+		r.mu.Unlock()
+
+		if err := r.reconcile(ctx, summarize(reasons)); err != nil {
+			log.Printf("Reconcile failed: %v", err)
+		}
+	}
+}
+
+// Reconcile computes the desired deployments and applies them right away. Use Trigger
+// unless the caller has to wait for the result.
+func (r *Reconciler) Reconcile(ctx context.Context, reason string) error {
+	r.updater.metrics.Reconciles.Add(1)
+	deployments, err := CreateDeployments(ctx, r.dockerClient)
+	if err != nil {
+		return fmt.Errorf("failed to create deployments: %w", err)
+	}
+	if r.certificates != nil {
+		// Certificates don't depend on HAProxy accepting the config.
+		r.certificates.Sync(deployments)
+	}
+	changed, err := r.updater.Apply(ctx, deployments)
+	if err != nil {
+		return fmt.Errorf("failed to update HAProxy: %w", err)
+	}
+	if changed {
+		log.Printf("Reconciled HAProxy with %d app(s) after %s", len(deployments), reason)
+	}
+	return nil
+}
+
+// summarize joins the reasons of coalesced triggers for the log.
+func summarize(reasons []string) string {
+	if len(reasons) > 3 {
+		return fmt.Sprintf("%s and %d more", strings.Join(reasons[:3], ", "), len(reasons)-3)
+	}
+	return strings.Join(reasons, ", ")
+}
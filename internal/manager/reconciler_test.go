@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ameistad/turkis/internal/haproxy"
+)
+
+// waitForTimer waits until Run waits for the debounce.
+func waitForTimer(t *testing.T, timers *fakeTimers) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		timers.mu.Lock()
+		n := len(timers.timers)
+		timers.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reconciler doesn't debounce")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconcilerCoalesces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	u := NewUpdater(filepath.Join(dir, "haproxy.cfg"), haproxy.NewRuntimeClient(filepath.Join(dir, "none.sock")), func(ctx context.Context) error {
+		return nil
+	}, nil, false)
+	r := NewReconciler(nil, u, nil, DefaultDebounce)
+	timers := &fakeTimers{}
+	r.after = timers.after
+	reconciled := make(chan string, 10)
+	r.reconcile = func(ctx context.Context, reason string) error {
+		reconciled <- reason
+		return nil
+	}
+	go r.Run(ctx)
+
+	// A burst of events, some of them while the reconciler waits for more.
+	for i := range 5 {
+		r.Trigger(fmt.Sprintf("event %d", i))
+	}
+	waitForTimer(t, timers)
+	for i := 5; i < 10; i++ {
+		r.Trigger(fmt.Sprintf("event %d", i))
+	}
+	select {
+	case reason := <-reconciled:
+		t.Fatalf("reconciled after %s before the debounce", reason)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	timers.fire()
+	if reason := <-reconciled; reason != "event 0, event 1, event 2 and 7 more" {
+		t.Errorf("reconciled after %q", reason)
+	}
+	select {
+	case reason := <-reconciled:
+		t.Errorf("reconciled again after %s", reason)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if triggers, coalesced := u.metrics.Triggers.Load(), u.metrics.Coalesced.Load(); triggers != 10 || coalesced != 9 {
+		t.Errorf("%d triggers, %d coalesced, want 10, 9", triggers, coalesced)
+	}
+
+	// A trigger after the reconcile gets one of its own.
+	r.Trigger("event 10")
+	waitForTimer(t, timers)
+	timers.fire()
+	if reason := <-reconciled; reason != "event 10" {
+		t.Errorf("reconciled after %q, want event 10", reason)
+	}
+}
@@ -0,0 +1,737 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameistad/turkis/internal/haproxy"
+)
+
+const (
+	// PhaseDraining means new servers are live and old ones are finishing their sessions.
+	PhaseDraining = "draining"
+	// PhaseActive means the deployment is the only one receiving traffic.
+	PhaseActive = "active"
+	// PhaseFailed means the app's latest change was rejected. HAProxy keeps routing to the
+	// containers it had before.
+	PhaseFailed = "failed"
+)
+
+// AppStatus is the cutover state of an app as seen by the manager.
+type AppStatus struct {
+	App          string `json:"app"`
+	DeploymentID string `json:"deploymentId"`
+	Phase        string `json:"phase"`
+	// Containers are the IDs of the containers HAProxy routes the app's traffic to.
+	Containers []string `json:"containers"`
+	// Error explains why the change failed, for PhaseFailed.
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ConfigStatus is the state of the haproxy.cfg the manager generated last.
+type ConfigStatus struct {
+	// Valid is false when the latest config was rejected and HAProxy runs the last-known-good one.
+	Valid bool `json:"valid"`
+	// Error is why the latest config was rejected.
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// InvalidConfigError is returned by a validator when HAProxy rejects a config file.
+type InvalidConfigError struct {
+	// Output is what haproxy -c printed.
+	Output string
+}
+
+func (e *InvalidConfigError) Error() string {
+	return "HAProxy rejected the config: " + e.Output
+}
+
+// Updater writes haproxy.cfg and brings the running HAProxy in line with it. When only the
+// servers inside existing backends change it uses the runtime API to add new servers and
+// drain old ones. Anything else triggers a full reload.
+type Updater struct {
+	configPath string
+	runtime    *haproxy.RuntimeClient
+	reload     func(ctx context.Context) error
+	validate   func(ctx context.Context, path string) error
+	dryRun     bool
+
+	mu      sync.Mutex
+	applied []Deployment
+	// appliedFiles are haproxy.cfg and the map files that go with applied, by file name.
+	appliedFiles map[string][]byte
+	// rejectedFiles are the last files that failed validation, and rejected the reason.
+	rejectedFiles map[string][]byte
+	rejected      error
+
+	// draining holds the containers the CLI asked to take out of service. They are left out
+	// of every config until they stop running or are undrained.
+	drainingMutex sync.Mutex
+	draining      map[string]bool
+
+	// drains are the servers being drained in the background, by backend/server, with the
+	// function that stops their drain when they are needed again.
+	drainsMutex sync.Mutex
+	drains      map[string]context.CancelFunc
+	// after is time.After, tests replace it.
+	after func(time.Duration) <-chan time.Time
+
+	statusMutex sync.RWMutex
+	status      map[string]AppStatus
+	config      ConfigStatus
+
+	metrics Metrics
+}
+
+// NewUpdater creates an Updater. reload is called whenever a full HAProxy reload is needed.
+// validate checks a candidate config file before it replaces the one at configPath, and
+// returns an *InvalidConfigError when HAProxy rejects it. A nil validate writes configs as is.
+func NewUpdater(configPath string, runtime *haproxy.RuntimeClient, reload func(ctx context.Context) error, validate func(ctx context.Context, path string) error, dryRun bool) *Updater {
+	return &Updater{
+		configPath: configPath,
+		runtime:    runtime,
+		reload:     reload,
+		validate:   validate,
+		dryRun:     dryRun,
+		status:     make(map[string]AppStatus),
+		draining:   make(map[string]bool),
+		drains:     make(map[string]context.CancelFunc),
+		after:      time.After,
+	}
+}
+
+// Drain takes containers out of service on the next Apply. Their servers are drained
+// gracefully like any other server that goes away.
+func (u *Updater) Drain(containerIDs []string) {
+	u.drainingMutex.Lock()
+	defer u.drainingMutex.Unlock()
+
+	for _, id := range containerIDs {
+		u.draining[id] = true
+	}
+}
+
+// Undrain puts containers that were drained back into service on the next Apply.
+func (u *Updater) Undrain(containerIDs []string) {
+	u.drainingMutex.Lock()
+	defer u.drainingMutex.Unlock()
+
+	for _, id := range containerIDs {
+		delete(u.draining, id)
+	}
+}
+
+// withoutDraining returns deployments without the instances that are being drained, and
+// forgets drained containers that are no longer running.
+func (u *Updater) withoutDraining(deployments []Deployment) []Deployment {
+	u.drainingMutex.Lock()
+	defer u.drainingMutex.Unlock()
+
+	running := make(map[string]bool)
+	filtered := make([]Deployment, 0, len(deployments))
+	for _, d := range deployments {
+		instances := make([]DeploymentInstance, 0, len(d.Instances))
+		for _, inst := range d.Instances {
+			running[inst.ContainerID] = true
+			if !u.draining[inst.ContainerID] {
+				instances = append(instances, inst)
+			}
+		}
+		d.Instances = instances
+		filtered = append(filtered, d)
+	}
+	for id := range u.draining {
+		if !running[id] {
+			delete(u.draining, id)
+		}
+	}
+	return filtered
+}
+
+// Apply makes HAProxy route traffic to deployments. Old servers are drained in the background,
+// and their apps are reported as draining until they are removed.
+// Nothing is written or reloaded when the generated config is the one HAProxy already runs.
+// A config that fails validation is never written: HAProxy keeps the last-known-good config
+// and the apps it would have changed are marked as failed. It reports whether anything changed.
+func (u *Updater) Apply(ctx context.Context, deployments []Deployment) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	deployments = u.withoutDraining(deployments)
+	buf, err := CreateHAProxyConfig(deployments)
+	if err != nil {
+		return false, fmt.Errorf("failed to create config: %w", err)
+	}
+	files := createMaps(deployments).files()
+	files[filepath.Base(u.configPath)] = buf.Bytes()
+
+	if u.applied != nil && sameFiles(files, u.appliedFiles) {
+		u.metrics.Unchanged.Add(1)
+		return false, nil
+	}
+	if u.applied == nil && !u.dryRun && u.runningConfig(ctx, files, deployments) {
+		// The manager restarted, but HAProxy kept running what it wrote before.
+		log.Printf("HAProxy already runs the current configuration")
+		u.metrics.Unchanged.Add(1)
+		u.setApplied(deployments, files)
+		return false, nil
+	}
+
+	if u.dryRun {
+		log.Printf("Generated HAProxy config would have been written to %s:\n%s", u.configPath, buf.String())
+		for _, name := range mapFiles {
+			log.Printf("Generated map %s:\n%s", name, files[name])
+		}
+		u.setApplied(deployments, files)
+		return true, nil
+	}
+
+	if u.rejected != nil && sameFiles(files, u.rejectedFiles) {
+		// Nothing changed since it was rejected, so don't validate it again.
+		return false, u.rejected
+	}
+	if err := u.install(ctx, files); err != nil {
+		var invalid *InvalidConfigError
+		if errors.As(err, &invalid) {
+			u.metrics.Rejected.Add(1)
+			u.rejectedFiles, u.rejected = files, fmt.Errorf("kept the last-known-good config: %w", err)
+			u.setFailed(deployments, invalid)
+			return false, u.rejected
+		}
+		return false, fmt.Errorf("failed to write updated config file: %w", err)
+	}
+
+	// Without a previously applied state we can't know what HAProxy is running, so reload.
+	if u.applied == nil || FrontendChanged(u.applied, deployments) || !u.runtime.Available(ctx) {
+		u.metrics.Reloads.Add(1)
+		// The reloaded HAProxy doesn't have the servers being drained, the old process
+		// finishes their sessions.
+		draining := u.cancelDrains()
+		if err := u.reload(ctx); err != nil {
+			return true, err
+		}
+		u.drainAfterReload(ctx, deployments, draining)
+		u.setApplied(deployments, files)
+		return true, nil
+	}
+
+	err = u.applyMaps(ctx, createMaps(u.applied), createMaps(deployments))
+	if err == nil {
+		err = u.applyServers(ctx, deployments)
+	}
+	if err != nil {
+		log.Printf("Failed to update HAProxy through the runtime API, falling back to reload: %v", err)
+		u.metrics.Reloads.Add(1)
+		draining := u.cancelDrains()
+		if err := u.reload(ctx); err != nil {
+			return true, err
+		}
+		u.drainAfterReload(ctx, deployments, draining)
+	} else {
+		u.metrics.RuntimeUpdates.Add(1)
+	}
+	u.setApplied(deployments, files)
+	return true, nil
+}
+
+// Metrics returns the counters of what the updater and the reconciler did.
+func (u *Updater) Metrics() MetricsSnapshot {
+	return u.metrics.Snapshot()
+}
+
+// install validates haproxy.cfg with its map files and moves them into place. The files in
+// the directory of configPath are left alone when validation fails.
+func (u *Updater) install(ctx context.Context, files map[string][]byte) error {
+	dir := filepath.Dir(u.configPath)
+	if u.validate == nil {
+		return writeFiles(dir, files, filepath.Base(u.configPath))
+	}
+
+	// The candidates sit in a directory next to haproxy.cfg, so the HAProxy container can read
+	// them too, and the candidate config finds the candidate maps next to it.
+	candidateDir := filepath.Join(dir, "candidate")
+	defer os.RemoveAll(candidateDir)
+	if err := os.MkdirAll(candidateDir, 0755); err != nil {
+		return err
+	}
+	if err := writeFiles(candidateDir, files, filepath.Base(u.configPath)); err != nil {
+		return err
+	}
+	if err := u.validate(ctx, filepath.Join(candidateDir, filepath.Base(u.configPath))); err != nil {
+		return err
+	}
+	// haproxy.cfg goes last, a reload in between still finds the maps it uses.
+	for _, name := range sortedFileNames(files, filepath.Base(u.configPath)) {
+		if err := os.Rename(filepath.Join(candidateDir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFiles writes files into dir, last at the end
+func writeFiles(dir string, files map[string][]byte, last string) error {
+	for _, name := range sortedFileNames(files, last) {
+		if err := writeFileAtomic(filepath.Join(dir, name), files[name], 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedFileNames returns the names of files sorted, with last at the end
+func sortedFileNames(files map[string][]byte, last string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != last {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := files[last]; ok {
+		names = append(names, last)
+	}
+	return names
+}
+
+// sameFiles reports whether a and b have the same files with the same contents
+func sameFiles(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, data := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(data, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place, so
+// HAProxy never reads a partially written config.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Does nothing once the rename succeeded.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setApplied records what HAProxy runs now.
+func (u *Updater) setApplied(deployments []Deployment, files map[string][]byte) {
+	u.applied = deployments
+	u.appliedFiles = files
+	u.rejectedFiles, u.rejected = nil, nil
+	u.setActive(deployments)
+	u.setConfigStatus(ConfigStatus{Valid: true})
+}
+
+// setFailed marks the apps whose deployment differs from the applied one as failed, and
+// records why the config was rejected.
+func (u *Updater) setFailed(deployments []Deployment, invalid *InvalidConfigError) {
+	log.Printf("HAProxy rejected the generated config, keeping the last-known-good one:\n%s", invalid.Output)
+
+	applied := make(map[string]Deployment, len(u.applied))
+	for _, d := range u.applied {
+		applied[d.Labels.AppName] = d
+	}
+	for _, d := range deployments {
+		current, ok := applied[d.Labels.AppName]
+		if ok && reflect.DeepEqual(current, d) {
+			continue
+		}
+		u.setStatus(AppStatus{App: d.Labels.AppName, DeploymentID: d.Labels.DeploymentID, Phase: PhaseFailed, Containers: containerIDs(current), Error: invalid.Error()})
+	}
+	u.setConfigStatus(ConfigStatus{Valid: false, Error: invalid.Output})
+}
+
+// runningConfig reports whether HAProxy runs files: they are haproxy.cfg and the map files on
+// disk and the servers of every backend match the deployments.
+func (u *Updater) runningConfig(ctx context.Context, files map[string][]byte, deployments []Deployment) bool {
+	for name, data := range files {
+		current, err := os.ReadFile(filepath.Join(filepath.Dir(u.configPath), name))
+		if err != nil || !bytes.Equal(current, data) {
+			return false
+		}
+	}
+	if !u.runtime.Available(ctx) {
+		return false
+	}
+	for _, d := range deployments {
+		servers, err := u.runtime.Servers(ctx, d.Labels.AppName)
+		if err != nil || len(servers) != len(d.Instances) {
+			return false
+		}
+		weights := make(map[string]int, len(servers))
+		for _, server := range servers {
+			weights[server.Name] = server.Weight
+		}
+		for _, inst := range d.Instances {
+			if weight, ok := weights[inst.ServerName()]; !ok || weight != inst.Weight {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Status returns the cutover state of an app.
+func (u *Updater) Status(appName string) (AppStatus, bool) {
+	u.statusMutex.RLock()
+	defer u.statusMutex.RUnlock()
+
+	status, ok := u.status[appName]
+	return status, ok
+}
+
+// ConfigStatus returns the state of the latest generated config.
+func (u *Updater) ConfigStatus() ConfigStatus {
+	u.statusMutex.RLock()
+	defer u.statusMutex.RUnlock()
+
+	return u.config
+}
+
+// Statuses returns the cutover state of every app, sorted by name.
+func (u *Updater) Statuses() []AppStatus {
+	u.statusMutex.RLock()
+	defer u.statusMutex.RUnlock()
+
+	statuses := make([]AppStatus, 0, len(u.status))
+	for _, status := range u.status {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].App < statuses[j].App })
+	return statuses
+}
+
+// applyMaps brings the entries of the maps HAProxy has loaded from previous to next. New
+// entries are added before old ones are deleted, so a domain that moves keeps working.
+func (u *Updater) applyMaps(ctx context.Context, previous, next haproxyMaps) error {
+	loaded, err := u.runtime.Maps(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range mapFiles {
+		if maps.Equal(previous[name], next[name]) {
+			continue
+		}
+		file := ""
+		for _, f := range loaded {
+			if filepath.Base(f) == name {
+				file = f
+				break
+			}
+		}
+		if file == "" {
+			return fmt.Errorf("map %s isn't loaded", name)
+		}
+
+		for key, value := range next[name] {
+			current, ok := previous[name][key]
+			switch {
+			case !ok:
+				log.Printf("Adding %s %s to map %s", key, value, name)
+				err = u.runtime.AddMapEntry(ctx, file, key, value)
+			case current != value:
+				log.Printf("Setting %s to %s in map %s", key, value, name)
+				err = u.runtime.SetMapEntry(ctx, file, key, value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for key := range previous[name] {
+			if _, ok := next[name][key]; !ok {
+				log.Printf("Deleting %s from map %s", key, name)
+				if err := u.runtime.DeleteMapEntry(ctx, file, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyServers adds missing servers to each backend, then drains the ones that are no longer
+// part of the deployment and removes them in the background. A server that is needed again
+// while it drains is put back into service.
+func (u *Updater) applyServers(ctx context.Context, deployments []Deployment) error {
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+
+	for _, d := range deployments {
+		backend := d.Labels.AppName
+		current, err := u.runtime.Servers(ctx, backend)
+		if err != nil {
+			return err
+		}
+
+		desired := make(map[string]DeploymentInstance, len(d.Instances))
+		for _, inst := range d.Instances {
+			desired[inst.ServerName()] = inst
+		}
+
+		existing := make(map[string]haproxy.ServerState, len(current))
+		var stale []string
+		for _, server := range current {
+			existing[server.Name] = server
+			if _, ok := desired[server.Name]; !ok {
+				stale = append(stale, server.Name)
+			}
+		}
+
+		for name, inst := range desired {
+			if server, ok := existing[name]; ok {
+				if cancel, ok := u.drains[backend+"/"+name]; ok {
+					log.Printf("Putting draining server %s/%s back into service", backend, name)
+					cancel()
+					delete(u.drains, backend+"/"+name)
+					if err := u.runtime.ReadyServer(ctx, backend, name); err != nil {
+						return err
+					}
+				}
+				if server.Weight != inst.Weight {
+					log.Printf("Setting weight of server %s/%s to %d", backend, name, inst.Weight)
+					if err := u.runtime.SetWeight(ctx, backend, name, inst.Weight); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			log.Printf("Adding server %s/%s (%s:%s, weight %d)", backend, name, inst.IP, inst.Port, inst.Weight)
+			if err := u.runtime.AddServer(ctx, backend, name, inst.IP+":"+inst.Port, inst.Weight, d.Labels.MaxConnections, true); err != nil {
+				return err
+			}
+		}
+
+		drainTimeout := time.Duration(d.Labels.DrainTime) * time.Second
+		for _, name := range stale {
+			key := backend + "/" + name
+			if _, ok := u.drains[key]; ok {
+				continue
+			}
+			if err := u.runtime.DrainServer(ctx, backend, name); err != nil {
+				return err
+			}
+			drainCtx, cancel := context.WithCancel(ctx)
+			u.drains[key] = cancel
+			go u.drainAndRemove(drainCtx, backend, name, drainTimeout)
+		}
+	}
+	return nil
+}
+
+// drainAndRemove waits for a server to drain and removes it, unless its drain is cancelled.
+func (u *Updater) drainAndRemove(ctx context.Context, backend, server string, timeout time.Duration) {
+	log.Printf("Draining server %s/%s (timeout %s)", backend, server, timeout)
+	remaining, err := u.runtime.WaitForDrain(ctx, backend, server, timeout)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to wait for %s/%s to drain: %v", backend, server, err)
+	} else if remaining > 0 {
+		log.Printf("Server %s/%s still has %d sessions after %s, closing them", backend, server, remaining, timeout)
+	}
+
+	// Removing it under the lock keeps applyServers from putting it back into service meanwhile.
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	delete(u.drains, backend+"/"+server)
+	defer u.finishDraining(backend)
+
+	// A server that can't be deleted stays in maintenance until the next reload.
+	if err := u.runtime.RemoveServer(ctx, backend, server); err != nil {
+		log.Printf("Failed to remove server %s/%s: %v", backend, server, err)
+		return
+	}
+	log.Printf("Removed server %s/%s", backend, server)
+}
+
+// cancelDrains stops the drains before a reload replaces the servers, and returns them by
+// backend/server.
+func (u *Updater) cancelDrains() []string {
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+
+	keys := make([]string, 0, len(u.drains))
+	for key, cancel := range u.drains {
+		cancel()
+		delete(u.drains, key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// drainAfterReload keeps the apps that lost servers in a reload draining for their drain time,
+// while the old HAProxy process finishes the sessions of those servers. draining are the
+// servers that were being drained before the reload, by backend/server. Without an applied
+// state it isn't known which servers HAProxy had, so every app is kept draining.
+func (u *Updater) drainAfterReload(ctx context.Context, deployments []Deployment, draining []string) {
+	previous := make(map[string]Deployment, len(u.applied))
+	for _, d := range u.applied {
+		previous[d.Labels.AppName] = d
+	}
+
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+
+	for _, d := range deployments {
+		backend := d.Labels.AppName
+		timeout := time.Duration(d.Labels.DrainTime) * time.Second
+		if timeout <= 0 {
+			continue
+		}
+
+		var stale []string
+		if u.applied == nil {
+			// Stands for the servers HAProxy may have had
+			stale = []string{""}
+		} else {
+			desired := make(map[string]bool, len(d.Instances))
+			for _, inst := range d.Instances {
+				desired[inst.ServerName()] = true
+			}
+			for _, inst := range previous[backend].Instances {
+				if !desired[inst.ServerName()] {
+					stale = append(stale, inst.ServerName())
+				}
+			}
+		}
+		for _, key := range draining {
+			if name, ok := strings.CutPrefix(key, backend+"/"); ok && !slices.Contains(stale, name) {
+				stale = append(stale, name)
+			}
+		}
+
+		for _, name := range stale {
+			key := backend + "/" + name
+			drainCtx, cancel := context.WithCancel(ctx)
+			u.drains[key] = cancel
+			log.Printf("Waiting %s for the old HAProxy process to finish the sessions of %s", timeout, key)
+			go u.waitForOldProcess(drainCtx, backend, key, u.after(timeout))
+		}
+	}
+}
+
+// waitForOldProcess gives the old HAProxy process until done to finish the sessions of a
+// server that a reload dropped, then marks its backend as active.
+func (u *Updater) waitForOldProcess(ctx context.Context, backend, key string, done <-chan time.Time) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-done:
+	}
+
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	delete(u.drains, key)
+	u.finishDraining(backend)
+}
+
+// drainingBackend reports whether servers of backend are being drained. The caller holds
+// drainsMutex.
+func (u *Updater) drainingBackend(backend string) bool {
+	for key := range u.drains {
+		if strings.HasPrefix(key, backend+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// finishDraining marks backend as active once its last server is drained. The caller holds
+// drainsMutex.
+func (u *Updater) finishDraining(backend string) {
+	if u.drainingBackend(backend) {
+		return
+	}
+	u.statusMutex.Lock()
+	defer u.statusMutex.Unlock()
+
+	if status, ok := u.status[backend]; ok && status.Phase == PhaseDraining {
+		status.Phase = PhaseActive
+		status.UpdatedAt = time.Now()
+		u.status[backend] = status
+	}
+}
+
+// setActive marks the apps of deployments as active, or as draining while old servers of
+// theirs are drained.
+func (u *Updater) setActive(deployments []Deployment) {
+	u.drainsMutex.Lock()
+	defer u.drainsMutex.Unlock()
+
+	for _, d := range deployments {
+		phase := PhaseActive
+		if u.drainingBackend(d.Labels.AppName) {
+			phase = PhaseDraining
+		}
+		u.setStatus(AppStatus{App: d.Labels.AppName, DeploymentID: d.Labels.DeploymentID, Phase: phase, Containers: containerIDs(d)})
+	}
+}
+
+func containerIDs(d Deployment) []string {
+	ids := make([]string, 0, len(d.Instances))
+	for _, inst := range d.Instances {
+		ids = append(ids, inst.ContainerID)
+	}
+	return ids
+}
+
+func (u *Updater) setStatus(status AppStatus) {
+	u.statusMutex.Lock()
+	defer u.statusMutex.Unlock()
+
+	status.UpdatedAt = time.Now()
+	u.status[status.App] = status
+}
+
+func (u *Updater) setConfigStatus(status ConfigStatus) {
+	u.statusMutex.Lock()
+	defer u.statusMutex.Unlock()
+
+	status.UpdatedAt = time.Now()
+	u.config = status
+}
@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+	"github.com/ameistad/turkis/internal/haproxy"
+)
+
+// fakeTimers stands in for time.After, the timers only fire when the test says so.
+type fakeTimers struct {
+	mu     sync.Mutex
+	timers []chan time.Time
+}
+
+func (f *fakeTimers) after(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	f.timers = append(f.timers, c)
+	return c
+}
+
+// fire fires the timers started so far.
+func (f *fakeTimers) fire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.timers {
+		c <- time.Now()
+	}
+	f.timers = nil
+}
+
+// testDeployment is a deployment of app with a container for each ID.
+func testDeployment(deploymentID string, containerIDs ...string) Deployment {
+	d := Deployment{Labels: &config.ContainerLabels{
+		AppName:      "app",
+		DeploymentID: deploymentID,
+		Port:         "8080",
+		DrainTime:    10,
+		Domains:      []config.Domain{{Canonical: "example.com"}},
+	}}
+	for i, id := range containerIDs {
+		d.Instances = append(d.Instances, DeploymentInstance{ContainerID: id, DeploymentID: deploymentID, IP: fmt.Sprintf("10.0.0.%d", i+1), Port: "8080", Weight: 1})
+	}
+	return d
+}
+
+// waitForPhase waits for the background drains to bring app to phase.
+func waitForPhase(t *testing.T, u *Updater, phase string) AppStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, _ := u.Status("app")
+		if status.Phase == phase {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("app is %s, want %s", status.Phase, phase)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApplyReloadDrains(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	reloads := 0
+	// Without a runtime socket every change is a reload.
+	u := NewUpdater(filepath.Join(dir, "haproxy.cfg"), haproxy.NewRuntimeClient(filepath.Join(dir, "none.sock")), func(ctx context.Context) error {
+		reloads++
+		return nil
+	}, nil, false)
+	timers := &fakeTimers{}
+	u.after = timers.after
+
+	// After a restart it isn't known what the old process still serves.
+	if _, err := u.Apply(ctx, []Deployment{testDeployment("20240101000000", "aaa")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPhase(t, u, PhaseDraining)
+	timers.fire()
+	waitForPhase(t, u, PhaseActive)
+
+	// Replacing the container keeps the app draining until the old process had its drain time.
+	if _, err := u.Apply(ctx, []Deployment{testDeployment("20240102000000", "bbb")}); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForPhase(t, u, PhaseDraining)
+	if !slices.Equal(status.Containers, []string{"bbb"}) {
+		t.Errorf("containers = %v, want the new one", status.Containers)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if status, _ := u.Status("app"); status.Phase != PhaseDraining {
+		t.Fatalf("app is %s before the drain time is up", status.Phase)
+	}
+
+	// A reload meanwhile doesn't cut the drain of the first one short.
+	if _, err := u.Apply(ctx, []Deployment{testDeployment("20240102000000", "bbb", "ccc")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPhase(t, u, PhaseDraining)
+	timers.fire()
+	waitForPhase(t, u, PhaseActive)
+
+	// Adding a container drains nothing.
+	if _, err := u.Apply(ctx, []Deployment{testDeployment("20240102000000", "bbb", "ccc", "ddd")}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := u.Status("app"); status.Phase != PhaseActive {
+		t.Errorf("app is %s after scaling up, want %s", status.Phase, PhaseActive)
+	}
+	if reloads != 4 {
+		t.Errorf("%d reloads, want 4", reloads)
+	}
+}
@@ -0,0 +1,108 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// The file functions work on the local disk, or on the host selected with --host.
+
+// errNotExistCode is the exit code of a remote command for a missing file.
+const errNotExistCode = 44
+
+// ReadFile reads a file. A missing file returns an error that satisfies os.IsNotExist.
+func ReadFile(name string) ([]byte, error) {
+	host := config.CurrentHost()
+	if host == nil {
+		return os.ReadFile(name)
+	}
+
+	p := shellPath(name)
+	out, err := Run(context.Background(), host, fmt.Sprintf("test -e %s || exit %d; cat -- %s", p, errNotExistCode, p), nil)
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode() == errNotExistCode {
+		return nil, &fs.PathError{Op: "open", Path: host.Name + ":" + name, Err: fs.ErrNotExist}
+	}
+	return out, err
+}
+
+// WriteFile writes a file, creating its directory if needed. On a host the file is replaced
+// atomically.
+func WriteFile(name string, data []byte, perm fs.FileMode) error {
+	host := config.CurrentHost()
+	if host == nil {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(name, data, perm)
+	}
+
+	p, tmp := shellPath(name), shellPath(name+".tmp")
+	command := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s && mv -f %s %s",
+		shellPath(path.Dir(name)), tmp, perm.Perm(), tmp, tmp, p)
+	_, err := Run(context.Background(), host, command, bytes.NewReader(data))
+	return err
+}
+
+// AppendFile appends data to a file with a single write, creating the file and its directory
+// if needed.
+func AppendFile(name string, data []byte, perm fs.FileMode) error {
+	host := config.CurrentHost()
+	if host == nil {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(data)
+		return err
+	}
+
+	command := fmt.Sprintf("mkdir -p %s && cat >> %s", shellPath(path.Dir(name)), shellPath(name))
+	_, err := Run(context.Background(), host, command, bytes.NewReader(data))
+	return err
+}
+
+// MkdirAll creates a directory and its parents.
+func MkdirAll(name string, perm fs.FileMode) error {
+	host := config.CurrentHost()
+	if host == nil {
+		return os.MkdirAll(name, perm)
+	}
+	_, err := Run(context.Background(), host, "mkdir -p "+shellPath(name), nil)
+	return err
+}
+
+// Location describes where a path is, for messages: the path itself locally, host:path on a host.
+func Location(name string) string {
+	if host := config.CurrentHost(); host != nil {
+		return host.Name + ":" + name
+	}
+	return name
+}
+
+// shellPath quotes a path for the remote shell. A leading ~/ stays outside the quotes so it
+// expands to the home directory of the ssh user.
+func shellPath(name string) string {
+	if rest, ok := strings.CutPrefix(name, "~/"); ok {
+		return `"$HOME"/` + shellQuote(rest)
+	}
+	return shellQuote(name)
+}
+
+// shellQuote wraps s in single quotes for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,181 @@
+// Package remote lets the turkis CLI manage a server over SSH. Connections to the server's
+// Docker daemon and to turkis-manager are tunnelled through ssh processes, and files in the
+// server's config directory are read and written with shell commands.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ameistad/turkis/internal/config"
+)
+
+// sshArgs returns the ssh arguments that select the host. ssh:// destinations are split into
+// their user@host and port, anything else is passed to ssh as is so aliases from
+// ~/.ssh/config work.
+func sshArgs(host *config.Host) []string {
+	u, err := url.Parse(host.SSH)
+	if err != nil || u.Scheme != "ssh" {
+		return []string{"--", host.SSH}
+	}
+	var args []string
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	destination := u.Hostname()
+	if u.User != nil {
+		destination = u.User.Username() + "@" + destination
+	}
+	return append(args, "--", destination)
+}
+
+// sshCommand returns the ssh command that runs remoteCommand on the host. options are passed
+// to ssh before the destination.
+func sshCommand(ctx context.Context, host *config.Host, options []string, remoteCommand string) *exec.Cmd {
+	args := append([]string{}, options...)
+	args = append(args, sshArgs(host)...)
+	if remoteCommand != "" {
+		args = append(args, remoteCommand)
+	}
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// Run runs a shell command on the host with stdin as its input and returns its output.
+func Run(ctx context.Context, host *config.Host, command string, stdin io.Reader) ([]byte, error) {
+	cmd := sshCommand(ctx, host, nil, command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.Bytes(), &CommandError{Host: host.Name, Err: err, Stderr: msg}
+		}
+		return stdout.Bytes(), &CommandError{Host: host.Name, Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// CommandError is returned when a command on a host fails.
+type CommandError struct {
+	Host   string
+	Err    error
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("command on host '%s' failed: %v: %s", e.Host, e.Err, e.Stderr)
+	}
+	return fmt.Sprintf("command on host '%s' failed: %v", e.Host, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code of the remote command, or -1 if it didn't run.
+func (e *CommandError) ExitCode() int {
+	if exitErr, ok := e.Err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// dial starts ssh and returns a connection to its stdin and stdout.
+func dial(ctx context.Context, host *config.Host, options []string, remoteCommand string) (net.Conn, error) {
+	// The connection outlives ctx, which only covers dialing.
+	cmd := sshCommand(context.WithoutCancel(ctx), host, options, remoteCommand)
+	// Passwords and host key prompts go to the terminal, errors to stderr.
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run ssh to host '%s': %w", host.Name, err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, host: host.Name}, nil
+}
+
+// DockerDialer returns a dial function for the Docker client that reaches the Docker daemon
+// on the host through 'docker system dial-stdio', like DOCKER_HOST=ssh:// does.
+func DockerDialer(host *config.Host) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(ctx, host, nil, "docker system dial-stdio")
+	}
+}
+
+// Transport returns an HTTP transport that connects to addresses as seen from the host, so
+// http://127.0.0.1:8080 is the turkis-manager API published on the server.
+func Transport(host *config.Host) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, host, []string{"-W", addr}, "")
+		},
+		// Starting ssh is slow, so keep connections around between requests.
+		IdleConnTimeout: time.Minute,
+	}
+}
+
+// commandConn is a net.Conn over the stdin and stdout of an ssh process.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	host   string
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite closes stdin, so the other end sees EOF. The Docker client uses it for attach.
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return dummyAddr("turkis")
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return dummyAddr(c.host)
+}
+
+// Deadlines aren't supported by pipes. Requests are bounded by their contexts instead.
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return "ssh" }
+func (a dummyAddr) String() string  { return string(a) }